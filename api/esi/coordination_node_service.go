@@ -34,6 +34,10 @@ import (
 //		Submit my facility registration form to ...
 //
 // For information on returning behaviour, consult der_handler.go.
+//
+// Every function sent by a facility to an exchange is addressed to the exchange key of its route, or to an exchange
+// key given explicitly, never to a single stored exchange. A facility registered with several exchanges therefore
+// picks the exchange by setting the route, and no separate exchange-keyed functions are needed.
 
 // GetDerFacilityRegistrationForm sends a message to an exchange to receive a registration form.
 func GetDerFacilityRegistrationForm(client *nkn.MultiClient, request *DerFacilityRegistrationFormRequest) error {
@@ -281,3 +285,213 @@ func ListPrices(client *nkn.MultiClient, datum *PriceDatum) error {
 
 	return nil
 }
+
+// AnnounceKeyRotation announces a new public key, signed by the old key, to a peer.
+func AnnounceKeyRotation(client *nkn.MultiClient, publicKey string, rotation *KeyRotation) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_AnnounceKeyRotation{AnnounceKeyRotation: rotation}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeregisterFacility ends the registration of a facility with an exchange.
+func DeregisterFacility(client *nkn.MultiClient, deregistration *DerFacilityDeregistration) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_DeregisterFacility{DeregisterFacility: deregistration}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(deregistration.Route.GetExchangeKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeRegistration revokes the registration of a facility by an exchange.
+func RevokeRegistration(client *nkn.MultiClient, deregistration *DerFacilityDeregistration) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_RevokeRegistration{RevokeRegistration: deregistration}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(deregistration.Route.GetFacilityKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendPriceMapOfferError sends an error for a price map offer message to a coordination node.
+func SendPriceMapOfferError(client *nkn.MultiClient, publicKey string, offerError *PriceMapOfferError) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_SendPriceMapOfferError{SendPriceMapOfferError: offerError}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ExpirePriceMapOffer notifies a coordination node that an offer has expired without being accepted.
+func ExpirePriceMapOffer(client *nkn.MultiClient, publicKey string, status *PriceMapOfferStatus) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_ExpirePriceMapOffer{ExpirePriceMapOffer: status}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// CancelPriceMapOffer withdraws or cancels an offer made with a coordination node.
+func CancelPriceMapOffer(client *nkn.MultiClient, publicKey string, cancellation *PriceMapOfferCancellation) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_CancelPriceMapOffer{CancelPriceMapOffer: cancellation}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetPriceMapCatalogue sends a message to a facility to receive the catalogue of price maps it offers.
+func GetPriceMapCatalogue(client *nkn.MultiClient, request *DerPriceMapRequest) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_GetPriceMapCatalogue{GetPriceMapCatalogue: request}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(request.Route.GetFacilityKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendPriceMapCatalogue sends the catalogue of price maps offered by a facility to the exchange.
+func SendPriceMapCatalogue(client *nkn.MultiClient, catalogue *PriceMapCharacteristics) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_SendPriceMapCatalogue{SendPriceMapCatalogue: catalogue}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(catalogue.Route.GetExchangeKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RequestBids sends a call for bids to a facility.
+func RequestBids(client *nkn.MultiClient, call *CallForBids) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_RequestBids{RequestBids: call}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(call.Route.GetFacilityKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SubmitBid sends a bid in answer to a call for bids to the exchange.
+func SubmitBid(client *nkn.MultiClient, bid *PriceMapBid) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_SubmitBid{SubmitBid: bid}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(bid.Route.GetExchangeKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListPowerProfile requests the power profile of a facility.
+func ListPowerProfile(client *nkn.MultiClient, request *DatumRequest) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_ListPowerProfile{ListPowerProfile: request}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(request.Route.GetFacilityKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SendPowerProfile sends the power profile of a facility to an exchange.
+func SendPowerProfile(client *nkn.MultiClient, profile *PowerProfile) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_SendPowerProfile{SendPowerProfile: profile}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(profile.Route.GetExchangeKey()), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DisputePriceMapOffer sends a dispute of the outcome of an offer to the other party of the offer.
+func DisputePriceMapOffer(client *nkn.MultiClient, publicKey string, dispute *PriceMapOfferDispute) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_DisputePriceMapOffer{DisputePriceMapOffer: dispute}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ResolvePriceMapOfferDispute sends the resolution of a disputed offer to the party which raised the dispute.
+func ResolvePriceMapOfferDispute(client *nkn.MultiClient, publicKey string, resolution *PriceMapOfferDisputeResolution) error {
+	data, err := proto.Marshal(&CoordinationNodeMessage{Chunk: &CoordinationNodeMessage_ResolvePriceMapOfferDispute{ResolvePriceMapOfferDispute: resolution}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(publicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -79,3 +79,18 @@ func QueryDerFacilities(client *nkn.MultiClient, registryPublicKey string, reque
 
 	return nil
 }
+
+// RotateCoordinationNodeKey replaces the key of a coordination node stored by a registry.
+func RotateCoordinationNodeKey(client *nkn.MultiClient, registryPublicKey string, rotation *KeyRotation) error {
+	data, err := proto.Marshal(&RegistryMessage{Chunk: &RegistryMessage_RotateCoordinationNodeKey{RotateCoordinationNodeKey: rotation}})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Send(nkn.NewStringArray(registryPublicKey), data, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
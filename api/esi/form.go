@@ -0,0 +1,60 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package esi
+
+// form.go
+//
+// This implements the handling of each FormSettingType, so that every user of a Form treats its settings the same way.
+
+// RedactedValue replaces the value of a SECURE_TEXT setting wherever form data is logged or persisted.
+const RedactedValue = "********"
+
+// IsAnswerable returns true if the setting expects a value in the form data.
+//
+// INFO settings are only displayed, and are never answered.
+func (x *FormSetting) IsAnswerable() bool {
+	return x.GetType() != FormSetting_INFO
+}
+
+// IsSecure returns true if the value of the setting must not be echoed, logged or persisted.
+func (x *FormSetting) IsSecure() bool {
+	return x.GetType() == FormSetting_SECURE_TEXT
+}
+
+// RedactFormData returns a copy of the form data with the value of each SECURE_TEXT setting of the form redacted.
+//
+// Values without a matching setting are also redacted, as there is no way to know that they are safe.
+func RedactFormData(form *Form, data *FormData) *FormData {
+	settings := make(map[string]*FormSetting)
+	for _, setting := range form.GetSettings() {
+		settings[setting.GetKey()] = setting
+	}
+
+	redacted := FormData{
+		Key:  data.GetKey(),
+		Data: make(map[string]string),
+	}
+	for key, value := range data.GetData() {
+		setting, ok := settings[key]
+		if !ok || setting.IsSecure() {
+			value = RedactedValue
+		}
+		redacted.Data[key] = value
+	}
+
+	return &redacted
+}
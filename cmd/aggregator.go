@@ -0,0 +1,399 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"sort"
+	"time"
+)
+
+// aggregatorCfgKey is the config key which, if true, runs the coordination node in aggregator mode.
+//
+// In aggregator mode, the facilities registered with the coordination node behaving as an exchange are combined into
+// one virtual facility, whose characteristics are given to every exchange it is registered with behaving as a facility.
+// An offer accepted from an upstream exchange is then split into offers to the downstream facilities.
+const aggregatorCfgKey = "aggregator"
+
+var (
+	// downstreamOffers are the uuids of the offers made to downstream facilities for each upstream offer, by uuid.
+	downstreamOffers = make(map[string][]string)
+)
+
+// aggregatorEnabled returns true if the coordination node is running in aggregator mode.
+func aggregatorEnabled() bool {
+	return viper.GetBool(aggregatorCfgKey)
+}
+
+// aggregateCharacteristics returns the combined characteristics of several facilities.
+//
+// Max power and storage capacity are summed, power factors are averaged by max power, and the response time is that of
+// the slowest facility, as the virtual facility has only responded once every facility has.
+func aggregateCharacteristics(characteristics map[string]*esi.DerCharacteristics) *esi.DerCharacteristics {
+	aggregate := &esi.DerCharacteristics{
+		ResponseTime: &esi.DurationRange{
+			Min: &duration.Duration{},
+			Max: &duration.Duration{},
+		},
+	}
+
+	var loadFactor, supplyFactor float64
+	for _, c := range characteristics {
+		aggregate.LoadPowerMax += c.GetLoadPowerMax()
+		aggregate.SupplyPowerMax += c.GetSupplyPowerMax()
+		aggregate.StorageEnergyCapacity += c.GetStorageEnergyCapacity()
+		loadFactor += float64(c.GetLoadPowerFactor()) * float64(c.GetLoadPowerMax())
+		supplyFactor += float64(c.GetSupplyPowerFactor()) * float64(c.GetSupplyPowerMax())
+
+		if slowerDuration(c.GetResponseTime().GetMin(), aggregate.ResponseTime.Min) {
+			aggregate.ResponseTime.Min = c.ResponseTime.Min
+		}
+		if slowerDuration(c.GetResponseTime().GetMax(), aggregate.ResponseTime.Max) {
+			aggregate.ResponseTime.Max = c.ResponseTime.Max
+		}
+	}
+	if aggregate.LoadPowerMax > 0 {
+		aggregate.LoadPowerFactor = float32(loadFactor / float64(aggregate.LoadPowerMax))
+	}
+	if aggregate.SupplyPowerMax > 0 {
+		aggregate.SupplyPowerFactor = float32(supplyFactor / float64(aggregate.SupplyPowerMax))
+	}
+
+	return aggregate
+}
+
+// slowerDuration returns true if one duration is longer than another.
+func slowerDuration(a *duration.Duration, b *duration.Duration) bool {
+	if a.GetSeconds() != b.GetSeconds() {
+		return a.GetSeconds() > b.GetSeconds()
+	}
+
+	return a.GetNanos() > b.GetNanos()
+}
+
+// publishAggregateCharacteristics gives the combined characteristics of the downstream facilities to every upstream
+// exchange, if running in aggregator mode.
+func publishAggregateCharacteristics() {
+	if !aggregatorEnabled() {
+		return
+	}
+
+	aggregate := aggregateCharacteristics(facilityCharacteristics)
+	for exchangeKey, registration := range registeredExchanges {
+		characteristics := proto.Clone(aggregate).(*esi.DerCharacteristics)
+		characteristics.Route = &esi.DerRoute{
+			ExchangeKey: exchangeKey,
+			FacilityKey: coordinationNodeInfo.GetPublicKey(),
+		}
+		registration.characteristics = characteristics
+
+		err := esi.SendResourceCharacteristics(coordinationNodeClient, characteristics)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"facilities": len(facilityCharacteristics),
+		"exchanges":  len(registeredExchanges),
+	}).Info("Published aggregate characteristics")
+}
+
+// isUpstreamOffer returns true if an offer was made between this coordination node behaving as a facility and another
+// exchange.
+func isUpstreamOffer(offer *esi.PriceMapOffer) bool {
+	return offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() &&
+		offer.Route.GetExchangeKey() != coordinationNodeInfo.GetPublicKey()
+}
+
+// downstreamCapacity returns the capacity of a downstream facility for an amount of real power, which is its max
+// supply for positive power and its max load otherwise.
+func downstreamCapacity(characteristics *esi.DerCharacteristics, realPower int64) int64 {
+	if realPower >= 0 {
+		return int64(characteristics.GetSupplyPowerMax())
+	}
+
+	return int64(characteristics.GetLoadPowerMax())
+}
+
+// splitByCapacity splits an amount between keys in proportion to their capacity, giving any remainder one at a time
+// to the keys with the largest remainders, then by key, so that the split is always the same for the same capacities.
+func splitByCapacity(amount int64, capacities map[string]int64) map[string]int64 {
+	var keys []string
+	var total int64
+	for k, capacity := range capacities {
+		if capacity > 0 {
+			keys = append(keys, k)
+			total += capacity
+		}
+	}
+	shares := make(map[string]int64)
+	if total == 0 {
+		return shares
+	}
+
+	remainders := make(map[string]int64)
+	allocated := int64(0)
+	for _, k := range keys {
+		shares[k] = amount * capacities[k] / total
+		remainders[k] = amount * capacities[k] % total
+		allocated += shares[k]
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := abs(remainders[keys[i]]), abs(remainders[keys[j]])
+		if a != b {
+			return a > b
+		}
+		return keys[i] < keys[j]
+	})
+	step := int64(1)
+	if amount < 0 {
+		step = -1
+	}
+	for i := 0; allocated != amount; i++ {
+		shares[keys[i%len(keys)]] += step
+		allocated += step
+	}
+
+	return shares
+}
+
+// disaggregateOffer splits an accepted upstream offer into offers to the downstream facilities, if running in
+// aggregator mode.
+//
+// Real and reactive power are split in proportion to the capacity of each downstream facility, and each downstream
+// offer starts when the upstream offer does. The price is per VAh, so every downstream offer keeps the upstream price.
+func disaggregateOffer(uuid string) {
+	offer := priceMapOffers[uuid]
+	if !aggregatorEnabled() || !isUpstreamOffer(offer) {
+		return
+	}
+	if _, ok := downstreamOffers[uuid]; ok {
+		return
+	}
+
+	realPower := offer.GetPriceMap().GetPowerComponents().GetRealPower()
+	capacities := make(map[string]int64)
+	var total int64
+	for facilityKey := range registeredFacilities {
+		capacities[facilityKey] = downstreamCapacity(facilityCharacteristics[facilityKey], realPower)
+		total += capacities[facilityKey]
+	}
+	if total == 0 {
+		log.WithFields(log.Fields{
+			"uuid": uuid,
+		}).Warn("No downstream capacity to disaggregate offer")
+		return
+	}
+	if abs(realPower) > total {
+		log.WithFields(log.Fields{
+			"uuid":     uuid,
+			"power":    realPower,
+			"capacity": total,
+		}).Warn("Offer exceeds downstream capacity")
+	}
+
+	realShares := splitByCapacity(realPower, capacities)
+	reactiveShares := splitByCapacity(offer.GetPriceMap().GetPowerComponents().GetReactivePower(), capacities)
+
+	downstreamOffers[uuid] = []string{}
+	for facilityKey, power := range realShares {
+		priceMap := proto.Clone(offer.PriceMap).(*esi.PriceMap)
+		priceMap.PowerComponents = &esi.PowerComponents{
+			RealPower:     power,
+			ReactivePower: reactiveShares[facilityKey],
+		}
+
+		downstream, err := proposeOffer(facilityKey, priceMap, offer.When, 0)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		downstreamOffers[uuid] = append(downstreamOffers[uuid], downstream.OfferId.GetUuid())
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":       uuid,
+		"facilities": len(downstreamOffers[uuid]),
+	}).Info("Disaggregated offer")
+}
+
+// upstreamOffer returns the uuid of the upstream offer a downstream offer was split from, or false if it was not.
+func upstreamOffer(downstream string) (string, bool) {
+	for uuid, offers := range downstreamOffers {
+		for _, v := range offers {
+			if v == downstream {
+				return uuid, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// droppedDownstream returns true if a downstream offer will never be carried out.
+func droppedDownstream(uuid string) bool {
+	switch offerStatus(uuid) {
+	case esi.PriceMapOfferStatus_REJECTED, esi.PriceMapOfferStatus_EXPIRED, esi.PriceMapOfferStatus_CANCELLED:
+		return true
+	}
+
+	return false
+}
+
+// downstreamShortfall returns the real power of an aggregated offer left uncovered by downstream offers which were
+// rejected, expired or cancelled.
+func downstreamShortfall(uuid string) int64 {
+	var shortfall int64
+	for _, downstream := range downstreamOffers[uuid] {
+		if droppedDownstream(downstream) {
+			shortfall += priceMapOffers[downstream].GetPriceMap().GetPowerComponents().GetRealPower()
+		}
+	}
+
+	return shortfall
+}
+
+// dropDownstreamOffer flags the shortfall a downstream offer leaves against its accepted upstream offer, once the
+// downstream offer was rejected, expired or cancelled.
+//
+// The upstream offer cannot be changed once accepted, so if no downstream offer is left to carry any of it out, it is
+// cancelled as lacking capacity, rather than failing once it is due.
+func dropDownstreamOffer(downstream string) {
+	uuid, ok := upstreamOffer(downstream)
+	if !ok || offerStatus(uuid) != esi.PriceMapOfferStatus_ACCEPTED {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":       uuid,
+		"downstream": downstream,
+		"status":     offerStatus(downstream),
+		"shortfall":  downstreamShortfall(uuid),
+		"power":      priceMapOffers[uuid].GetPriceMap().GetPowerComponents().GetRealPower(),
+	}).Warn("Downstream offer dropped from aggregated offer")
+
+	for _, v := range downstreamOffers[uuid] {
+		if !droppedDownstream(v) {
+			return
+		}
+	}
+
+	reason := esi.PriceMapOfferCancellation_CAPACITY_UNAVAILABLE
+	err := cancelOffer(uuid, coordinationNodeInfo.GetPublicKey(), reason)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+	sendOfferCancellation(priceMapOffers[uuid], reason, "no downstream facility will carry out the offer")
+}
+
+// cancelDownstreamOffers cancels the downstream offers an upstream offer was split into which have not started
+// executing, and tells each downstream facility.
+func cancelDownstreamOffers(uuid string, reason esi.PriceMapOfferCancellation_Reason) {
+	for _, downstream := range downstreamOffers[uuid] {
+		if !canTransitionOffer(offerStatus(downstream), esi.PriceMapOfferStatus_CANCELLED) {
+			continue
+		}
+		err := cancelOffer(downstream, coordinationNodeInfo.GetPublicKey(), reason)
+		if err != nil {
+			log.Error(err.Error())
+			continue
+		}
+		sendOfferCancellation(priceMapOffers[downstream], reason, "the upstream offer was cancelled")
+	}
+}
+
+// abs returns the absolute value of x.
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
+
+// aggregatedOffer returns true if an upstream offer was split into offers to the downstream facilities, which carry it
+// out instead of the equipment of this coordination node.
+func aggregatedOffer(uuid string) bool {
+	_, ok := downstreamOffers[uuid]
+	return ok
+}
+
+// aggregateOutcome returns the outcome of an aggregated offer from the offers made to the downstream facilities, or
+// false if any of them has not finished or had its feedback verified yet.
+//
+// The delivery is measured from the combined power profiles of the downstream facilities, as the upstream exchange
+// measures it from the power profile of this coordination node.
+func aggregateOutcome(uuid string, settings verificationSettings) (offerVerification, bool) {
+	executed := false
+	for _, downstream := range downstreamOffers[uuid] {
+		switch offerStatus(downstream) {
+		case esi.PriceMapOfferStatus_UNKNOWN, esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_EXECUTING:
+			return offerVerification{}, false
+		case esi.PriceMapOfferStatus_COMPLETED, esi.PriceMapOfferStatus_FAILED, esi.PriceMapOfferStatus_DISPUTED:
+			feedback, ok := offerFeedback[downstream]
+			if !ok || feedback.ObligationStatus == esi.PriceMapOfferFeedback_UNSATISFIED {
+				continue
+			}
+			if !feedbackVerified(downstream) {
+				return offerVerification{}, false
+			}
+			executed = true
+		}
+	}
+
+	if !executed {
+		return offerVerification{
+			status:  esi.PriceMapOfferFeedback_UNSATISFIED,
+			message: "no downstream facility carried out the offer",
+		}, true
+	}
+	offer := priceMapOffers[uuid]
+	start := time.Unix(offer.GetWhen().GetSeconds(), 0)
+
+	return measureDelivery(offer, start, aggregatedPowerSamples(), settings), true
+}
+
+// finishAggregatedOffer completes or fails an aggregated offer which has finished executing once every downstream
+// offer has finished, and tells the upstream exchange the outcome.
+func finishAggregatedOffer(uuid string) {
+	outcome, ok := aggregateOutcome(uuid, verification)
+	if !ok {
+		return
+	}
+	if outcome.status == esi.PriceMapOfferFeedback_UNSATISFIED {
+		failOffer(uuid, errors.New(outcome.message))
+		return
+	}
+
+	_ = transitionOffer(uuid, esi.PriceMapOfferStatus_COMPLETED)
+
+	log.WithFields(log.Fields{
+		"uuid":      uuid,
+		"claim":     outcome.status,
+		"delivered": fmt.Sprintf("%.1f%%", outcome.deliveredPercentage),
+	}).Info("Aggregated offer has completed")
+
+	sendOfferFeedback(priceMapOffers[uuid], outcome)
+}
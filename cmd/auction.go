@@ -0,0 +1,151 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+)
+
+const (
+	// clearingRuleCfgKey is the config key containing the default auction clearing rule.
+	clearingRuleCfgKey = "auction.clearing-rule"
+
+	// payAsBidRuleName pays each winning bid the price it bid.
+	payAsBidRuleName = "pay-as-bid"
+	// uniformPriceRuleName pays each winning bid the price of the last bid needed to meet the demand.
+	uniformPriceRuleName = "uniform-price"
+)
+
+// clearingRule is the rule used to price the winning bids of an auction.
+type clearingRule int
+
+const (
+	// payAsBidRule pays each winning bid the price it bid.
+	payAsBidRule clearingRule = iota
+	// uniformPriceRule pays each winning bid at the clearing price.
+	uniformPriceRule
+)
+
+// String implements fmt.Stringer.
+func (r clearingRule) String() string {
+	if r == uniformPriceRule {
+		return uniformPriceRuleName
+	}
+
+	return payAsBidRuleName
+}
+
+// parseClearingRule returns the clearing rule with a name.
+func parseClearingRule(name string) (clearingRule, error) {
+	switch name {
+	case payAsBidRuleName:
+		return payAsBidRule, nil
+	case uniformPriceRuleName:
+		return uniformPriceRule, nil
+	}
+
+	return payAsBidRule, fmt.Errorf("unknown clearing rule: '%s'", name)
+}
+
+// defaultClearingRuleName returns the name of the configured clearing rule, or pay-as-bid if none is set.
+func defaultClearingRuleName() string {
+	if viper.IsSet(clearingRuleCfgKey) {
+		return viper.GetString(clearingRuleCfgKey)
+	}
+
+	return payAsBidRuleName
+}
+
+// auctionAward is the power and price awarded to a winning bid.
+type auctionAward struct {
+	bid *esi.PriceMapBid
+	// power is the real power awarded, which is less than the power bid only for the last bid needed.
+	power int64
+	// price is the price per VAh paid for the power awarded.
+	price *esi.Money
+}
+
+// priceMap returns the price map of the bid for the power and price awarded.
+//
+// The reactive power is scaled with the real power, rounded up. The price is per VAh, so it does not depend on the
+// power awarded.
+func (a auctionAward) priceMap() *esi.PriceMap {
+	priceMap := proto.Clone(a.bid.PriceMap).(*esi.PriceMap)
+	priceMap.PowerComponents.ReactivePower = ceilDiv(priceMap.PowerComponents.ReactivePower*a.power, bidPower(a.bid))
+	priceMap.PowerComponents.RealPower = a.power
+	priceMap.Price.ApparentEnergyPrice = proto.Clone(a.price).(*esi.Money)
+
+	return priceMap
+}
+
+// clearAuction awards bids against a demand for real power, or returns an error if all of the bids together do not
+// meet the demand.
+//
+// Bids are taken cheapest price per VAh first, in the order of rankBids, until the demand is met, and the last bid taken
+// is only awarded the power still needed. Under pay-as-bid each winner is paid its own price per VAh, and under uniform
+// price each winner is paid the price per VAh of the last bid taken, which is never less than it bid.
+func clearAuction(demand int64, bids map[string]*esi.PriceMapBid, rule clearingRule) ([]auctionAward, error) {
+	if demand <= 0 {
+		return nil, fmt.Errorf("demand must be positive")
+	}
+
+	var awards []auctionAward
+	remaining := demand
+	for _, bid := range rankBids(bids) {
+		if remaining == 0 {
+			break
+		}
+		if bidPower(bid) <= 0 {
+			continue
+		}
+		power := bidPower(bid)
+		if power > remaining {
+			power = remaining
+		}
+		awards = append(awards, auctionAward{bid: bid, power: power})
+		remaining -= power
+	}
+	if remaining > 0 {
+		return nil, fmt.Errorf("bids offer %d of the %d power needed", demand-remaining, demand)
+	}
+
+	// The clearing price is the price of the last bid taken.
+	marginal := awards[len(awards)-1].bid
+	for i := range awards {
+		awards[i].price = awards[i].bid.PriceMap.Price.ApparentEnergyPrice
+		if rule == uniformPriceRule {
+			awards[i].price = marginal.PriceMap.Price.ApparentEnergyPrice
+		}
+	}
+
+	return awards, nil
+}
+
+// ceilDiv returns a / b rounded up, for a positive b.
+//
+// Go division rounds towards zero, which is already up for a negative a.
+func ceilDiv(a int64, b int64) int64 {
+	q := a / b
+	if a%b > 0 {
+		q += 1
+	}
+
+	return q
+}
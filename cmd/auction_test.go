@@ -0,0 +1,294 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+)
+
+// testBid returns a bid from a facility for an amount of real and reactive power at a price per VAh.
+func testBid(facilityKey string, realPower int64, reactivePower int64, units int64, nanos int32) *esi.PriceMapBid {
+	return &esi.PriceMapBid{
+		Route: &esi.DerRoute{FacilityKey: facilityKey, ExchangeKey: "exchange"},
+		PriceMap: &esi.PriceMap{
+			PowerComponents: &esi.PowerComponents{RealPower: realPower, ReactivePower: reactivePower},
+			Price: &esi.PriceComponents{
+				ApparentEnergyPrice: &esi.Money{CurrencyCode: "USD", Units: units, Nanos: nanos},
+			},
+		},
+	}
+}
+
+// testBids returns bids by facility key.
+func testBids(bids ...*esi.PriceMapBid) map[string]*esi.PriceMapBid {
+	byFacility := make(map[string]*esi.PriceMapBid)
+	for _, bid := range bids {
+		byFacility[bid.Route.GetFacilityKey()] = bid
+	}
+
+	return byFacility
+}
+
+// awardedFacilities returns the facility keys of auction awards in order.
+func awardedFacilities(awards []auctionAward) []string {
+	var keys []string
+	for _, award := range awards {
+		keys = append(keys, award.bid.Route.GetFacilityKey())
+	}
+
+	return keys
+}
+
+func TestRankBids(t *testing.T) {
+	bids := testBids(
+		testBid("d", 10, 0, 5, 0),
+		testBid("c", 20, 0, 4, 500000000),
+		testBid("b", 10, 0, 4, 500000000),
+		testBid("a", 10, 0, 4, 500000000),
+		testBid("e", 50, 0, 4, 500000001),
+	)
+
+	want := []string{"c", "a", "b", "e", "d"}
+	var got []string
+	for _, bid := range rankBids(bids) {
+		got = append(got, bid.Route.GetFacilityKey())
+	}
+	for i := range want {
+		if len(got) != len(want) || got[i] != want[i] {
+			t.Fatalf("rankBids = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestClearAuctionPayAsBid(t *testing.T) {
+	bids := testBids(
+		testBid("a", 10, 0, 3, 0),
+		testBid("b", 20, 0, 2, 250000000),
+		testBid("c", 30, 0, 4, 0),
+	)
+
+	awards, err := clearAuction(60, bids, payAsBidRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		facilityKey string
+		power       int64
+		units       int64
+		nanos       int32
+	}{
+		{"b", 20, 2, 250000000},
+		{"a", 10, 3, 0},
+		{"c", 30, 4, 0},
+	}
+	if len(awards) != len(want) {
+		t.Fatalf("clearAuction awarded %v, want %d awards", awardedFacilities(awards), len(want))
+	}
+	for i, w := range want {
+		priceMap := awards[i].priceMap()
+		price := priceMap.Price.ApparentEnergyPrice
+		if awards[i].bid.Route.GetFacilityKey() != w.facilityKey || priceMap.PowerComponents.RealPower != w.power ||
+			price.Units != w.units || price.Nanos != w.nanos {
+			t.Errorf("award %d = %s %d at %d.%09d, want %s %d at %d.%09d", i,
+				awards[i].bid.Route.GetFacilityKey(), priceMap.PowerComponents.RealPower, price.Units, price.Nanos,
+				w.facilityKey, w.power, w.units, w.nanos)
+		}
+	}
+}
+
+func TestClearAuctionUniformPrice(t *testing.T) {
+	bids := testBids(
+		testBid("a", 10, 0, 3, 0),
+		testBid("b", 20, 0, 2, 250000000),
+		testBid("c", 30, 0, 4, 750000000),
+	)
+
+	awards, err := clearAuction(40, bids, uniformPriceRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awards) != 3 {
+		t.Fatalf("clearAuction awarded %v, want 3 awards", awardedFacilities(awards))
+	}
+	for _, award := range awards {
+		price := award.priceMap().Price.ApparentEnergyPrice
+		if price.Units != 4 || price.Nanos != 750000000 || price.CurrencyCode != "USD" {
+			t.Errorf("award to %s at %d.%09d %s, want the marginal price 4.750000000 USD",
+				award.bid.Route.GetFacilityKey(), price.Units, price.Nanos, price.CurrencyCode)
+		}
+	}
+	// The award must not change the bid it was made from.
+	if bids["b"].PriceMap.Price.ApparentEnergyPrice.Units != 2 {
+		t.Errorf("clearing changed the price of a bid")
+	}
+}
+
+func TestClearAuctionTrimsMarginalBid(t *testing.T) {
+	bids := testBids(
+		testBid("a", 10, 4, 1, 0),
+		testBid("b", 30, 9, 2, 0),
+		testBid("c", 30, 0, 3, 0),
+	)
+
+	awards, err := clearAuction(25, bids, payAsBidRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(awards) != 2 {
+		t.Fatalf("clearAuction awarded %v, want a and b", awardedFacilities(awards))
+	}
+	marginal := awards[1].priceMap()
+	if marginal.PowerComponents.RealPower != 15 {
+		t.Errorf("marginal real power = %d, want 15", marginal.PowerComponents.RealPower)
+	}
+	// 9 * 15 / 30 is 4.5, rounded up.
+	if marginal.PowerComponents.ReactivePower != 5 {
+		t.Errorf("marginal reactive power = %d, want 5", marginal.PowerComponents.ReactivePower)
+	}
+	if marginal.Price.ApparentEnergyPrice.Units != 2 {
+		t.Errorf("marginal price = %d, want the bid price 2", marginal.Price.ApparentEnergyPrice.Units)
+	}
+	if first := awards[0].priceMap(); first.PowerComponents.RealPower != 10 || first.PowerComponents.ReactivePower != 4 {
+		t.Errorf("first award = %d and %d, want the whole bid", first.PowerComponents.RealPower,
+			first.PowerComponents.ReactivePower)
+	}
+}
+
+func TestClearAuctionTies(t *testing.T) {
+	bids := testBids(
+		testBid("b", 10, 0, 2, 0),
+		testBid("a", 10, 0, 2, 0),
+		testBid("c", 20, 0, 2, 0),
+	)
+
+	awards, err := clearAuction(25, bids, payAsBidRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := awardedFacilities(awards)
+	if len(got) != 2 || got[0] != "c" || got[1] != "a" {
+		t.Fatalf("clearAuction awarded %v, want [c a]", got)
+	}
+	if awards[1].power != 5 {
+		t.Errorf("tied marginal award = %d, want 5", awards[1].power)
+	}
+}
+
+func TestClearAuctionSupplyBelowDemand(t *testing.T) {
+	bids := testBids(
+		testBid("a", 10, 0, 1, 0),
+		testBid("b", 20, 0, 2, 0),
+	)
+
+	awards, err := clearAuction(31, bids, uniformPriceRule)
+	if err == nil {
+		t.Fatalf("clearAuction awarded %v with too little supply", awardedFacilities(awards))
+	}
+	if _, err = clearAuction(0, bids, payAsBidRule); err == nil {
+		t.Error("clearAuction accepted no demand")
+	}
+}
+
+func TestClearAuctionSkipsBidsWithoutPower(t *testing.T) {
+	bids := testBids(
+		testBid("a", 0, 0, 0, 0),
+		testBid("b", -10, 0, 0, 500000000),
+		testBid("c", 10, 0, 3, 0),
+	)
+
+	awards, err := clearAuction(10, bids, uniformPriceRule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := awardedFacilities(awards)
+	if len(got) != 1 || got[0] != "c" {
+		t.Fatalf("clearAuction awarded %v, want [c]", got)
+	}
+	if price := awards[0].priceMap().Price.ApparentEnergyPrice; price.Units != 3 || price.Nanos != 0 {
+		t.Errorf("uniform price = %d.%09d, want 3", price.Units, price.Nanos)
+	}
+
+	if _, err = clearAuction(5, testBids(testBid("a", 0, 0, 1, 0)), payAsBidRule); err == nil {
+		t.Error("clearAuction met a demand with no power")
+	}
+}
+
+func TestCeilDiv(t *testing.T) {
+	tests := []struct {
+		a, b, want int64
+	}{
+		{10, 5, 2},
+		{11, 5, 3},
+		{14, 5, 3},
+		{0, 5, 0},
+		{1, 5, 1},
+		{-11, 5, -2},
+		{-10, 5, -2},
+	}
+
+	for _, test := range tests {
+		if got := ceilDiv(test.a, test.b); got != test.want {
+			t.Errorf("ceilDiv(%d, %d) = %d, want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestReceiveBid(t *testing.T) {
+	call := &esi.CallForBids{
+		CallId:   &esi.Uuid{Uuid: "call"},
+		Duration: &duration.Duration{Seconds: 3600},
+		MaxPrice: &esi.Money{CurrencyCode: "USD", Units: 5},
+		Deadline: &timestamppb.Timestamp{Seconds: unixSeconds() + 60},
+	}
+	callsForBids[call.CallId.Uuid] = &callForBids{call: call, bids: make(map[string]*esi.PriceMapBid)}
+	defer delete(callsForBids, call.CallId.Uuid)
+
+	// bid returns a bid for the call in a currency and for a number of seconds.
+	bid := func(currency string, seconds int64, units int64) *esi.PriceMapBid {
+		b := testBid("a", 10, 0, units, 0)
+		b.CallId = call.CallId
+		b.PriceMap.Price.ApparentEnergyPrice.CurrencyCode = currency
+		b.PriceMap.Duration = &duration.Duration{Seconds: seconds}
+		return b
+	}
+
+	tests := []struct {
+		name string
+		bid  *esi.PriceMapBid
+		ok   bool
+	}{
+		{"matching", bid("USD", 3600, 4), true},
+		{"at max price", bid("USD", 3600, 5), true},
+		{"over max price", bid("USD", 3600, 6), false},
+		{"other currency", bid("EUR", 3600, 4), false},
+		{"shorter duration", bid("USD", 1800, 4), false},
+		{"no duration", testBid("a", 10, 0, 4, 0), false},
+	}
+
+	for _, test := range tests {
+		if test.bid.CallId == nil {
+			test.bid.CallId = call.CallId
+		}
+		err := receiveBid("a", test.bid)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: receiveBid error = %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+}
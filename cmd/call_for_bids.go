@@ -0,0 +1,282 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/abiosoft/ishell"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"sort"
+	"strconv"
+)
+
+// callForBids is a call for bids broadcast by a coordination node behaving as an exchange, and the bids received for
+// it.
+type callForBids struct {
+	// call is the call for bids, without a facility key in its route.
+	call *esi.CallForBids
+	// bids are the bids received by facility key.
+	bids map[string]*esi.PriceMapBid
+	// rule is the rule used to price the winning bids.
+	rule clearingRule
+	// closed is true once the deadline has passed and the bids have been awarded.
+	closed bool
+}
+
+// callsForBids are the calls for bids made by this coordination node by uuid.
+var callsForBids = make(map[string]*callForBids)
+
+// broadcastCallForBids sends a call for bids to every registered facility, to be cleared with a clearing rule.
+func broadcastCallForBids(call *esi.CallForBids, rule clearingRule) {
+	callsForBids[call.CallId.GetUuid()] = &callForBids{
+		call: call,
+		bids: make(map[string]*esi.PriceMapBid),
+		rule: rule,
+	}
+	scheduleOffers()
+
+	for facilityKey := range registeredFacilities {
+		request := proto.Clone(call).(*esi.CallForBids)
+		request.Route.FacilityKey = facilityKey
+		err := esi.RequestBids(coordinationNodeClient, request)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":       call.CallId.GetUuid(),
+		"facilities": len(registeredFacilities),
+	}).Info("Sent call for bids")
+}
+
+// newCallForBids prompts for a new call for bids.
+//
+// The power and price of the price map prompted for are the total power needed and the max price that will be paid.
+func newCallForBids(shell *ishell.Shell, c *ishell.Context) (*esi.CallForBids, error) {
+	needed, err := newPriceMap(shell, c, defaultRealPower, defaultReactivePower, defaultUnits)
+	if err != nil {
+		return nil, err
+	}
+	if needed.PowerComponents.RealPower <= 0 {
+		return nil, fmt.Errorf("real power must be positive")
+	}
+	durationSeconds, err := readSeconds(shell, c, "Duration Seconds", defaultDuration)
+	if err != nil {
+		return nil, err
+	}
+	startSeconds, err := readSeconds(shell, c, "Start In Seconds", defaultWhen)
+	if err != nil {
+		return nil, err
+	}
+	windowSeconds, err := readSeconds(shell, c, "Start Window Seconds", defaultWhen)
+	if err != nil {
+		return nil, err
+	}
+	bidSeconds, err := readSeconds(shell, c, "Bid Seconds", defaultBidSeconds)
+	if err != nil {
+		return nil, err
+	}
+	// Offers are only made once bidding has closed, so the window must start after the deadline.
+	if bidSeconds >= startSeconds {
+		return nil, fmt.Errorf("bidding must close before the start window")
+	}
+
+	uuid, err := newUuid()
+	if err != nil {
+		return nil, err
+	}
+	now := unixSeconds()
+	call := esi.CallForBids{
+		Route: &esi.DerRoute{
+			ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+		},
+		CallId:          &esi.Uuid{Uuid: uuid},
+		PowerComponents: needed.PowerComponents,
+		Duration: &duration.Duration{
+			Seconds: durationSeconds,
+			Nanos:   0,
+		},
+		StartWindow: &esi.TimestampRange{
+			Min: &timestamppb.Timestamp{Seconds: now + startSeconds},
+			Max: &timestamppb.Timestamp{Seconds: now + startSeconds + windowSeconds},
+		},
+		MaxPrice: needed.Price.ApparentEnergyPrice,
+		Deadline: &timestamppb.Timestamp{Seconds: now + bidSeconds},
+	}
+
+	return &call, nil
+}
+
+// readSeconds prompts for a positive number of seconds.
+func readSeconds(shell *ishell.Shell, c *ishell.Context, prompt string, def int) (int64, error) {
+	shell.Printf("%s [%d]: ", prompt, def)
+	secondsString := c.ReadLine()
+	if secondsString == "" {
+		secondsString = strconv.Itoa(def)
+	}
+	seconds, err := strconv.ParseInt(secondsString, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if seconds <= 0 {
+		return 0, fmt.Errorf("%s must be positive", prompt)
+	}
+
+	return seconds, nil
+}
+
+// receiveBid stores a bid for an open call for bids, and returns an error if the bid cannot be accepted.
+func receiveBid(src string, bid *esi.PriceMapBid) error {
+	calls, ok := callsForBids[bid.CallId.GetUuid()]
+	if !ok {
+		return fmt.Errorf("no call for bids with the uuid: '%s'", bid.CallId.GetUuid())
+	}
+	if calls.closed || calls.call.Deadline.GetSeconds() < unixSeconds() {
+		return fmt.Errorf("call for bids '%s' is closed", bid.CallId.GetUuid())
+	}
+	if bid.GetPriceMap().GetPowerComponents().GetRealPower() <= 0 {
+		return fmt.Errorf("bid has no power")
+	}
+	if bid.GetPriceMap().GetPrice().GetApparentEnergyPrice() == nil {
+		return fmt.Errorf("bid has no price")
+	}
+	// Bids are ranked and cleared by price and power alone, so each must be in the currency and for the duration of
+	// the call.
+	if currency := bid.PriceMap.Price.ApparentEnergyPrice.GetCurrencyCode(); currency != calls.call.MaxPrice.GetCurrencyCode() {
+		return fmt.Errorf("bid is in %s, not %s", currency, calls.call.MaxPrice.GetCurrencyCode())
+	}
+	if !sameDuration(bid.GetPriceMap().GetDuration(), calls.call.GetDuration()) {
+		return fmt.Errorf("bid is not for the duration of %d seconds", calls.call.GetDuration().GetSeconds())
+	}
+	if bidPrice(bid) > moneyNanos(calls.call.MaxPrice) {
+		return fmt.Errorf("bid is over the max price of %s", formatNanos(moneyNanos(calls.call.MaxPrice)))
+	}
+
+	// A facility may replace its bid until the deadline.
+	calls.bids[src] = bid
+
+	return nil
+}
+
+// sameDuration returns true if two durations are the same length.
+func sameDuration(a *duration.Duration, b *duration.Duration) bool {
+	return a.GetSeconds() == b.GetSeconds() && a.GetNanos() == b.GetNanos()
+}
+
+// bidPrice returns the price per VAh of a bid in nano units.
+func bidPrice(bid *esi.PriceMapBid) int64 {
+	return moneyNanos(bid.GetPriceMap().GetPrice().GetApparentEnergyPrice())
+}
+
+// bidPower returns the real power of a bid.
+func bidPower(bid *esi.PriceMapBid) int64 {
+	return bid.GetPriceMap().GetPowerComponents().GetRealPower()
+}
+
+// rankBids returns the bids of a call for bids from cheapest to dearest price per VAh.
+//
+// Bids with the same price are ranked by the most power first, then by facility key, so that the ranking is always the
+// same for the same bids.
+func rankBids(bids map[string]*esi.PriceMapBid) []*esi.PriceMapBid {
+	var ranked []*esi.PriceMapBid
+	for _, bid := range bids {
+		ranked = append(ranked, bid)
+	}
+
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if bidPrice(a) != bidPrice(b) {
+			return bidPrice(a) < bidPrice(b)
+		}
+		if bidPower(a) != bidPower(b) {
+			return bidPower(a) > bidPower(b)
+		}
+		return a.Route.GetFacilityKey() < b.Route.GetFacilityKey()
+	})
+
+	return ranked
+}
+
+// closeCallsForBids clears and awards offers for every call for bids whose deadline has passed.
+func closeCallsForBids() {
+	for uuid, calls := range callsForBids {
+		if calls.closed || calls.call.Deadline.GetSeconds() > unixSeconds() {
+			continue
+		}
+		calls.closed = true
+
+		awards, err := clearAuction(calls.call.PowerComponents.GetRealPower(), calls.bids, calls.rule)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"uuid":  uuid,
+				"bids":  len(calls.bids),
+				"error": err.Error(),
+			}).Warn("Call for bids closed without awards")
+			continue
+		}
+
+		// Each winner is offered the power and price it was awarded, starting at the start of the window.
+		for _, award := range awards {
+			_, err = proposeOffer(award.bid.Route.GetFacilityKey(), award.priceMap(), calls.call.StartWindow.GetMin(), 0)
+			if err != nil {
+				log.Error(err.Error())
+			}
+		}
+
+		log.WithFields(log.Fields{
+			"uuid":    uuid,
+			"bids":    len(calls.bids),
+			"winners": len(awards),
+			"rule":    calls.rule,
+		}).Info("Call for bids awarded")
+	}
+}
+
+// newBid returns the bid of a coordination node behaving as a facility for a call for bids, or nil if it will not
+// bid.
+//
+// The bid is made from the price map given to the exchange, for the requested duration, and for no more than the
+// requested power.
+func newBid(call *esi.CallForBids) *esi.PriceMapBid {
+	registration, ok := registeredExchanges[call.Route.GetExchangeKey()]
+	if !ok || registration.priceMap.GetPrice().GetApparentEnergyPrice() == nil {
+		return nil
+	}
+	if registration.priceMap.Price.ApparentEnergyPrice.GetCurrencyCode() != call.MaxPrice.GetCurrencyCode() {
+		return nil
+	}
+
+	priceMap := proto.Clone(registration.priceMap).(*esi.PriceMap)
+	if priceMap.GetPowerComponents().GetRealPower() <= 0 || moneyNanos(priceMap.Price.ApparentEnergyPrice) > moneyNanos(call.MaxPrice) {
+		return nil
+	}
+	if priceMap.PowerComponents.RealPower > call.PowerComponents.GetRealPower() {
+		priceMap.PowerComponents.RealPower = call.PowerComponents.GetRealPower()
+	}
+	priceMap.Duration = call.Duration
+
+	return &esi.PriceMapBid{
+		Route:    call.Route,
+		CallId:   call.CallId,
+		PriceMap: priceMap,
+	}
+}
@@ -22,11 +22,20 @@ import (
 	"github.com/spf13/cobra"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 // coordinationNodeInfo is the coordination node config details.
 var coordinationNodeInfo esi.DerFacilityExchangeInfo
 
+// stateMutex guards the state of the coordination node - its client and key, its peers, and its offers and everything
+// kept about them - which is used by the message receiver, the offer scheduler, the periodic messenger and the shell on
+// different goroutines.
+//
+// It is taken by each of them before using the state, and never held while waiting on a message or on input, so that
+// no function working on the state locks it itself.
+var stateMutex sync.Mutex
+
 // coordinationNodeCmd represents the facility command.
 var coordinationNodeCmd = &cobra.Command{
 	Use:   "coordination-node",
@@ -0,0 +1,63 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+)
+
+// removeRegisteredFacility removes a facility registered in an exchange role, and cancels any pending offers with it.
+func removeRegisteredFacility(publicKey string) {
+	delete(registeredFacilities, publicKey)
+	delete(facilityPriceMaps, publicKey)
+	delete(facilityCatalogues, publicKey)
+	delete(facilityCharacteristics, publicKey)
+	delete(facilityPowerProfiles, publicKey)
+	for _, calls := range callsForBids {
+		delete(calls.bids, publicKey)
+	}
+
+	cancelRegistrationOffers(publicKey, coordinationNodeInfo.GetPublicKey())
+	publishAggregateCharacteristics()
+}
+
+// removeRegisteredExchange removes an exchange registered with in a facility role, and cancels any pending offers with
+// it.
+func removeRegisteredExchange(publicKey string) {
+	delete(registeredExchanges, publicKey)
+	// A new registration must use a new form, rather than the form received for this one.
+	delete(receivedRegistrationForms, publicKey)
+
+	cancelRegistrationOffers(coordinationNodeInfo.GetPublicKey(), publicKey)
+}
+
+// cancelRegistrationOffers cancels any offers between a facility and an exchange which have not started executing.
+func cancelRegistrationOffers(facilityKey string, exchangeKey string) {
+	for uuid, offer := range priceMapOffers {
+		if offer.Route.GetFacilityKey() != facilityKey || offer.Route.GetExchangeKey() != exchangeKey {
+			continue
+		}
+
+		// Offers which have already started executing, or have finished, cannot be cancelled.
+		if transitionOffer(uuid, esi.PriceMapOfferStatus_CANCELLED) == nil {
+			log.WithFields(log.Fields{
+				"uuid": uuid,
+			}).Info("Cancelled offer")
+		}
+	}
+}
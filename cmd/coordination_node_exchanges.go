@@ -0,0 +1,74 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/abiosoft/ishell"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+)
+
+// exchangeRegistration is the state of a registration with an exchange, held by a coordination node behaving as a
+// facility.
+//
+// A facility may be registered with several exchanges at once, for example a utility demand response program and an
+// aggregator market, and each exchange is given its own view of the facility.
+type exchangeRegistration struct {
+	// priceMap is the price map given to the exchange.
+	priceMap *esi.PriceMap
+	// characteristics are the resource characteristics given to the exchange.
+	characteristics *esi.DerCharacteristics
+	// powerParameters are the power parameters set by the exchange.
+	powerParameters *esi.PowerParameters
+}
+
+// newExchangeRegistration returns a new exchange registration, starting with the local price map and characteristics.
+func newExchangeRegistration() *exchangeRegistration {
+	return &exchangeRegistration{
+		priceMap:        proto.Clone(&priceMap).(*esi.PriceMap),
+		characteristics: proto.Clone(resourceCharacteristics).(*esi.DerCharacteristics),
+		powerParameters: &esi.PowerParameters{},
+	}
+}
+
+// readExchangeKey prompts for the public key of a registered exchange.
+//
+// If allowLocal is true, an empty public key selects the local price map and characteristics, which are given to any
+// exchange registered with afterwards, and a nil registration is returned.
+//
+// As it waits on input, the state is only locked to look up the registration, which must be locked again to be used.
+func readExchangeKey(shell *ishell.Shell, c *ishell.Context, allowLocal bool) (*exchangeRegistration, error) {
+	if allowLocal {
+		shell.Print("Exchange Public Key [local]: ")
+	} else {
+		shell.Print("Exchange Public Key: ")
+	}
+	publicKey := c.ReadLine()
+	if publicKey == "" && allowLocal {
+		return nil, nil
+	}
+
+	stateMutex.Lock()
+	registration, ok := registeredExchanges[publicKey]
+	stateMutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no exchange with public key: '%s'", publicKey)
+	}
+
+	return registration, nil
+}
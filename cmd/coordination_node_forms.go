@@ -0,0 +1,70 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/abiosoft/ishell"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+)
+
+// printFormSetting prints a form setting without prompting for it.
+//
+// INFO settings are printed as text, and any other setting is printed as a question with its placeholder.
+func printFormSetting(shell *ishell.Shell, setting *esi.FormSetting) {
+	if !setting.IsAnswerable() {
+		shell.Println(boldMsgColorFunc(setting.GetLabel()))
+	} else {
+		shell.Printf("%s. %s [%s]\n", setting.GetKey(), setting.GetLabel(), setting.GetPlaceholder())
+	}
+	if setting.GetCaption() != "" {
+		shell.Println(noteMsgColorFunc(setting.GetCaption()))
+	}
+}
+
+// readFormSetting prompts for the value of a form setting, and returns false if the setting is not answerable.
+//
+// INFO settings are printed, but never prompted for. SECURE_TEXT settings are read without echo, and their placeholder
+// is not shown.
+func readFormSetting(shell *ishell.Shell, c *ishell.Context, setting *esi.FormSetting) (string, bool) {
+	if !setting.IsAnswerable() {
+		printFormSetting(shell, setting)
+		shell.Println()
+		return "", false
+	}
+
+	if setting.GetCaption() != "" {
+		shell.Println(noteMsgColorFunc(setting.GetCaption()))
+	}
+
+	var result string
+	if setting.IsSecure() {
+		shell.Printf("%s. %s: ", setting.GetKey(), setting.GetLabel())
+		result = c.ReadPassword()
+	} else {
+		shell.Printf("%s. %s [%s]: ", setting.GetKey(), setting.GetLabel(), setting.GetPlaceholder())
+		result = c.ReadLine()
+	}
+	// If input is not given, then use the placeholder value.
+	//
+	// This placeholder value given by DerFacilityRegistrationFormData is useful for any number of situations in which
+	// user input could be either optional or unnecessary.
+	if result == "" {
+		result = setting.GetPlaceholder()
+	}
+
+	return result, true
+}
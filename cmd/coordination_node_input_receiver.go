@@ -17,6 +17,7 @@ limitations under the License.
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/abiosoft/ishell"
 	"github.com/elijahjpassmore/nkn-esi/api/esi"
@@ -24,7 +25,9 @@ import (
 	"github.com/golang/protobuf/ptypes/duration"
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"io/ioutil"
 	"strconv"
+	"time"
 )
 
 const (
@@ -37,6 +40,10 @@ const (
 	defaultWhen = 7
 	// defaultDuration is the default time it takes for an offer to be completed.
 	defaultDuration = 30
+	// defaultBidSeconds is the default time in seconds that facilities have to bid for a call for bids.
+	defaultBidSeconds = 20
+	// dateLayout is the layout of dates given to the shell, such as the start of a billing period.
+	dateLayout = "2006-01-02"
 
 	// defaultLoadMaxPower is the default load max power.
 	defaultLoadMaxPower = "100"
@@ -62,8 +69,13 @@ const (
 // coordinationNodeInputReceiver receives and returns any facility inputs.
 func coordinationNodeInputReceiver() {
 	shell := ishell.New()
-	<-coordinationNodeClient.OnConnect.C
-	shell.Printf("Connection opened on coordination node '%s'\n", infoMsgColorFunc(coordinationNodeInfo.GetName()))
+	stateMutex.Lock()
+	client := coordinationNodeClient
+	name := coordinationNodeInfo.GetName()
+	stateMutex.Unlock()
+
+	<-client.OnConnect.C
+	shell.Printf("Connection opened on coordination node '%s'\n", infoMsgColorFunc(name))
 
 	coordinationNodeInfoShellCmd := &ishell.Cmd{
 		Name: "info",
@@ -74,9 +86,62 @@ func coordinationNodeInputReceiver() {
 		Name: "public",
 		Help: "print local public key of coordination node",
 		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			shell.Printf("%s\n", infoMsgColorFunc(coordinationNodeInfo.GetPublicKey()))
 		},
 	})
+	coordinationNodeInfoShellCmd.AddCmd(&ishell.Cmd{
+		Name: "dropped",
+		Help: "print the number of dropped messages by message type",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			for k, v := range coordinationNodeRateLimiter.dropped {
+				shell.Printf("%s %d\n", boldMsgColorFunc(k+":"), v)
+			}
+		},
+	})
+	coordinationNodeInfoShellCmd.AddCmd(&ishell.Cmd{
+		Name: "denied",
+		Help: "print the number of denied messages by message type",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			for k, v := range deniedMessages {
+				shell.Printf("%s %d\n", boldMsgColorFunc(k+":"), v)
+			}
+		},
+	})
+
+	coordinationNodeKeysShellCmd := &ishell.Cmd{
+		Name: "keys",
+		Help: "manage coordination node keys",
+	}
+	shell.AddCmd(coordinationNodeKeysShellCmd)
+	coordinationNodeKeysShellCmd.AddCmd(&ishell.Cmd{
+		Name: "rotate",
+		Help: "replace the key pair and notify all known peers",
+		Func: func(c *ishell.Context) {
+			choice := c.MultiChoice([]string{
+				"YES",
+				"NO",
+			}, "Do you wish to replace your key pair?")
+			if choice != 0 {
+				return
+			}
+
+			stateMutex.Lock()
+			publicKey, err := rotateCoordinationNodeKey()
+			stateMutex.Unlock()
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			shell.Printf("New public key: %s\n", infoMsgColorFunc(publicKey))
+		},
+	})
 
 	coordinationNodeRegistryShellCmd := &ishell.Cmd{
 		Name: "registry",
@@ -87,6 +152,8 @@ func coordinationNodeInputReceiver() {
 		Name: "list",
 		Help: "print known coordination nodes received from registry",
 		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			for _, facility := range knownCoordinationNodes {
 				// Print any information - currently only name, country, and public key.
 				shell.Printf("\n%s %s\n%s %s\n%s %s\n",
@@ -106,6 +173,8 @@ func coordinationNodeInputReceiver() {
 		Func: func(c *ishell.Context) {
 			c.Print("Registry Public Key: ")
 			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			if publicKey == coordinationNodeInfo.PublicKey {
 				shell.Println("you cannot signup to yourself")
 				return
@@ -115,6 +184,7 @@ func coordinationNodeInputReceiver() {
 			if err != nil {
 				log.Error(err.Error())
 			}
+			knownRegistries[publicKey] = true
 
 			log.WithFields(log.Fields{
 				"dest": publicKey,
@@ -127,7 +197,10 @@ func coordinationNodeInputReceiver() {
 		Func: func(c *ishell.Context) {
 			c.Print("Registry Public Key: ")
 			registryPublicKey := c.ReadLine()
-			if registryPublicKey == coordinationNodeInfo.PublicKey {
+			stateMutex.Lock()
+			self := coordinationNodeInfo.GetPublicKey()
+			stateMutex.Unlock()
+			if registryPublicKey == self {
 				shell.Println("you cannot query yourself")
 				return
 			}
@@ -136,6 +209,8 @@ func coordinationNodeInputReceiver() {
 			if country == "" {
 				country = defaultCountry
 			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 
 			// You can query based upon any setting that DerFacilityExchangeRequest takes.
 			//
@@ -149,6 +224,7 @@ func coordinationNodeInputReceiver() {
 			if err != nil {
 				log.Error(err.Error())
 			}
+			knownRegistries[registryPublicKey] = true
 
 			log.WithFields(log.Fields{
 				"dest": registryPublicKey,
@@ -160,12 +236,17 @@ func coordinationNodeInputReceiver() {
 		Name: "peers",
 		Help: "show any registered facilities or exchanges",
 		Func: func(c *ishell.Context) {
-			if registeredExchange != "" {
-				// Print the exchange.
-				shell.Printf("\n%s\n", boldMsgColorFunc("EXCHANGE"))
-				shell.Printf("%s %s\n",
-					boldMsgColorFunc("Public Key:"),
-					noteMsgColorFunc(registeredExchange))
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if len(registeredExchanges) > 0 {
+				// Print the exchanges.
+				shell.Printf("\n%s\n", boldMsgColorFunc("EXCHANGES"))
+				for k, v := range registeredExchanges {
+					shell.Printf("%s %s\n",
+						boldMsgColorFunc("Public Key:"),
+						noteMsgColorFunc(k))
+					shell.Println(proto.MarshalTextString(v.powerParameters))
+				}
 			}
 			if len(registeredFacilities) > 0 {
 				// Print the facilities.
@@ -198,21 +279,27 @@ func coordinationNodeInputReceiver() {
 		Name: "request",
 		Help: "request registration form from a coordination node behaving as an exchange",
 		Func: func(c *ishell.Context) {
-			if registeredExchange != "" {
-				shell.Println("customer has already been set")
-				return
-			}
 			c.Print("Public Key: ")
 			exchangePublicKey := c.ReadLine()
-			if exchangePublicKey == coordinationNodeInfo.PublicKey {
+			stateMutex.Lock()
+			_, registered := registeredExchanges[exchangePublicKey]
+			self := coordinationNodeInfo.GetPublicKey()
+			stateMutex.Unlock()
+			if exchangePublicKey == self {
 				shell.Println("you cannot request your own form")
 				return
 			}
+			if registered {
+				shell.Println("already registered with this exchange")
+				return
+			}
 			c.Printf("Language Code [%s]: ", defaultLanguage)
 			languageCode := c.ReadLine()
 			if languageCode == "" {
 				languageCode = defaultLanguage
 			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 
 			// When creating a request, you can specify a language code.
 			//
@@ -226,40 +313,45 @@ func coordinationNodeInputReceiver() {
 			if err != nil {
 				log.Error(err.Error())
 			}
+			pendingExchanges[exchangePublicKey] = true
 		},
 	})
 	coordinationNodeFacilityShellCmd.AddCmd(&ishell.Cmd{
 		Name: "forms",
 		Help: "print forms to be signed",
 		Func: func(c *ishell.Context) {
-			if registeredExchange != "" {
-				shell.Println("customer has already been set")
-				return
-			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			for _, v := range receivedRegistrationForms {
-				shell.Printf("%s %s",
+				shell.Printf("%s %s\n\n",
 					boldMsgColorFunc("Exchange Public Key:"),
 					noteMsgColorFunc(v.Route.GetExchangeKey()))
+				for _, setting := range v.Form.GetSettings() {
+					printFormSetting(shell, setting)
+				}
+				shell.Println()
 			}
-			shell.Println()
 		},
 	})
 	coordinationNodeFacilityShellCmd.AddCmd(&ishell.Cmd{
 		Name: "register",
 		Help: "fill in a received registration form",
 		Func: func(c *ishell.Context) {
-			if registeredExchange != "" {
-				shell.Println("customer has already been set")
-				return
-			}
 			shell.Print("Public Key: ")
 			publicKey := c.ReadLine()
-			if publicKey == coordinationNodeInfo.PublicKey {
+			stateMutex.Lock()
+			_, registered := registeredExchanges[publicKey]
+			form, present := receivedRegistrationForms[publicKey]
+			self := coordinationNodeInfo.GetPublicKey()
+			stateMutex.Unlock()
+			if publicKey == self {
 				shell.Println("you cannot register to yourself")
 				return
 			}
-
-			form, present := receivedRegistrationForms[publicKey]
+			if registered {
+				shell.Println("already registered with this exchange")
+				return
+			}
 
 			if present {
 				shell.Println() // gap from input
@@ -272,6 +364,7 @@ func coordinationNodeInputReceiver() {
 				}
 
 				formData := esi.FormData{
+					Key:  form.Form.GetKey(),
 					Data: results,
 				}
 				// Contains the full form data.
@@ -281,23 +374,16 @@ func coordinationNodeInputReceiver() {
 				}
 
 				for _, setting := range form.Form.Settings {
-					// For all the settings, print the desired setting, get an input and then store it in the
-					// results.
-					shell.Printf("%s. %s [%s]: ", setting.GetKey(), setting.GetLabel(), setting.GetPlaceholder())
-					result := c.ReadLine()
-					// If input is not given, then use the placeholder value.
-					//
-					// This placeholder value given by DerFacilityRegistrationFormData is useful for any number of
-					// situations in which user input could be either optional or unnecessary.
-					if setting.GetPlaceholder() != "" {
-						if result == "" {
-							result = setting.GetPlaceholder()
-						}
+					// For all the settings, render the setting by its type, and store any answer in the results.
+					result, ok := readFormSetting(shell, c, setting)
+					if ok {
+						results[setting.Key] = result
 					}
-
-					results[setting.Key] = result
 				}
 
+				stateMutex.Lock()
+				defer stateMutex.Unlock()
+
 				// Submit the registration form.
 				err := esi.SubmitDerFacilityRegistrationForm(coordinationNodeClient, &registrationFormData)
 				if err != nil {
@@ -308,7 +394,8 @@ func coordinationNodeInputReceiver() {
 				delete(receivedRegistrationForms, form.Route.GetExchangeKey())
 
 				log.WithFields(log.Fields{
-					"end": form.Route.GetExchangeKey(),
+					"end":  form.Route.GetExchangeKey(),
+					"data": esi.RedactFormData(form.Form, &formData).GetData(),
 				}).Info("Sent registration form")
 
 				shell.Printf("\nForm has been submitted to %s\n", registrationFormData.Route.GetExchangeKey())
@@ -320,48 +407,196 @@ func coordinationNodeInputReceiver() {
 		},
 	})
 
+	coordinationNodeFacilityShellCmd.AddCmd(&ishell.Cmd{
+		Name: "deregister",
+		Help: "end the registration with a coordination node behaving as an exchange",
+		Func: func(c *ishell.Context) {
+			shell.Print("Public Key: ")
+			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			_, registered := registeredExchanges[publicKey]
+			stateMutex.Unlock()
+			if !registered {
+				shell.Printf("no exchange with public key: '%s'\n", publicKey)
+				return
+			}
+			shell.Print("Reason: ")
+			reason := c.ReadLine()
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+
+			deregistration := esi.DerFacilityDeregistration{
+				Route: &esi.DerRoute{
+					FacilityKey: coordinationNodeInfo.GetPublicKey(),
+					ExchangeKey: publicKey,
+				},
+				Reason: reason,
+			}
+			err := esi.DeregisterFacility(coordinationNodeClient, &deregistration)
+			if err != nil {
+				log.Error(err.Error())
+			}
+
+			// Any pending offers with the removed party are cancelled.
+			removeRegisteredExchange(publicKey)
+
+			log.WithFields(log.Fields{
+				"dest": publicKey,
+			}).Info("Deregistered from exchange")
+		},
+	})
+
 	coordinationNodePriceMapShellCmd := &ishell.Cmd{
 		Name: "price-map",
-		Help: "manage local price maps",
+		Help: "manage price maps given to exchanges",
 	}
 	shell.AddCmd(coordinationNodePriceMapShellCmd)
 	coordinationNodePriceMapShellCmd.AddCmd(&ishell.Cmd{
 		Name: "view",
-		Help: "print local price map",
+		Help: "print the price map given to an exchange",
 		Func: func(c *ishell.Context) {
-			fmt.Println(proto.MarshalTextString(&priceMap))
+			registration, err := readExchangeKey(shell, c, true)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if registration == nil {
+				fmt.Println(proto.MarshalTextString(&priceMap))
+			} else {
+				fmt.Println(proto.MarshalTextString(registration.priceMap))
+			}
 		},
 	})
 	coordinationNodePriceMapShellCmd.AddCmd(&ishell.Cmd{
 		Name: "create",
-		Help: "create a local price map",
+		Help: "create the price map given to an exchange",
 		Func: func(c *ishell.Context) {
+			registration, err := readExchangeKey(shell, c, true)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
 			createdPriceMap, err := newPriceMap(shell, c, defaultRealPower, defaultReactivePower, defaultUnits)
 			if err != nil {
 				shell.Println(err.Error())
 				return
 			}
 
-			priceMap = *createdPriceMap
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if registration == nil {
+				priceMap.Reset()
+				proto.Merge(&priceMap, createdPriceMap)
+			} else {
+				registration.priceMap = createdPriceMap
+			}
+		},
+	})
+
+	coordinationNodePriceMapShellCmd.AddCmd(&ishell.Cmd{
+		Name: "catalogue",
+		Help: "print the catalogue of price maps offered to exchanges",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			printCatalogue(shell, priceMapCatalogue)
+			shell.Println()
+		},
+	})
+	coordinationNodePriceMapShellCmd.AddCmd(&ishell.Cmd{
+		Name: "add",
+		Help: "add a price map to the catalogue offered to exchanges",
+		Func: func(c *ishell.Context) {
+			entry, err := newCatalogueEntry(shell, c)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			priceMapCatalogue = append(priceMapCatalogue, entry)
+			shell.Printf("Added catalogue entry %d\n", len(priceMapCatalogue))
+		},
+	})
+	coordinationNodePriceMapShellCmd.AddCmd(&ishell.Cmd{
+		Name: "remove",
+		Help: "remove a price map from the catalogue offered to exchanges",
+		Func: func(c *ishell.Context) {
+			shell.Print("Entry: ")
+			entry, err := strconv.Atoi(c.ReadLine())
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			if entry <= 0 {
+				shell.Printf("no catalogue entry %d\n", entry)
+				return
+			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			// The entry is left as a tombstone, so offers made against later entries still match them.
+			err = removeCatalogueEntry(uint32(entry))
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			shell.Printf("Removed catalogue entry %d\n", entry)
 		},
 	})
 
 	coordinationNodeCharacteristicsShellCmd := &ishell.Cmd{
 		Name: "characteristics",
-		Help: "manage local characteristics",
+		Help: "manage characteristics given to exchanges",
 	}
 	shell.AddCmd(coordinationNodeCharacteristicsShellCmd)
 	coordinationNodeCharacteristicsShellCmd.AddCmd(&ishell.Cmd{
 		Name: "view",
-		Help: "print local characteristics",
+		Help: "print the characteristics given to an exchange",
 		Func: func(c *ishell.Context) {
-			fmt.Println(proto.MarshalTextString(&resourceCharacteristics))
+			registration, err := readExchangeKey(shell, c, true)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if registration == nil {
+				fmt.Println(proto.MarshalTextString(resourceCharacteristics))
+			} else {
+				fmt.Println(proto.MarshalTextString(registration.characteristics))
+			}
+		},
+	})
+	coordinationNodeCharacteristicsShellCmd.AddCmd(&ishell.Cmd{
+		Name: "aggregate",
+		Help: "print and publish the combined characteristics of registered facilities in aggregator mode",
+		Func: func(c *ishell.Context) {
+			if !aggregatorEnabled() {
+				shell.Println("aggregator mode is not enabled")
+				return
+			}
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			fmt.Println(proto.MarshalTextString(aggregateCharacteristics(facilityCharacteristics)))
+			publishAggregateCharacteristics()
 		},
 	})
 	coordinationNodeCharacteristicsShellCmd.AddCmd(&ishell.Cmd{
 		Name: "create",
-		Help: "create coordination node facility characteristics",
+		Help: "create the characteristics given to an exchange",
 		Func: func(c *ishell.Context) {
+			registration, err := readExchangeKey(shell, c, true)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
 			shell.Printf("Max Load Power [%s]: ", defaultLoadMaxPower)
 			loadPowerMaxString := c.ReadLine()
 			if loadPowerMaxString == "" {
@@ -413,12 +648,19 @@ func coordinationNodeInputReceiver() {
 				return
 			}
 
-			// Set the local characteristics to user input.
-			resourceCharacteristics.LoadPowerMax = uint64(loadPowerMax)
-			resourceCharacteristics.LoadPowerFactor = float32(loadPowerFactor)
-			resourceCharacteristics.SupplyPowerMax = uint64(supplyPowerMax)
-			resourceCharacteristics.SupplyPowerFactor = float32(supplyPowerFactor)
-			resourceCharacteristics.StorageEnergyCapacity = uint64(storageEnergyCapacity)
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			characteristics := resourceCharacteristics
+			if registration != nil {
+				characteristics = registration.characteristics
+			}
+
+			// Set the characteristics to user input.
+			characteristics.LoadPowerMax = uint64(loadPowerMax)
+			characteristics.LoadPowerFactor = float32(loadPowerFactor)
+			characteristics.SupplyPowerMax = uint64(supplyPowerMax)
+			characteristics.SupplyPowerFactor = float32(supplyPowerFactor)
+			characteristics.StorageEnergyCapacity = uint64(storageEnergyCapacity)
 		},
 	})
 
@@ -432,6 +674,8 @@ func coordinationNodeInputReceiver() {
 		Func: func(c *ishell.Context) {
 			shell.Print("Public Key: ")
 			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			if publicKey == coordinationNodeInfo.PublicKey {
 				shell.Println("you cannot get your own details")
 				return
@@ -462,12 +706,19 @@ func coordinationNodeInputReceiver() {
 			if err != nil {
 				log.Error(err.Error())
 			}
+			// Get the price map catalogue.
+			err = esi.GetPriceMapCatalogue(coordinationNodeClient, &newPriceMapRequest)
+			if err != nil {
+				log.Error(err.Error())
+			}
 		},
 	})
 	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
 		Name: "price-maps",
 		Help: "print facility price maps",
 		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			for k, v := range facilityPriceMaps {
 				shell.Printf("\n%s %s\n%s %s\n\n",
 					boldMsgColorFunc("Public Key:"),
@@ -477,10 +728,27 @@ func coordinationNodeInputReceiver() {
 			}
 		},
 	})
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "catalogues",
+		Help: "print facility price map catalogues",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			for k, v := range facilityCatalogues {
+				shell.Printf("\n%s %s\n",
+					boldMsgColorFunc("Public Key:"),
+					noteMsgColorFunc(k))
+				printCatalogue(shell, v.GetPriceMap())
+			}
+			shell.Println()
+		},
+	})
 	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
 		Name: "characteristics",
 		Help: "print facility characteristics",
 		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
 			for k, v := range facilityCharacteristics {
 				shell.Printf("\n%s %s\n%s %s\n\n",
 					boldMsgColorFunc("Public Key:"),
@@ -510,65 +778,301 @@ func coordinationNodeInputReceiver() {
 		Func: func(c *ishell.Context) {
 			shell.Print("Public Key: ")
 			publicKey := c.ReadLine()
-			if publicKey == coordinationNodeInfo.PublicKey {
+			stateMutex.Lock()
+			_, registered := registeredFacilities[publicKey]
+			catalogue := facilityCatalogues[publicKey].GetPriceMap()
+			self := coordinationNodeInfo.GetPublicKey()
+			stateMutex.Unlock()
+			if publicKey == self {
 				shell.Println("you cannot propose yourself an offer")
 				return
 			}
-			if _, ok := registeredFacilities[publicKey]; !ok {
+			if !registered {
 				shell.Printf("no facility with public key: '%s'\n", publicKey)
 				return
 			}
 
-			createdPriceMap, err := newPriceMap(shell, c, defaultRealPower, defaultReactivePower, defaultUnits)
+			// An offer may be made against an entry of the facility price map catalogue, in which case the power and
+			// duration of the entry are used.
+			shell.Print("Catalogue Entry [none]: ")
+			entryString := c.ReadLine()
+			var entryNumber uint32
+			var entry *esi.PriceMap
+			if entryString != "" {
+				number, err := strconv.ParseUint(entryString, 10, 32)
+				if err != nil {
+					shell.Println(err.Error())
+					return
+				}
+				entryNumber = uint32(number)
+				entry, err = catalogueEntry(catalogue, entryNumber)
+				if err != nil {
+					shell.Println(err.Error())
+					return
+				}
+			}
+
+			var createdPriceMap *esi.PriceMap
+			var err error
+			if entry == nil {
+				createdPriceMap, err = newPriceMap(shell, c, defaultRealPower, defaultReactivePower, defaultUnits)
+				if err != nil {
+					shell.Println(err.Error())
+					return
+				}
+			} else {
+				shell.Printf("Price [%d]: ", entry.GetPrice().GetApparentEnergyPrice().GetUnits())
+				createdPriceMap = proto.Clone(entry).(*esi.PriceMap)
+				if createdPriceMap.GetPrice().GetApparentEnergyPrice() == nil {
+					shell.Println("catalogue entry has no price")
+					return
+				}
+				priceString := c.ReadLine()
+				if priceString != "" {
+					price, err := strconv.ParseInt(priceString, 10, 64)
+					if err != nil {
+						shell.Println(err.Error())
+						return
+					}
+					createdPriceMap.Price.ApparentEnergyPrice.Units = price
+				}
+			}
+			// Always assume that the offer should be carried out immediately.
+			//
+			// There could be scenarios in which you need to send offers at some other interval, in which case you
+			// could use this field.
+			newTimeStamp := timestamppb.Timestamp{
+				Seconds: unixSeconds() + defaultWhen,
+				Nanos:   0,
+			}
+			stateMutex.Lock()
+			_, err = proposeOffer(publicKey, createdPriceMap, &newTimeStamp, entryNumber)
+			stateMutex.Unlock()
 			if err != nil {
 				shell.Println(err.Error())
 				return
 			}
-			newRoute := esi.DerRoute{
-				FacilityKey: publicKey,
-				ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+		},
+	})
+
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "call-for-bids",
+		Help: "request bids from every coordination node behaving as facility",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			facilities := len(registeredFacilities)
+			stateMutex.Unlock()
+			if facilities == 0 {
+				shell.Println("no registered facilities")
+				return
 			}
-			uuid, err := newUuid()
+			call, err := newCallForBids(shell, c)
 			if err != nil {
 				shell.Println(err.Error())
 				return
 			}
-			newUuid := esi.Uuid{
-				Uuid: uuid,
+			shell.Printf("Clearing Rule (%s or %s) [%s]: ", payAsBidRuleName, uniformPriceRuleName, defaultClearingRuleName())
+			ruleName := c.ReadLine()
+			if ruleName == "" {
+				ruleName = defaultClearingRuleName()
 			}
-			// Always assume that the offer should be carried out immediately.
-			//
-			// There could be scenarios in which you need to send offers at some other interval, in which case you
-			// could use this field.
-			newTimeStamp := timestamppb.Timestamp{
-				Seconds: unixSeconds() + defaultWhen,
-				Nanos:   0,
+			rule, err := parseClearingRule(ruleName)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			stateMutex.Lock()
+			broadcastCallForBids(call, rule)
+			stateMutex.Unlock()
+			shell.Printf("%s %s\n", boldMsgColorFunc("Call UUID:"), call.CallId.GetUuid())
+		},
+	})
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "bids",
+		Help: "print calls for bids and the bids received",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+
+			for k, v := range callsForBids {
+				shell.Printf("\n%s %s\n%s %s\n%s %t\n%s\n",
+					boldMsgColorFunc("Call UUID:"),
+					noteMsgColorFunc(k),
+					boldMsgColorFunc("Clearing Rule:"),
+					v.rule,
+					boldMsgColorFunc("Closed:"),
+					v.closed,
+					proto.MarshalTextString(v.call))
+				for _, bid := range rankBids(v.bids) {
+					shell.Printf("%s %s\n%s %d\n%s %s\n",
+						boldMsgColorFunc("Facility:"),
+						bid.Route.GetFacilityKey(),
+						boldMsgColorFunc("Power:"),
+						bidPower(bid),
+						boldMsgColorFunc("Price:"),
+						formatNanos(bidPrice(bid)))
+				}
+			}
+			shell.Println()
+		},
+	})
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "get-profile",
+		Help: "request the power profile of a coordination node behaving as a facility",
+		Func: func(c *ishell.Context) {
+			shell.Print("Public Key: ")
+			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			_, registered := registeredFacilities[publicKey]
+			stateMutex.Unlock()
+			if !registered {
+				shell.Printf("no facility with public key: '%s'\n", publicKey)
+				return
+			}
+			request, err := newDatumRequest(shell, c)
+			if err != nil {
+				shell.Println(err.Error())
+				return
 			}
-			newPriceMapOffer := esi.PriceMapOffer{
-				Route:    &newRoute,
-				OfferId:  &newUuid,
-				When:     &newTimeStamp,
-				PriceMap: createdPriceMap,
-				Node:     &esi.NodeType{Type: esi.NodeType_FACILITY},
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			request.Route = &esi.DerRoute{
+				ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+				FacilityKey: publicKey,
 			}
 
-			priceMapOffers[uuid] = &newPriceMapOffer
-			// Store the status of the offer.
-			status := esi.PriceMapOfferStatus{
-				Route:   &newRoute,
-				OfferId: &newUuid,
-				Status:  esi.PriceMapOfferStatus_UNKNOWN,
+			err = esi.ListPowerProfile(coordinationNodeClient, request)
+			if err != nil {
+				shell.Println(err.Error())
+				return
 			}
-			priceMapOfferStatus[uuid] = &status
 
-			err = esi.ProposePriceMapOffer(coordinationNodeClient, &newPriceMapOffer)
+			log.WithFields(log.Fields{
+				"dest": publicKey,
+			}).Info("Sent power profile request")
+		},
+	})
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "profiles",
+		Help: "print facility power profiles",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			for k, v := range facilityPowerProfiles {
+				shell.Printf("\n%s %s\n", boldMsgColorFunc("Public Key:"), noteMsgColorFunc(k))
+				for _, datum := range v.GetDatum() {
+					shell.Printf("%s  %d %s  %d W  %d var\n",
+						datum.Ts.AsTime().Local().Format(time.RFC3339),
+						datum.TimeLength,
+						datum.TimeUnit,
+						datum.PowerComponents.GetRealPower(),
+						datum.PowerComponents.GetReactivePower())
+				}
+			}
+			shell.Println()
+		},
+	})
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "revoke",
+		Help: "revoke the registration of a coordination node behaving as a facility",
+		Func: func(c *ishell.Context) {
+			shell.Print("Public Key: ")
+			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			_, registered := registeredFacilities[publicKey]
+			stateMutex.Unlock()
+			if !registered {
+				shell.Printf("no facility with public key: '%s'\n", publicKey)
+				return
+			}
+			shell.Print("Reason: ")
+			reason := c.ReadLine()
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+
+			deregistration := esi.DerFacilityDeregistration{
+				Route: &esi.DerRoute{
+					FacilityKey: publicKey,
+					ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+				},
+				Reason: reason,
+			}
+			err := esi.RevokeRegistration(coordinationNodeClient, &deregistration)
 			if err != nil {
 				log.Error(err.Error())
 			}
 
+			// Any pending offers with the removed party are cancelled.
+			removeRegisteredFacility(publicKey)
+
 			log.WithFields(log.Fields{
 				"dest": publicKey,
-			}).Info("Sent proposal")
+			}).Info("Revoked facility registration")
+		},
+	})
+
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "approvals",
+		Help: "list registrations waiting for manual approval",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if len(pendingApprovals) == 0 {
+				shell.Println("no registrations waiting for approval")
+				return
+			}
+			for publicKey, formData := range pendingApprovals {
+				shell.Printf("\n%s\n", publicKey)
+				for key, value := range formData.GetData().GetData() {
+					shell.Printf("  %s: %s\n", key, value)
+				}
+			}
+			shell.Println()
+		},
+	})
+
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "approve",
+		Help: "approve a registration waiting for manual approval",
+		Func: func(c *ishell.Context) {
+			shell.Print("Public Key: ")
+			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if _, ok := pendingApprovals[publicKey]; !ok {
+				shell.Printf("no registration waiting for approval with public key: '%s'\n", publicKey)
+				return
+			}
+
+			completeRegistration(publicKey, true, "")
+		},
+	})
+
+	coordinationNodeExchangeShellCmd.AddCmd(&ishell.Cmd{
+		Name: "reject",
+		Help: "reject a registration waiting for manual approval",
+		Func: func(c *ishell.Context) {
+			shell.Print("Public Key: ")
+			publicKey := c.ReadLine()
+			stateMutex.Lock()
+			_, pending := pendingApprovals[publicKey]
+			stateMutex.Unlock()
+			if !pending {
+				shell.Printf("no registration waiting for approval with public key: '%s'\n", publicKey)
+				return
+			}
+			shell.Print("Reason: ")
+			reason := c.ReadLine()
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			// The registration may have been completed while the reason was read.
+			if _, ok := pendingApprovals[publicKey]; !ok {
+				shell.Printf("no registration waiting for approval with public key: '%s'\n", publicKey)
+				return
+			}
+			completeRegistration(publicKey, false, reason)
 		},
 	})
 
@@ -581,21 +1085,31 @@ func coordinationNodeInputReceiver() {
 		Name: "list",
 		Help: "view all offers",
 		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+
 			for k, v := range priceMapOffers {
 				// You have access to a lot of information.
 				//
 				// In this example, only key information is provided.
-				shell.Printf("\n%s %s\n%s %s\n%s %s\n%s %s\n%s %s\n",
+				shell.Printf("\n%s %s\n%s %s\n%s %s\n%s %d\n%s %s\n%s %s\n%s %s\n",
 					boldMsgColorFunc("Exchange Public Key:"),
 					noteMsgColorFunc(v.Route.GetExchangeKey()),
 					boldMsgColorFunc("Facility Public Key:"),
 					noteMsgColorFunc(v.Route.GetFacilityKey()),
 					boldMsgColorFunc("UUID:"),
 					k,
+					boldMsgColorFunc("Round:"),
+					offerRound(k),
 					boldMsgColorFunc("Price Map:"),
 					proto.MarshalTextString(v.PriceMap),
+					boldMsgColorFunc("Respond By:"),
+					v.RespondBy.AsTime().Local().String(),
 					boldMsgColorFunc("Status:"),
 					infoMsgColorFunc(priceMapOfferStatus[v.OfferId.Uuid].Status))
+				if aggregatedOffer(k) {
+					shell.Printf("%s %d W\n", boldMsgColorFunc("Downstream Shortfall:"), downstreamShortfall(k))
+				}
 			}
 			shell.Println()
 		},
@@ -606,55 +1120,49 @@ func coordinationNodeInputReceiver() {
 		Func: func(c *ishell.Context) {
 			shell.Print("Offer UUID: ")
 			currentUuid := c.ReadLine()
-			if priceMapOffers[currentUuid] == nil {
-				shell.Printf("no offer with the uuid: '%s'\n", currentUuid)
-				return
-			}
-			// Check to see if the responding party is responsible.
-			if priceMapOffers[currentUuid].Route.GetExchangeKey() == coordinationNodeInfo.GetPublicKey() && priceMapOffers[currentUuid].Node.Type == esi.NodeType_FACILITY {
-				shell.Println("you are not the responsible party for this offer")
-				return
-			}
-			// Check to see tha the offer is actually available.
-			if priceMapOfferStatus[currentUuid].Status != esi.PriceMapOfferStatus_UNKNOWN {
-				shell.Println("offer is not available")
+			// The state is not locked while waiting for input, so the status of the offer is checked again when
+			// it is answered.
+			stateMutex.Lock()
+			offer, err := evaluatedOffer(currentUuid)
+			stateMutex.Unlock()
+			if err != nil {
+				shell.Println(err.Error())
 				return
 			}
 			choice := c.MultiChoice([]string{
 				"YES",
-				"NO",
-			}, fmt.Sprintf("Do you accept this offer?\n\n%s\n", proto.MarshalTextString(priceMapOffers[currentUuid])))
+				"COUNTER",
+				"REJECT",
+			}, fmt.Sprintf("Do you accept this offer?\n\n%s\n", proto.MarshalTextString(offer)))
 
 			if choice == 0 {
-				// Accept the offer.
-				shell.Println("\nOffer has been accepted.\n")
-				accept := esi.PriceMapOfferResponse_Accept{
-					Accept: true,
-				}
-
-				var party = esi.NodeType_NONE
-				if priceMapOffers[currentUuid].Node.Type == esi.NodeType_FACILITY {
-					party = esi.NodeType_EXCHANGE
-				} else {
-					party = esi.NodeType_FACILITY
+				// Accept the offer, signed by this coordination node.
+				response, err := acceptOffer(offer, responseParty(offer))
+				if err != nil {
+					shell.Println(err.Error())
+					return
 				}
-
-				response := esi.PriceMapOfferResponse{
-					Route:       priceMapOffers[currentUuid].Route,
-					OfferId:     priceMapOffers[currentUuid].OfferId,
-					AcceptOneof: &accept,
-					Node:        &esi.NodeType{Type: party},
+				stateMutex.Lock()
+				defer stateMutex.Unlock()
+				// The offer may have changed while the choice was made, so only send the answer if it can be accepted.
+				err = transitionOffer(currentUuid, esi.PriceMapOfferStatus_ACCEPTED)
+				if err != nil {
+					shell.Println(err.Error())
+					return
 				}
-				err := esi.SendPriceMapOfferResponse(coordinationNodeClient, &response)
+				err = esi.SendPriceMapOfferResponse(coordinationNodeClient, response)
 				if err != nil {
 					log.Error(err.Error())
 				}
 
-				priceMapOfferStatus[currentUuid].Status = esi.PriceMapOfferStatus_ACCEPTED
-				priceMap = *priceMapOffers[currentUuid].PriceMap
-
+				shell.Println("\nOffer has been accepted.\n")
 				log.Info("Accepted price map offer")
-				log.Info("Updated price map")
+
+				// Update the price map given to the exchange of the offer.
+				if registration, ok := registeredExchanges[offer.Route.GetExchangeKey()]; ok {
+					registration.priceMap = offer.PriceMap
+					log.Info("Updated price map")
+				}
 
 			} else if choice == 1 {
 				// Create a new counter offer.
@@ -665,77 +1173,416 @@ func coordinationNodeInputReceiver() {
 				createdPriceMap, err := newPriceMap(
 					shell,
 					c,
-					strconv.FormatInt(priceMapOffers[currentUuid].PriceMap.PowerComponents.RealPower, 10),
-					strconv.FormatInt(priceMapOffers[currentUuid].PriceMap.PowerComponents.ReactivePower, 10),
-					strconv.FormatInt(priceMapOffers[currentUuid].PriceMap.Price.ApparentEnergyPrice.Units, 10))
+					strconv.FormatInt(offer.PriceMap.PowerComponents.RealPower, 10),
+					strconv.FormatInt(offer.PriceMap.PowerComponents.ReactivePower, 10),
+					strconv.FormatInt(offer.PriceMap.Price.ApparentEnergyPrice.Units, 10))
 				if err != nil {
 					shell.Println(err.Error())
 					return
 				}
-				counterOffer := esi.PriceMapOfferResponse_CounterOffer{
-					CounterOffer: createdPriceMap,
-				}
-				uuid, err := newUuid()
+				stateMutex.Lock()
+				defer stateMutex.Unlock()
+				// Store the status REJECTED, and the new offer with the status UNKNOWN.
+				offerResponse, err := counterOffer(offer, createdPriceMap)
 				if err != nil {
 					shell.Println(err.Error())
 					return
 				}
-				newUuid := esi.Uuid{
-					Uuid: uuid,
-				}
 
-				var party = esi.NodeType_NONE
-				if priceMapOffers[currentUuid].Node.Type == esi.NodeType_FACILITY {
-					party = esi.NodeType_EXCHANGE
-				} else {
-					party = esi.NodeType_FACILITY
-				}
-				offerResponse := esi.PriceMapOfferResponse{
-					Route:         priceMapOffers[currentUuid].Route,
-					PreviousOffer: priceMapOffers[currentUuid].OfferId,
-					OfferId:       &newUuid,
-					AcceptOneof:   &counterOffer,
-					Node:          &esi.NodeType{Type: party},
+				err = esi.SendPriceMapOfferResponse(coordinationNodeClient, offerResponse)
+				if err != nil {
+					log.Error(err.Error())
 				}
 
-				err = esi.SendPriceMapOfferResponse(coordinationNodeClient, &offerResponse)
+				log.WithFields(log.Fields{
+					"src": offer.Route.GetExchangeKey(),
+				}).Info("Sent counter offer")
+			} else if choice == 2 {
+				// Reject the offer outright, ending the negotiation.
+				shell.Print("Reason: ")
+				reason := c.ReadLine()
+
+				stateMutex.Lock()
+				defer stateMutex.Unlock()
+				err := transitionOffer(currentUuid, esi.PriceMapOfferStatus_REJECTED)
+				if err != nil {
+					shell.Println(err.Error())
+					return
+				}
+				err = esi.SendPriceMapOfferResponse(coordinationNodeClient, rejectOffer(offer.Route, offer.OfferId, responseParty(offer), reason))
 				if err != nil {
 					log.Error(err.Error())
 				}
 
+				shell.Println("\nOffer has been rejected.\n")
 				log.WithFields(log.Fields{
-					"src": priceMapOffers[currentUuid].Route.GetExchangeKey(),
-				}).Info("Sent counter offer")
+					"uuid":   currentUuid,
+					"reason": reason,
+				}).Info("Rejected price map offer")
+			}
+		},
+	})
+
+	coordinationNodeOffersShellCmd.AddCmd(&ishell.Cmd{
+		Name: "history",
+		Help: "view each round of the negotiation of an offer",
+		Func: func(c *ishell.Context) {
+			currentUuid := readOfferUuid(shell, c)
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			if _, ok := priceMapOffers[currentUuid]; !ok {
+				shell.Printf("no offer with the uuid: '%s'\n", currentUuid)
+				return
+			}
 
-				// Store the status REJECTED.
-				priceMapOfferStatus[currentUuid].Status = esi.PriceMapOfferStatus_REJECTED
+			var lastPrice int64
+			for i, uuid := range offerThread(currentUuid) {
+				offer := priceMapOffers[uuid]
+				delta := ""
+				if i > 0 {
+					change := offerPrice(offer) - lastPrice
+					sign := ""
+					if change >= 0 {
+						sign = "+"
+					}
+					delta = fmt.Sprintf(" (%s%s)", sign, formatNanos(change))
+				}
+				lastPrice = offerPrice(offer)
 
-				// In the new offer, use the time specified by the previous offer.
-				newOffer := esi.PriceMapOffer{
-					Route:    priceMapOffers[currentUuid].Route,
-					OfferId:  &newUuid,
-					When:     priceMapOffers[currentUuid].When,
-					PriceMap: createdPriceMap,
-					Node:     &esi.NodeType{Type: party},
+				// The offer is made to the party in its node type, so it is made by the other party.
+				from := offer.Route.GetExchangeKey()
+				if offer.GetNode().GetType() == esi.NodeType_EXCHANGE {
+					from = offer.Route.GetFacilityKey()
 				}
+				shell.Printf("\n%s %d\n%s %s\n%s %s\n%s %s\n%s %s%s\n%s %s\n",
+					boldMsgColorFunc("Round:"),
+					i+1,
+					boldMsgColorFunc("UUID:"),
+					uuid,
+					boldMsgColorFunc("From:"),
+					noteMsgColorFunc(from),
+					boldMsgColorFunc("Time:"),
+					offerTimes[uuid].Format(time.RFC3339),
+					boldMsgColorFunc("Price:"),
+					formatNanos(lastPrice),
+					delta,
+					boldMsgColorFunc("Status:"),
+					infoMsgColorFunc(offerStatus(uuid)))
+			}
+			shell.Println()
+		},
+	})
 
-				// Store the new offer.
-				priceMapOffers[uuid] = &newOffer
+	coordinationNodeOffersShellCmd.AddCmd(&ishell.Cmd{
+		Name: "cancel",
+		Help: "withdraw an unanswered offer, or cancel an accepted offer before it executes",
+		Func: func(c *ishell.Context) {
+			currentUuid := readOfferUuid(shell, c)
+			stateMutex.Lock()
+			offer, ok := priceMapOffers[currentUuid]
+			status := offerStatus(currentUuid)
+			stateMutex.Unlock()
+			if !ok {
+				shell.Printf("no offer with the uuid: '%s'\n", currentUuid)
+				return
+			}
+			if !canTransitionOffer(status, esi.PriceMapOfferStatus_CANCELLED) {
+				shell.Printf("offer cannot be cancelled while %s\n", status)
+				return
+			}
 
-				// Store the status of the offer.
-				status := esi.PriceMapOfferStatus{
-					Route:   priceMapOffers[uuid].Route,
-					OfferId: priceMapOffers[uuid].OfferId,
-					Status:  esi.PriceMapOfferStatus_UNKNOWN,
+			// List every reason except NONE.
+			var reasons []string
+			for i := int32(1); i < int32(len(esi.PriceMapOfferCancellation_Reason_name)); i++ {
+				reasons = append(reasons, esi.PriceMapOfferCancellation_Reason_name[i])
+			}
+			choice := c.MultiChoice(reasons, "Why is the offer being cancelled?")
+			if choice < 0 {
+				return
+			}
+			reason := esi.PriceMapOfferCancellation_Reason(choice + 1)
+			shell.Print("Message: ")
+			message := c.ReadLine()
+
+			penalty := cancellationPenaltyNanos(offer, status, reason)
+			if penalty > 0 {
+				confirm := c.MultiChoice([]string{
+					"YES",
+					"NO",
+				}, fmt.Sprintf("Cancelling this offer has a penalty of %s %s. Continue?", formatNanos(penalty),
+					offer.GetPriceMap().GetPrice().GetApparentEnergyPrice().GetCurrencyCode()))
+				if confirm != 0 {
+					return
 				}
-				priceMapOfferStatus[uuid] = &status
 			}
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			err := cancelOffer(currentUuid, coordinationNodeInfo.GetPublicKey(), reason)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			sendOfferCancellation(offer, reason, message)
+
+			shell.Println("\nOffer has been cancelled.\n")
+		},
+	})
+
+	coordinationNodeOffersShellCmd.AddCmd(&ishell.Cmd{
+		Name: "dispute",
+		Help: "contest the outcome of a completed or failed offer",
+		Func: func(c *ishell.Context) {
+			currentUuid := readOfferUuid(shell, c)
+			stateMutex.Lock()
+			_, ok := priceMapOffers[currentUuid]
+			status := offerStatus(currentUuid)
+			delivered := offerFeedback[currentUuid].GetDeliveredPercentage()
+			stateMutex.Unlock()
+			if !ok {
+				shell.Printf("no offer with the uuid: '%s'\n", currentUuid)
+				return
+			}
+			if !canTransitionOffer(status, esi.PriceMapOfferStatus_DISPUTED) {
+				shell.Printf("offer cannot be disputed while %s\n", status)
+				return
+			}
+
+			shell.Print("Reason: ")
+			reason := c.ReadLine()
+			percentage, err := readPercentage(shell, c, delivered)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			err = raiseDispute(currentUuid, reason, percentage)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			shell.Println("\nOffer has been disputed.\n")
+		},
+	})
+
+	coordinationNodeOffersShellCmd.AddCmd(&ishell.Cmd{
+		Name: "disputes",
+		Help: "view disputed offers and their resolutions",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+
+			for k, v := range offerDisputes {
+				resolution := "awaiting resolution"
+				if v.resolution != nil {
+					resolution = fmt.Sprintf("%s, %.1f%% delivered: %s", v.resolution.Outcome,
+						v.resolution.DeliveredPercentage, v.resolution.Message)
+				}
+				shell.Printf("\n%s %s\n%s %s\n%s %s\n%s %.1f%%\n%s %d\n%s %s\n",
+					boldMsgColorFunc("UUID:"),
+					k,
+					boldMsgColorFunc("Raised By:"),
+					noteMsgColorFunc(v.raisedBy),
+					boldMsgColorFunc("Reason:"),
+					v.dispute.GetReason(),
+					boldMsgColorFunc("Delivered:"),
+					v.dispute.GetDeliveredPercentage(),
+					boldMsgColorFunc("Evidence:"),
+					len(v.dispute.GetEvidence().GetDatum()),
+					boldMsgColorFunc("Resolution:"),
+					infoMsgColorFunc(resolution))
+			}
+			shell.Println()
+		},
+	})
+
+	coordinationNodeOffersShellCmd.AddCmd(&ishell.Cmd{
+		Name: "resolve",
+		Help: "give the final resolution of a dispute raised by the other party",
+		Func: func(c *ishell.Context) {
+			currentUuid := readOfferUuid(shell, c)
+			stateMutex.Lock()
+			d, ok := offerDisputes[currentUuid]
+			stateMutex.Unlock()
+			if !ok {
+				shell.Printf("offer '%s' has not been disputed\n", currentUuid)
+				return
+			}
+
+			choice := c.MultiChoice([]string{
+				esi.PriceMapOfferStatus_COMPLETED.String(),
+				esi.PriceMapOfferStatus_FAILED.String(),
+			}, "What is the final status of the offer?")
+			if choice < 0 {
+				return
+			}
+			outcome := esi.PriceMapOfferStatus_COMPLETED
+			if choice == 1 {
+				outcome = esi.PriceMapOfferStatus_FAILED
+			}
+			percentage, err := readPercentage(shell, c, d.dispute.GetDeliveredPercentage())
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			shell.Print("Message: ")
+			message := c.ReadLine()
+
+			stateMutex.Lock()
+			defer stateMutex.Unlock()
+			err = resolveDispute(currentUuid, outcome, percentage, message)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			shell.Println("\nDispute has been resolved.\n")
+		},
+	})
+
+	coordinationNodeLedgerShellCmd := &ishell.Cmd{
+		Name: "ledger",
+		Help: "view and export the amounts owed for offers",
+	}
+	shell.AddCmd(coordinationNodeLedgerShellCmd)
+	coordinationNodeLedgerShellCmd.AddCmd(&ishell.Cmd{
+		Name: "balances",
+		Help: "view the total owed with each counterparty in each currency",
+		Func: func(c *ishell.Context) {
+			stateMutex.Lock()
+			balances := ledgerBalances()
+			stateMutex.Unlock()
+			for _, total := range balances {
+				shell.Printf("\n%s %s\n%s %s %s\n",
+					boldMsgColorFunc("Counterparty:"),
+					noteMsgColorFunc(total.Counterparty),
+					boldMsgColorFunc("Balance:"),
+					infoMsgColorFunc(total.Amount),
+					total.Currency)
+			}
+			shell.Println()
+		},
+	})
+	coordinationNodeLedgerShellCmd.AddCmd(&ishell.Cmd{
+		Name: "statement",
+		Help: "export the ledger entries for a billing period as CSV or JSON",
+		Func: func(c *ishell.Context) {
+			now := time.Now().UTC()
+			monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+			from, err := readDate(shell, c, "From", monthStart)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			to, err := readDate(shell, c, "To", from.AddDate(0, 1, 0))
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			if !from.Before(to) {
+				shell.Println("billing period must end after it starts")
+				return
+			}
+			choice := c.MultiChoice([]string{
+				"CSV",
+				"JSON",
+			}, "Which format?")
+			if choice < 0 {
+				return
+			}
+			shell.Print("Path [print]: ")
+			path := c.ReadLine()
+
+			stateMutex.Lock()
+			statement := newLedgerStatement(from, to)
+			stateMutex.Unlock()
+			var exported bytes.Buffer
+			if choice == 0 {
+				err = writeStatementCsv(&exported, statement)
+			} else {
+				err = writeStatementJson(&exported, statement)
+			}
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+
+			if path == "" {
+				shell.Print(exported.String())
+				return
+			}
+			err = ioutil.WriteFile(path, exported.Bytes(), 0644)
+			if err != nil {
+				shell.Println(err.Error())
+				return
+			}
+			shell.Printf("\nStatement of %d entries written to %s.\n\n", len(statement.Entries), path)
 		},
 	})
 
 	shell.Run()
 }
 
+// readOfferUuid returns the offer uuid given as an argument, or prompts for it if none is given.
+func readOfferUuid(shell *ishell.Shell, c *ishell.Context) string {
+	if len(c.Args) > 0 {
+		return c.Args[0]
+	}
+	shell.Print("Offer UUID: ")
+
+	return c.ReadLine()
+}
+
+// evaluatedOffer returns an offer which is waiting for this coordination node to answer it, or an error if there is
+// none with the uuid.
+func evaluatedOffer(uuid string) (*esi.PriceMapOffer, error) {
+	offer, ok := priceMapOffers[uuid]
+	if !ok {
+		return nil, fmt.Errorf("no offer with the uuid: '%s'", uuid)
+	}
+	// Check to see if the responding party is responsible.
+	if offerRecipient(uuid) != coordinationNodeInfo.GetPublicKey() {
+		return nil, fmt.Errorf("you are not the responsible party for this offer")
+	}
+	// Check to see that the offer is actually available.
+	expireOfferIfDue(uuid)
+	if offerStatus(uuid) != esi.PriceMapOfferStatus_UNKNOWN {
+		return nil, fmt.Errorf("offer is not available")
+	}
+
+	return offer, nil
+}
+
+// readDate prompts for a date in UTC, with a default.
+func readDate(shell *ishell.Shell, c *ishell.Context, prompt string, def time.Time) (time.Time, error) {
+	shell.Printf("%s [%s]: ", prompt, def.Format(dateLayout))
+	dateString := c.ReadLine()
+	if dateString == "" {
+		return def, nil
+	}
+
+	return time.ParseInLocation(dateLayout, dateString, time.UTC)
+}
+
+// readPercentage prompts for a delivered percentage, with a default.
+func readPercentage(shell *ishell.Shell, c *ishell.Context, def float32) (float32, error) {
+	shell.Printf("Delivered Percentage [%.1f]: ", def)
+	percentageString := c.ReadLine()
+	if percentageString == "" {
+		return def, nil
+	}
+	percentage, err := strconv.ParseFloat(percentageString, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return float32(percentage), nil
+}
+
 // newPriceMap creates and returns a new price map.
 func newPriceMap(shell *ishell.Shell, c *ishell.Context, optRealPower string, optReactivePower string, optUnits string) (*esi.PriceMap, error) {
 	// Create newPowerComponents.
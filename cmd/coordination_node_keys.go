@@ -0,0 +1,193 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// rotateCoordinationNodeKey replaces the key pair of the running coordination node and returns the new public key.
+//
+// All registered peers and known registries are sent the new public key, signed by the old key, before the old
+// client is closed. The new secret key and config are written to disk, keeping the old secret key.
+//
+// The client is replaced under the state lock, which the caller holds, so the message receiver moves on to the new
+// client as soon as the old one is closed.
+func rotateCoordinationNodeKey() (string, error) {
+	oldPublicKey := coordinationNodeInfo.GetPublicKey()
+
+	newSeed, err := newNKNPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	newClient, err := newMultiClient(newSeed, numSubClients)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case <-newClient.OnConnect.C:
+	case <-time.After(keyRotationTimeout):
+		newClient.Close()
+		return "", errors.New("timed out connecting with the new key")
+	}
+	newPublicKey := formatBinary(newClient.PubKey())
+
+	rotation, err := newKeyRotation(coordinationNodePrivateKey, oldPublicKey, newPublicKey)
+	if err != nil {
+		newClient.Close()
+		return "", err
+	}
+
+	// Notify every peer while the old key is still in use.
+	peers := make(map[string]bool)
+	for publicKey := range registeredExchanges {
+		peers[publicKey] = true
+	}
+	for publicKey := range registeredFacilities {
+		peers[publicKey] = true
+	}
+	for publicKey := range peers {
+		err = esi.AnnounceKeyRotation(coordinationNodeClient, publicKey, rotation)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+	for publicKey := range knownRegistries {
+		err = esi.RotateCoordinationNodeKey(coordinationNodeClient, publicKey, rotation)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	err = writeRotatedKey(coordinationNodePath, coordinationNodeSecretPath, newSeed)
+	if err != nil {
+		newClient.Close()
+		return "", err
+	}
+
+	// Replace our own key in any stored routes, and switch to the new client.
+	replaceCoordinationNodeKey(oldPublicKey, newPublicKey)
+	coordinationNodeInfo.PublicKey = newPublicKey
+	coordinationNodePrivateKey = newSeed
+	oldClient := coordinationNodeClient
+	coordinationNodeClient = newClient
+	oldClient.Close()
+
+	log.WithFields(log.Fields{
+		"old":   oldPublicKey,
+		"new":   newPublicKey,
+		"peers": len(peers),
+	}).Info("Rotated key")
+
+	return newPublicKey, nil
+}
+
+// replaceCoordinationNodeKey replaces every stored reference to a public key with a new public key.
+func replaceCoordinationNodeKey(oldPublicKey string, newPublicKey string) {
+	if v, ok := registeredExchanges[oldPublicKey]; ok {
+		delete(registeredExchanges, oldPublicKey)
+		registeredExchanges[newPublicKey] = v
+	}
+	for _, peers := range []map[string]bool{registeredFacilities, pendingExchanges} {
+		if _, ok := peers[oldPublicKey]; ok {
+			delete(peers, oldPublicKey)
+			peers[newPublicKey] = true
+		}
+	}
+	for k, v := range sentRegistrationForms {
+		if k.facilityKey == oldPublicKey {
+			delete(sentRegistrationForms, k)
+			sentRegistrationForms[sentFormKey{newPublicKey, k.formKey}] = v
+		}
+	}
+	if v, ok := registrationApplicants[oldPublicKey]; ok {
+		delete(registrationApplicants, oldPublicKey)
+		registrationApplicants[newPublicKey] = v
+	}
+	if v, ok := pendingApprovals[oldPublicKey]; ok {
+		delete(pendingApprovals, oldPublicKey)
+		replaceRouteKey(v.Route, oldPublicKey, newPublicKey)
+		pendingApprovals[newPublicKey] = v
+	}
+	if v, ok := facilityPriceMaps[oldPublicKey]; ok {
+		delete(facilityPriceMaps, oldPublicKey)
+		facilityPriceMaps[newPublicKey] = v
+	}
+	if v, ok := facilityCatalogues[oldPublicKey]; ok {
+		delete(facilityCatalogues, oldPublicKey)
+		replaceRouteKey(v.Route, oldPublicKey, newPublicKey)
+		facilityCatalogues[newPublicKey] = v
+	}
+	if v, ok := facilityCharacteristics[oldPublicKey]; ok {
+		delete(facilityCharacteristics, oldPublicKey)
+		facilityCharacteristics[newPublicKey] = v
+	}
+	if v, ok := facilityPowerProfiles[oldPublicKey]; ok {
+		delete(facilityPowerProfiles, oldPublicKey)
+		replaceRouteKey(v.Route, oldPublicKey, newPublicKey)
+		facilityPowerProfiles[newPublicKey] = v
+	}
+	for _, calls := range callsForBids {
+		if v, ok := calls.bids[oldPublicKey]; ok {
+			delete(calls.bids, oldPublicKey)
+			replaceRouteKey(v.Route, oldPublicKey, newPublicKey)
+			calls.bids[newPublicKey] = v
+		}
+	}
+	if v, ok := knownCoordinationNodes[oldPublicKey]; ok {
+		delete(knownCoordinationNodes, oldPublicKey)
+		v.PublicKey = newPublicKey
+		knownCoordinationNodes[newPublicKey] = v
+	}
+	if v, ok := receivedRegistrationForms[oldPublicKey]; ok {
+		delete(receivedRegistrationForms, oldPublicKey)
+		replaceRouteKey(v.Route, oldPublicKey, newPublicKey)
+		receivedRegistrationForms[newPublicKey] = v
+	}
+	for _, offer := range priceMapOffers {
+		replaceRouteKey(offer.Route, oldPublicKey, newPublicKey)
+	}
+	for _, status := range priceMapOfferStatus {
+		replaceRouteKey(status.Route, oldPublicKey, newPublicKey)
+	}
+	for uuid, proposer := range offerProposers {
+		if proposer == oldPublicKey {
+			offerProposers[uuid] = newPublicKey
+		}
+	}
+	for _, d := range offerDisputes {
+		if d.raisedBy == oldPublicKey {
+			d.raisedBy = newPublicKey
+		}
+	}
+}
+
+// replaceRouteKey replaces a public key within a route.
+func replaceRouteKey(route *esi.DerRoute, oldPublicKey string, newPublicKey string) {
+	if route == nil {
+		return
+	}
+	if route.FacilityKey == oldPublicKey {
+		route.FacilityKey = newPublicKey
+	}
+	if route.ExchangeKey == oldPublicKey {
+		route.ExchangeKey = newPublicKey
+	}
+}
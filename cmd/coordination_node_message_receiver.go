@@ -22,14 +22,18 @@ import (
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 	"strconv"
-	"strings"
 )
 
 // coordinationNodeMessageReceiver receives and returns any incoming coordination node messages.
 func coordinationNodeMessageReceiver() {
 	var formKey int // a simple number to increment form number.
 
-	<-coordinationNodeClient.OnConnect.C
+	// The client is only read under the lock, as a key rotation replaces it.
+	stateMutex.Lock()
+	client := coordinationNodeClient
+	stateMutex.Unlock()
+
+	<-client.OnConnect.C
 	log.WithFields(log.Fields{
 		"publicKey": coordinationNodeInfo.GetPublicKey(),
 		"name":      coordinationNodeInfo.GetName(),
@@ -37,12 +41,41 @@ func coordinationNodeMessageReceiver() {
 
 	message := &esi.CoordinationNodeMessage{}
 
+	// The state is locked while handling each message, and unlocked while waiting for the next one, so that every
+	// path back to the start of the loop releases it.
+	stateMutex.Lock()
 	for {
+		client = coordinationNodeClient
+		stateMutex.Unlock()
 		// Unmarshal the protocol buffer.
-		msg := <-coordinationNodeClient.OnMessage.C
+		msg := <-client.OnMessage.C
+		stateMutex.Lock()
+		if msg == nil {
+			if client == coordinationNodeClient {
+				// The client has been closed without being replaced, so there is nothing left to receive.
+				stateMutex.Unlock()
+				log.Error("Connection closed")
+				return
+			}
+			// The client has been replaced by a key rotation, so read from the new client.
+			continue
+		}
 		err := proto.Unmarshal(msg.Data, message)
 		if err != nil {
 			log.Error(err.Error())
+			continue
+		}
+
+		// Check that the source is allowed to send the message, as defined in coordination_node_policy.go.
+		//
+		// This comes before the rate limit, so that denied messages never take up a token bucket.
+		if !authorizeCoordinationNodeMessage(msg.Src, message) {
+			continue
+		}
+
+		// Check that the source is within its rate limit, as defined in rate_limit.go.
+		if !coordinationNodeRateLimiter.allow(msg.Src, chunkName(message)) {
+			continue
 		}
 
 		// Case documentation located at api/esi/coordination_node_service.go.
@@ -61,28 +94,23 @@ func coordinationNodeMessageReceiver() {
 			}).Info(fmt.Sprintf("Saved coordination node %s", x.SendKnownDerFacility.GetPublicKey()))
 
 		case *esi.CoordinationNodeMessage_GetDerFacilityRegistrationForm:
+			// Don't generate any more forms for a facility which hasn't submitted the ones it has.
+			if registrationApplicants[msg.Src] >= maxPendingForms() {
+				coordinationNodeRateLimiter.drop(msg.Src, chunkName(message), "too many pending forms")
+				continue
+			}
+
 			// Set the basic info.
 			//
-			// An example FormSetting - you can set whatever you want, and the facility will get a copy for you to then
-			// evaluate as you wish.
-			newFormSetting := esi.FormSetting{
-				Key:         "0",
-				Label:       "Do you wish to register?",
-				Caption:     "",
-				Placeholder: "Y",
-			}
-			newForm := esi.Form{
-				LanguageCode: "en",
-				Key:          strconv.Itoa(formKey),
-				Settings:     []*esi.FormSetting{&newFormSetting},
-			}
+			// The form is read from the registration forms file, in the language best matching the request. You can
+			// set whatever you want, and the facility will get a copy for you to then evaluate as you wish.
 			newRoute := esi.DerRoute{
 				FacilityKey: msg.Src,
 				ExchangeKey: coordinationNodeInfo.GetPublicKey(),
 			}
 			newRegistrationForm := esi.DerFacilityRegistrationForm{
 				Route: &newRoute,
-				Form:  &newForm,
+				Form:  newRegistrationForm(x.GetDerFacilityRegistrationForm.GetLanguageCode(), strconv.Itoa(formKey)),
 			}
 
 			// Send the registration form.
@@ -91,10 +119,13 @@ func coordinationNodeMessageReceiver() {
 				log.Error(err.Error())
 			}
 
+			sentRegistrationForms[sentFormKey{msg.Src, newRegistrationForm.Form.GetKey()}] = newRegistrationForm.Form.GetLanguageCode()
 			formKey += 1 // increment form key
+			registrationApplicants[msg.Src] += 1
 
 			log.WithFields(log.Fields{
-				"dest": msg.Src,
+				"dest":     msg.Src,
+				"language": newRegistrationForm.Form.GetLanguageCode(),
 			}).Info("Sent registration form")
 
 		case *esi.CoordinationNodeMessage_SendDerFacilityRegistrationForm:
@@ -113,41 +144,36 @@ func coordinationNodeMessageReceiver() {
 				"src": msg.Src,
 			}).Info("Received registration form data")
 
-			registration := esi.DerFacilityRegistration{
-				Route: x.SubmitDerFacilityRegistrationForm.Route,
-			}
-			// If the user responded positively, then success.
-			response := strings.ToLower(x.SubmitDerFacilityRegistrationForm.Data.Data["0"])
-			if response == "y" || response == "yes" {
-				registration.Success = true
-			} else {
-				registration.Success = false
-			}
-
-			// If successful, add it as a facility.
-			if registration.Success {
-				registeredFacilities[msg.Src] = true
-			}
-
-			err = esi.CompleteDerFacilityRegistration(coordinationNodeClient, &registration)
-			if err != nil {
-				log.Error(err.Error())
+			// Run the form data through the registration approval pipeline. A queued registration is completed once it
+			// is approved or rejected in the shell.
+			result, reason := approveRegistrationForm(msg.Src, x.SubmitDerFacilityRegistrationForm)
+			delete(sentRegistrationForms, sentFormKey{msg.Src, x.SubmitDerFacilityRegistrationForm.GetData().GetKey()})
+			switch result {
+			case approveRegistration:
+				completeRegistration(msg.Src, true, "")
+			case rejectRegistration:
+				completeRegistration(msg.Src, false, reason)
+			case queueRegistration:
+				delete(registrationApplicants, msg.Src)
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Info("Queued registration for approval")
 			}
 
-			log.WithFields(log.Fields{
-				"dest":    msg.Src,
-				"success": registration.GetSuccess(),
-			}).Info("Sent completed registration form")
-
 		case *esi.CoordinationNodeMessage_CompleteDerFacilityRegistration:
-			if x.CompleteDerFacilityRegistration.GetSuccess() == true {
-				registeredExchange = msg.Src
-			}
+			delete(pendingExchanges, msg.Src)
 			log.WithFields(log.Fields{
 				"src":     msg.Src,
 				"success": x.CompleteDerFacilityRegistration.GetSuccess(),
+				"reason":  x.CompleteDerFacilityRegistration.GetReason(),
 			}).Info("Received completed registration form")
 
+			// Only a successful registration goes on to get power parameters.
+			if !x.CompleteDerFacilityRegistration.GetSuccess() {
+				continue
+			}
+			registeredExchanges[msg.Src] = newExchangeRegistration()
+
 			newRequest := esi.DerPowerParametersRequest{
 				Route: x.CompleteDerFacilityRegistration.Route,
 			}
@@ -185,8 +211,8 @@ func coordinationNodeMessageReceiver() {
 				"src": msg.Src,
 			}).Info("Received power parameters")
 
-			// Set your power parameters to the ones provided by the service.
-			powerParameters = *x.SetPowerParameters
+			// Set your power parameters for this exchange to the ones provided by the service.
+			registeredExchanges[msg.Src].powerParameters = x.SetPowerParameters
 
 			log.WithFields(log.Fields{
 				"src":   msg.Src,
@@ -200,169 +226,349 @@ func coordinationNodeMessageReceiver() {
 			}).Info("Received price datum")
 
 		case *esi.CoordinationNodeMessage_GetResourceCharacteristics:
-			// Check to make sure that the source is the registered exchange.
-			if registeredExchange == msg.Src {
-				newRoute := esi.DerRoute{
-					FacilityKey: coordinationNodeInfo.GetPublicKey(),
-					ExchangeKey: msg.Src,
-				}
-				newCharacteristics := resourceCharacteristics
-				newCharacteristics.Route = &newRoute
-				err := esi.SendResourceCharacteristics(coordinationNodeClient, &newCharacteristics)
-				if err != nil {
-					log.Error(err.Error())
-				}
-
-				log.WithFields(log.Fields{
-					"dest": msg.Src,
-				}).Info("Sent resource characteristics")
+			newRoute := esi.DerRoute{
+				FacilityKey: coordinationNodeInfo.GetPublicKey(),
+				ExchangeKey: msg.Src,
+			}
+			// In aggregator mode, the characteristics given to an exchange are those of the downstream facilities.
+			if aggregatorEnabled() {
+				registeredExchanges[msg.Src].characteristics = aggregateCharacteristics(facilityCharacteristics)
+			}
+			newCharacteristics := proto.Clone(registeredExchanges[msg.Src].characteristics).(*esi.DerCharacteristics)
+			newCharacteristics.Route = &newRoute
+			err := esi.SendResourceCharacteristics(coordinationNodeClient, newCharacteristics)
+			if err != nil {
+				log.Error(err.Error())
 			}
 
+			log.WithFields(log.Fields{
+				"dest": msg.Src,
+			}).Info("Sent resource characteristics")
+
 		case *esi.CoordinationNodeMessage_SendResourceCharacteristics:
-			// Check to make sure that the source is a registered facility.
-			if _, ok := registeredFacilities[msg.Src]; ok {
-				facilityCharacteristics[msg.Src] = x.SendResourceCharacteristics
+			facilityCharacteristics[msg.Src] = x.SendResourceCharacteristics
+
+			log.WithFields(log.Fields{
+				"src": msg.Src,
+			}).Info("Received resource characteristics")
+
+			publishAggregateCharacteristics()
 
+		case *esi.CoordinationNodeMessage_GetPriceMap:
+			err = esi.SendPriceMap(coordinationNodeClient, msg.Src, registeredExchanges[msg.Src].priceMap)
+			if err != nil {
+				log.Error(err.Error())
+			}
+
+			log.WithFields(log.Fields{
+				"dest": msg.Src,
+			}).Info("Sent price map")
+
+		case *esi.CoordinationNodeMessage_SendPriceMap:
+			facilityPriceMaps[msg.Src] = x.SendPriceMap
+
+			log.WithFields(log.Fields{
+				"src": msg.Src,
+			}).Info("Received price map")
+
+		case *esi.CoordinationNodeMessage_GetPriceMapCatalogue:
+			catalogue := esi.PriceMapCharacteristics{
+				Route: &esi.DerRoute{
+					ExchangeKey: msg.Src,
+					FacilityKey: coordinationNodeInfo.GetPublicKey(),
+				},
+				PriceMap: priceMapCatalogue,
+			}
+			err = esi.SendPriceMapCatalogue(coordinationNodeClient, &catalogue)
+			if err != nil {
+				log.Error(err.Error())
+			}
+
+			log.WithFields(log.Fields{
+				"dest":    msg.Src,
+				"entries": len(priceMapCatalogue),
+			}).Info("Sent price map catalogue")
+
+		case *esi.CoordinationNodeMessage_SendPriceMapCatalogue:
+			facilityCatalogues[msg.Src] = x.SendPriceMapCatalogue
+
+			log.WithFields(log.Fields{
+				"src":     msg.Src,
+				"entries": len(x.SendPriceMapCatalogue.GetPriceMap()),
+			}).Info("Received price map catalogue")
+
+		case *esi.CoordinationNodeMessage_RequestBids:
+			call := x.RequestBids
+			log.WithFields(log.Fields{
+				"src":  msg.Src,
+				"uuid": call.CallId.GetUuid(),
+			}).Info("Received call for bids")
+
+			// The call must be made by the exchange sending it, to this facility.
+			if call.Route.GetExchangeKey() != msg.Src || call.Route.GetFacilityKey() != coordinationNodeInfo.GetPublicKey() {
 				log.WithFields(log.Fields{
 					"src": msg.Src,
-				}).Info("Received resource characteristics")
+				}).Warn("Call for bids has an invalid route")
+				continue
+			}
+			bid := newBid(call)
+			if bid == nil {
+				log.WithFields(log.Fields{
+					"uuid": call.CallId.GetUuid(),
+				}).Info("Declined call for bids")
+				continue
+			}
+			err = esi.SubmitBid(coordinationNodeClient, bid)
+			if err != nil {
+				log.Error(err.Error())
 			}
 
-		case *esi.CoordinationNodeMessage_GetPriceMap:
-			// Check to make sure that the source is the registered exchange.
-			if registeredExchange == msg.Src {
-				err = esi.SendPriceMap(coordinationNodeClient, x.GetPriceMap.Route.GetExchangeKey(), &priceMap)
-				if err != nil {
-					log.Error(err.Error())
-				}
+			log.WithFields(log.Fields{
+				"dest":  msg.Src,
+				"uuid":  call.CallId.GetUuid(),
+				"power": bidPower(bid),
+				"price": formatNanos(bidPrice(bid)),
+			}).Info("Sent bid")
+
+		case *esi.CoordinationNodeMessage_SubmitBid:
+			bid := x.SubmitBid
+			if bid.Route.GetFacilityKey() != msg.Src {
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Warn("Bid has an invalid route")
+				continue
+			}
+			err = receiveBid(msg.Src, bid)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"src":   msg.Src,
+					"uuid":  bid.CallId.GetUuid(),
+					"error": err.Error(),
+				}).Warn("Rejected bid")
+				continue
+			}
 
+			log.WithFields(log.Fields{
+				"src":   msg.Src,
+				"uuid":  bid.CallId.GetUuid(),
+				"power": bidPower(bid),
+				"price": formatNanos(bidPrice(bid)),
+			}).Info("Received bid")
+
+		case *esi.CoordinationNodeMessage_ListPowerProfile:
+			request := x.ListPowerProfile
+			datum, err := powerProfile(request)
+			if err != nil {
 				log.WithFields(log.Fields{
-					"dest": msg.Src,
-				}).Info("Sent price map")
+					"src":   msg.Src,
+					"error": err.Error(),
+				}).Warn("Invalid power profile request")
+				continue
+			}
+			profile := esi.PowerProfile{
+				Route: &esi.DerRoute{
+					ExchangeKey: msg.Src,
+					FacilityKey: coordinationNodeInfo.GetPublicKey(),
+				},
+				Datum:     datum,
+				RequestId: request.RequestId,
+			}
+			// The profile is signed, so that it can be given as evidence in a dispute.
+			err = signProfile(&profile)
+			if err != nil {
+				log.Error(err.Error())
+				continue
+			}
+			err = esi.SendPowerProfile(coordinationNodeClient, &profile)
+			if err != nil {
+				log.Error(err.Error())
 			}
 
-		case *esi.CoordinationNodeMessage_SendPriceMap:
-			// Check to make sure that the source is a registered facility.
-			if _, ok := registeredFacilities[msg.Src]; ok {
-				facilityPriceMaps[msg.Src] = x.SendPriceMap
+			log.WithFields(log.Fields{
+				"dest":  msg.Src,
+				"datum": len(datum),
+			}).Info("Sent power profile")
 
+		case *esi.CoordinationNodeMessage_SendPowerProfile:
+			err = verifyProfileSignature(msg.Src, x.SendPowerProfile)
+			if err != nil {
 				log.WithFields(log.Fields{
-					"src": msg.Src,
-				}).Info("Received price map")
+					"src":   msg.Src,
+					"error": err.Error(),
+				}).Warn("Invalid power profile")
+				continue
 			}
+			facilityPowerProfiles[msg.Src] = x.SendPowerProfile
 
-		case *esi.CoordinationNodeMessage_ProposePriceMapOffer:
-			// Check to make sure that the source is the registered exchange or facility.
-			_, ok := registeredFacilities[msg.Src]
-			if registeredExchange == msg.Src || ok {
-				log.Info("Received propose offer")
-				if x.ProposePriceMapOffer.PriceMap.Price.ApparentEnergyPrice.Units < autoPrice.AlwaysBuyBelowPrice.Units {
-					// If the offer is below our auto accept, just accept the offer.
-					//
-					// There is also a value for "AvoidBuyOverPrice", which could be used in a similar way in other
-					// scenarios. In this demo, if the price is not lower than our auto accept, then it just goes to
-					// evaluation.
-					var response *esi.PriceMapOfferResponse
-					if x.ProposePriceMapOffer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
-						response = acceptOffer(x.ProposePriceMapOffer.Route, x.ProposePriceMapOffer.OfferId, &esi.NodeType{Type: esi.NodeType_EXCHANGE})
-					} else {
-						response = acceptOffer(x.ProposePriceMapOffer.Route, x.ProposePriceMapOffer.OfferId, &esi.NodeType{Type: esi.NodeType_FACILITY})
-					}
-					err = esi.SendPriceMapOfferResponse(coordinationNodeClient, response)
-					if err != nil {
-						log.Error(err.Error())
-					}
+			log.WithFields(log.Fields{
+				"src":   msg.Src,
+				"datum": len(x.SendPowerProfile.GetDatum()),
+			}).Info("Received power profile")
 
-					log.WithFields(log.Fields{
-						"src":  msg.Src,
-						"auto": autoPrice.AlwaysBuyBelowPrice.Units,
-					}).Info("Accepted price map due to auto buy")
-
-					priceMapOffers[x.ProposePriceMapOffer.OfferId.Uuid] = x.ProposePriceMapOffer
-					// Store the status of the offer.
-					status := esi.PriceMapOfferStatus{
-						Route:   x.ProposePriceMapOffer.Route,
-						OfferId: x.ProposePriceMapOffer.OfferId,
-						Status:  esi.PriceMapOfferStatus_ACCEPTED,
-					}
-					priceMapOfferStatus[x.ProposePriceMapOffer.OfferId.Uuid] = &status
-				} else {
-					priceMapOffers[x.ProposePriceMapOffer.OfferId.Uuid] = x.ProposePriceMapOffer
+			// A profile requested to verify the feedback on an offer answers that feedback.
+			receiveVerification(msg.Src, x.SendPowerProfile)
 
-					log.WithFields(log.Fields{
-						"src": msg.Src,
-					}).Info("Received price map offer")
+		case *esi.CoordinationNodeMessage_ProposePriceMapOffer:
+			if pendingOffers(msg.Src) >= maxPendingOffers() {
+				coordinationNodeRateLimiter.drop(msg.Src, chunkName(message), "too many pending offers")
+				continue
+			}
 
-					// Store the status of the offer.
-					status := esi.PriceMapOfferStatus{
-						Route:   x.ProposePriceMapOffer.Route,
-						OfferId: x.ProposePriceMapOffer.OfferId,
-						Status:  esi.PriceMapOfferStatus_UNKNOWN,
-					}
-					priceMapOfferStatus[x.ProposePriceMapOffer.OfferId.Uuid] = &status
+			log.Info("Received propose offer")
+
+			// An offer must be party to the sender, and its ID must not have been used before.
+			offer := x.ProposePriceMapOffer
+			if offer.Route.GetFacilityKey() != msg.Src && offer.Route.GetExchangeKey() != msg.Src {
+				sendOfferError(msg.Src, offer.Route, offer.OfferId, fmt.Errorf("not a party to offer '%s'", offer.OfferId.GetUuid()))
+				continue
+			}
+			// An offer must also be made to this coordination node.
+			if routeCounterparty(offer.Route, msg.Src) != coordinationNodeInfo.GetPublicKey() {
+				sendOfferError(msg.Src, offer.Route, offer.OfferId, fmt.Errorf("offer '%s' is not made to this node", offer.OfferId.GetUuid()))
+				continue
+			}
+			// An offer made against the catalogue of this facility must match the entry.
+			if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
+				err = checkCatalogueOffer(offer)
+				if err != nil {
+					sendOfferError(msg.Src, offer.Route, offer.OfferId, err)
+					continue
 				}
 			}
+			// An offer must be signed by its proposer, so that it can be held to it.
+			err = verifyOfferSignature(msg.Src, offer, offer.GetSignature())
+			if err == nil {
+				err = trackOffer(offer, msg.Src)
+			}
+			if err != nil {
+				sendOfferError(msg.Src, offer.Route, offer.OfferId, err)
+				continue
+			}
+			counterpartySignatures[offer.OfferId.GetUuid()] = offer.GetSignature()
+			// An offer which arrives after its deadline can never be accepted.
+			if expireOfferIfDue(offer.OfferId.Uuid) {
+				continue
+			}
+
+			// Answer the offer with the negotiation strategy, or leave it to be evaluated.
+			if !negotiate(offer) {
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Info("Received price map offer")
+			}
 
 		case *esi.CoordinationNodeMessage_SendPriceMapOfferResponse:
-			switch y := x.SendPriceMapOfferResponse.AcceptOneof.(type) {
+			response := x.SendPriceMapOfferResponse
+			switch y := response.AcceptOneof.(type) {
 			// Evaluate the contents of the response.
 			case *esi.PriceMapOfferResponse_Accept:
+				// Only an offer that was made to the sender, and which is still waiting for an answer, can be accepted
+				// or rejected. An offer which has passed its deadline is expired instead.
+				target := esi.PriceMapOfferStatus_REJECTED
+				if y.Accept {
+					target = esi.PriceMapOfferStatus_ACCEPTED
+				}
+				// An offer is accepted with the signature of the recipient, so that it can be held to it.
+				offer, err := peerOffer(msg.Src, response.OfferId.GetUuid())
+				if err == nil {
+					err = checkOfferRecipient(msg.Src, response.OfferId.GetUuid())
+				}
+				if err == nil && y.Accept {
+					err = verifyOfferSignature(msg.Src, offer, response.GetOfferSignature())
+				}
+				if err == nil {
+					expireOfferIfDue(response.OfferId.GetUuid())
+					err = transitionOffer(response.OfferId.GetUuid(), target)
+				}
+				if err != nil {
+					sendOfferError(msg.Src, response.Route, response.OfferId, err)
+					continue
+				}
+
 				if y.Accept {
+					counterpartySignatures[response.OfferId.GetUuid()] = response.GetOfferSignature()
 					// If the offer has been accepted, log the acceptance.
 					log.WithFields(log.Fields{
 						"src": msg.Src,
 					}).Info("Price map accepted")
-
-					// Store the status ACCEPTED.
-					priceMapOfferStatus[x.SendPriceMapOfferResponse.OfferId.Uuid].Status = esi.PriceMapOfferStatus_ACCEPTED
+				} else {
+					// A rejection ends the negotiation, so no counter offer is made.
+					log.WithFields(log.Fields{
+						"src":    msg.Src,
+						"uuid":   response.OfferId.GetUuid(),
+						"reason": response.GetReason(),
+					}).Info("Price map rejected")
 				}
 			case *esi.PriceMapOfferResponse_CounterOffer:
-				log.WithFields(log.Fields{
-					"src": msg.Src,
-				}).Info("Counter offer received")
+				if pendingOffers(msg.Src) >= maxPendingOffers() {
+					coordinationNodeRateLimiter.drop(msg.Src, chunkName(message), "too many pending offers")
+					continue
+				}
 
-				// Store the previous offer as REJECTED.
-				priceMapOfferStatus[x.SendPriceMapOfferResponse.PreviousOffer.Uuid].Status = esi.PriceMapOfferStatus_REJECTED
+				// A counter offer rejects the previous offer, so the previous offer must be known, made to the sender
+				// and still waiting for an answer.
+				previousOffer, err := peerOffer(msg.Src, response.PreviousOffer.GetUuid())
+				expireOfferIfDue(response.PreviousOffer.GetUuid())
+				if err == nil {
+					err = checkOfferRecipient(msg.Src, response.PreviousOffer.GetUuid())
+				}
+				if err == nil {
+					err = checkOfferRounds(response.PreviousOffer.GetUuid())
+				}
+				if err == nil && !canTransitionOffer(offerStatus(response.PreviousOffer.GetUuid()), esi.PriceMapOfferStatus_REJECTED) {
+					err = &offerTransitionError{
+						uuid: response.PreviousOffer.GetUuid(),
+						from: offerStatus(response.PreviousOffer.GetUuid()),
+						to:   esi.PriceMapOfferStatus_REJECTED,
+					}
+				}
+				if err != nil {
+					sendOfferError(msg.Src, response.Route, response.PreviousOffer, err)
+					continue
+				}
 
 				// In the new offer, use the time specified by the previous offer.
 				newOffer := esi.PriceMapOffer{
-					Route:    x.SendPriceMapOfferResponse.Route,
-					OfferId:  x.SendPriceMapOfferResponse.OfferId,
-					When:     priceMapOffers[x.SendPriceMapOfferResponse.PreviousOffer.Uuid].When,
-					PriceMap: x.SendPriceMapOfferResponse.GetCounterOffer(),
-					//Node:     &esi.NodeType{Type: party},
-					Node: x.SendPriceMapOfferResponse.Node,
+					Route:     previousOffer.Route,
+					OfferId:   response.OfferId,
+					When:      previousOffer.When,
+					PriceMap:  response.GetCounterOffer(),
+					Node:      response.Node,
+					RespondBy: response.RespondBy,
+					// A counter offer is made against the same catalogue entry as the offer it answers.
+					CatalogueEntry: previousOffer.GetCatalogueEntry(),
+					Signature:      response.GetOfferSignature(),
 				}
-				// Store the new offer.
-				priceMapOffers[x.SendPriceMapOfferResponse.OfferId.Uuid] = &newOffer
-
-				// Store the status of the offer.
-				status := esi.PriceMapOfferStatus{
-					Route:   x.SendPriceMapOfferResponse.Route,
-					OfferId: x.SendPriceMapOfferResponse.OfferId,
-					Status:  esi.PriceMapOfferStatus_UNKNOWN,
-				}
-				priceMapOfferStatus[x.SendPriceMapOfferResponse.OfferId.Uuid] = &status
-
-				if y.CounterOffer.Price.ApparentEnergyPrice.Units < autoPrice.AlwaysBuyBelowPrice.Units {
-					// If it falls below the auto accept, then accept it.
-					var response *esi.PriceMapOfferResponse
-					if x.SendPriceMapOfferResponse.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
-						response = acceptOffer(x.SendPriceMapOfferResponse.Route, x.SendPriceMapOfferResponse.OfferId, &esi.NodeType{Type: esi.NodeType_EXCHANGE})
-					} else {
-						response = acceptOffer(x.SendPriceMapOfferResponse.Route, x.SendPriceMapOfferResponse.OfferId, &esi.NodeType{Type: esi.NodeType_FACILITY})
-					}
-					err = esi.SendPriceMapOfferResponse(coordinationNodeClient, response)
+				if newOffer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
+					err = checkCatalogueOffer(&newOffer)
 					if err != nil {
-						log.Error(err.Error())
+						sendOfferError(msg.Src, response.Route, response.OfferId, err)
+						continue
 					}
+				}
+				// Store the new offer, which must be signed by the sender.
+				err = verifyOfferSignature(msg.Src, &newOffer, newOffer.Signature)
+				if err == nil {
+					err = trackOffer(&newOffer, msg.Src)
+				}
+				if err != nil {
+					sendOfferError(msg.Src, response.Route, response.OfferId, err)
+					continue
+				}
+				counterpartySignatures[response.OfferId.GetUuid()] = newOffer.Signature
+				expireOfferIfDue(response.OfferId.GetUuid())
 
-					priceMapOfferStatus[x.SendPriceMapOfferResponse.OfferId.Uuid].Status = esi.PriceMapOfferStatus_ACCEPTED
+				// Store the previous offer as REJECTED.
+				_ = transitionOffer(response.PreviousOffer.GetUuid(), esi.PriceMapOfferStatus_REJECTED)
+				previousOffers[response.OfferId.GetUuid()] = response.PreviousOffer.GetUuid()
 
-					log.WithFields(log.Fields{
-						"src":  msg.Src,
-						"auto": autoPrice.AlwaysBuyBelowPrice.Units,
-					}).Info("Accepted price map due to auto buy")
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Info("Counter offer received")
+
+				// Answer the counter offer with the negotiation strategy, or leave it to be evaluated.
+				if offerStatus(response.OfferId.GetUuid()) == esi.PriceMapOfferStatus_UNKNOWN {
+					negotiate(&newOffer)
 				}
 			}
 
@@ -371,49 +577,216 @@ func coordinationNodeMessageReceiver() {
 			//
 			// In a real situation, getting feedback on a response (either manually or automatically) is very powerful,
 			// this is just to show the capability.
-			if _, ok := registeredFacilities[msg.Src]; ok {
-				log.WithFields(log.Fields{
-					"src":   msg.Src,
-					"claim": x.GetPriceMapOfferFeedback.ObligationStatus,
-				}).Info("Received offer feedback")
+			log.WithFields(log.Fields{
+				"src":     msg.Src,
+				"claim":   x.GetPriceMapOfferFeedback.ObligationStatus,
+				"message": x.GetPriceMapOfferFeedback.GetMessage(),
+			}).Info("Received offer feedback")
+
+			// The offer may not have been seen to start executing yet if its duration is shorter than the interval of
+			// the periodic messenger, in which case it is moved through EXECUTING first.
+			uuid := x.GetPriceMapOfferFeedback.OfferId.GetUuid()
+			_, err = peerOffer(msg.Src, uuid)
+			if err == nil && offerStatus(uuid) == esi.PriceMapOfferStatus_ACCEPTED {
+				err = transitionOffer(uuid, esi.PriceMapOfferStatus_EXECUTING)
+			}
+			// A facility which could not carry out the offer fails it.
+			outcome := esi.PriceMapOfferStatus_COMPLETED
+			if x.GetPriceMapOfferFeedback.ObligationStatus == esi.PriceMapOfferFeedback_UNSATISFIED {
+				outcome = esi.PriceMapOfferStatus_FAILED
+			}
+			if err == nil {
+				err = transitionOffer(uuid, outcome)
+			}
+			if err != nil {
+				sendOfferError(msg.Src, x.GetPriceMapOfferFeedback.Route, x.GetPriceMapOfferFeedback.OfferId, err)
+				continue
+			}
 
-				response := esi.PriceMapOfferFeedbackResponse{
-					Route:    x.GetPriceMapOfferFeedback.Route,
-					OfferId:  x.GetPriceMapOfferFeedback.OfferId,
-					Accepted: true,
-				}
+			offerFeedback[uuid] = x.GetPriceMapOfferFeedback
+
+			log.WithFields(log.Fields{
+				"src":       msg.Src,
+				"uuid":      uuid,
+				"status":    outcome,
+				"delivered": fmt.Sprintf("%.1f%%", x.GetPriceMapOfferFeedback.DeliveredPercentage),
+			}).Info("Offer has finished")
+
+			// A facility which could not carry out the offer is taken at its word. Any other claim is checked against
+			// the delivery measured from the power profile of the facility, which answers the feedback.
+			if x.GetPriceMapOfferFeedback.ObligationStatus == esi.PriceMapOfferFeedback_UNSATISFIED {
+				answerFeedback(uuid, true, "", 0)
+				continue
+			}
+			err = requestVerification(uuid)
+			if err != nil {
+				log.Error(err.Error())
+			}
 
+		case *esi.CoordinationNodeMessage_ProvidePriceMapOfferFeedback:
+			_, err = peerOffer(msg.Src, x.ProvidePriceMapOfferFeedback.OfferId.GetUuid())
+			if err != nil {
+				log.Error(err.Error())
+				continue
+			}
+			offerFeedbackAccepted[x.ProvidePriceMapOfferFeedback.OfferId.GetUuid()] = x.ProvidePriceMapOfferFeedback.Accepted
+
+			if !x.ProvidePriceMapOfferFeedback.Accepted {
 				log.WithFields(log.Fields{
 					"src":  msg.Src,
-					"uuid": x.GetPriceMapOfferFeedback.OfferId.Uuid,
-				}).Info("Offer has completed")
-				priceMapOfferStatus[x.GetPriceMapOfferFeedback.OfferId.Uuid].Status = esi.PriceMapOfferStatus_COMPLETED
-
-				err := esi.ProvidePriceMapOfferFeedback(coordinationNodeClient, &response)
-				if err != nil {
-					log.Error(err.Error())
-				}
+					"uuid": x.ProvidePriceMapOfferFeedback.OfferId.GetUuid(),
+				}).Warn("Feedback was not accepted, expect a dispute")
+				continue
 			}
 
-		case *esi.CoordinationNodeMessage_ProvidePriceMapOfferFeedback:
 			log.WithFields(log.Fields{
 				"src":   msg.Src,
 				"claim": x.ProvidePriceMapOfferFeedback.Accepted,
 			}).Info("Received feedback response")
+
+		case *esi.CoordinationNodeMessage_DisputePriceMapOffer:
+			err = receiveDispute(msg.Src, x.DisputePriceMapOffer)
+			if err != nil {
+				sendOfferError(msg.Src, x.DisputePriceMapOffer.Route, x.DisputePriceMapOffer.OfferId, err)
+			}
+
+		case *esi.CoordinationNodeMessage_ResolvePriceMapOfferDispute:
+			err = receiveResolution(msg.Src, x.ResolvePriceMapOfferDispute)
+			if err != nil {
+				sendOfferError(msg.Src, x.ResolvePriceMapOfferDispute.Route, x.ResolvePriceMapOfferDispute.OfferId, err)
+			}
+
+		case *esi.CoordinationNodeMessage_SendPriceMapOfferError:
+			log.WithFields(log.Fields{
+				"src":    msg.Src,
+				"uuid":   x.SendPriceMapOfferError.OfferId.GetUuid(),
+				"status": x.SendPriceMapOfferError.GetStatus(),
+				"error":  x.SendPriceMapOfferError.GetMessage(),
+			}).Warn("Offer message rejected by peer")
+
+			// A dispute the peer refused is withdrawn, rather than left waiting on a resolution which never comes.
+			withdrawDispute(msg.Src, x.SendPriceMapOfferError)
+
+		case *esi.CoordinationNodeMessage_ExpirePriceMapOffer:
+			// An offer may already have been expired locally, but may not be expired before its deadline.
+			uuid := x.ExpirePriceMapOffer.OfferId.GetUuid()
+			offer, err := peerOffer(msg.Src, uuid)
+			if err == nil && offerDeadline(offer) > unixSeconds() {
+				err = fmt.Errorf("offer '%s' is not due to expire until %d", uuid, offerDeadline(offer))
+			}
+			if err == nil && offerStatus(uuid) != esi.PriceMapOfferStatus_EXPIRED {
+				err = transitionOffer(uuid, esi.PriceMapOfferStatus_EXPIRED)
+			}
+			if err != nil {
+				sendOfferError(msg.Src, x.ExpirePriceMapOffer.Route, x.ExpirePriceMapOffer.OfferId, err)
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"src":  msg.Src,
+				"uuid": uuid,
+			}).Info("Offer expired by peer")
+
+		case *esi.CoordinationNodeMessage_CancelPriceMapOffer:
+			// The sender is charged any penalty for the cancellation.
+			uuid := x.CancelPriceMapOffer.OfferId.GetUuid()
+			_, err = peerOffer(msg.Src, uuid)
+			if err == nil {
+				err = cancelOffer(uuid, msg.Src, x.CancelPriceMapOffer.GetReason())
+			}
+			if err != nil {
+				sendOfferError(msg.Src, x.CancelPriceMapOffer.Route, x.CancelPriceMapOffer.OfferId, err)
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"src":     msg.Src,
+				"uuid":    uuid,
+				"message": x.CancelPriceMapOffer.GetMessage(),
+			}).Info("Offer cancelled by peer")
+
+		case *esi.CoordinationNodeMessage_DeregisterFacility:
+			removeRegisteredFacility(msg.Src)
+
+			log.WithFields(log.Fields{
+				"src":    msg.Src,
+				"reason": x.DeregisterFacility.GetReason(),
+			}).Info("Facility deregistered")
+
+		case *esi.CoordinationNodeMessage_RevokeRegistration:
+			removeRegisteredExchange(msg.Src)
+
+			log.WithFields(log.Fields{
+				"src":    msg.Src,
+				"reason": x.RevokeRegistration.GetReason(),
+			}).Info("Registration revoked by exchange")
+
+		case *esi.CoordinationNodeMessage_AnnounceKeyRotation:
+			// Only the old key may announce its replacement.
+			err = verifyKeyRotation(x.AnnounceKeyRotation)
+			if err != nil || x.AnnounceKeyRotation.GetOldPublicKey() != msg.Src {
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Warn("Rejected key rotation")
+				continue
+			}
+
+			replaceCoordinationNodeKey(x.AnnounceKeyRotation.GetOldPublicKey(), x.AnnounceKeyRotation.GetNewPublicKey())
+
+			log.WithFields(log.Fields{
+				"src": msg.Src,
+				"new": x.AnnounceKeyRotation.GetNewPublicKey(),
+			}).Info("Replaced coordination node key")
+		}
+	}
+}
+
+// pendingOffers returns the number of unanswered offers involving a peer.
+func pendingOffers(publicKey string) int {
+	var count int
+	for uuid, offer := range priceMapOffers {
+		if priceMapOfferStatus[uuid].GetStatus() != esi.PriceMapOfferStatus_UNKNOWN {
+			continue
+		}
+		if offer.Route.GetFacilityKey() == publicKey || offer.Route.GetExchangeKey() == publicKey {
+			count += 1
 		}
 	}
+
+	return count
 }
 
-// acceptOffer accepts a given offer.
-func acceptOffer(route *esi.DerRoute, offerId *esi.Uuid, nodeType *esi.NodeType) *esi.PriceMapOfferResponse {
+// acceptOffer accepts a given offer, signed by this coordination node.
+func acceptOffer(offer *esi.PriceMapOffer, nodeType *esi.NodeType) (*esi.PriceMapOfferResponse, error) {
+	signature, err := signOffer(offer)
+	if err != nil {
+		return nil, err
+	}
 	accept := esi.PriceMapOfferResponse_Accept{
 		Accept: true,
 	}
+	response := esi.PriceMapOfferResponse{
+		Route:          offer.Route,
+		OfferId:        offer.OfferId,
+		AcceptOneof:    &accept,
+		Node:           nodeType,
+		OfferSignature: signature,
+	}
+
+	return &response, nil
+}
+
+// rejectOffer rejects a given offer, ending its negotiation.
+func rejectOffer(route *esi.DerRoute, offerId *esi.Uuid, nodeType *esi.NodeType, reason string) *esi.PriceMapOfferResponse {
+	accept := esi.PriceMapOfferResponse_Accept{
+		Accept: false,
+	}
 	response := esi.PriceMapOfferResponse{
 		Route:       route,
 		OfferId:     offerId,
 		AcceptOneof: &accept,
 		Node:        nodeType,
+		Reason:      reason,
 	}
 
 	return &response
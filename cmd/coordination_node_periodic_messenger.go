@@ -24,6 +24,8 @@ import (
 )
 
 // coordinationNodePeriodicMessenger sends information at a regular period.
+//
+// Offers are moved through their lifecycle by coordinationNodeOfferScheduler instead, at the time each step is due.
 func coordinationNodePeriodicMessenger() {
 	// Expected price low of any random price.
 	priceLow := 20
@@ -31,6 +33,7 @@ func coordinationNodePeriodicMessenger() {
 	priceHigh := 35
 
 	for {
+		stateMutex.Lock()
 		if len(registeredFacilities) > 0 {
 
 			// Explicit look at just facilities.
@@ -71,47 +74,7 @@ func coordinationNodePeriodicMessenger() {
 				}).Info("Sent price datum")
 			}
 		}
-
-		// Look at current offers.
-		for uuid, offer := range priceMapOffers {
-			// Actions specifically relating to the facility.
-			if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
-
-				// If the offer has been accepted, then check to see if the time expected has passed.
-				if priceMapOfferStatus[offer.OfferId.Uuid].Status == esi.PriceMapOfferStatus_ACCEPTED && offer.When.Seconds <= unixSeconds() {
-					priceMapOfferStatus[offer.OfferId.Uuid].Status = esi.PriceMapOfferStatus_EXECUTING
-
-					log.WithFields(log.Fields{
-						"uuid": uuid,
-					}).Info("Offer is executing")
-				}
-			}
-
-			// If the offer is executing and has passed the time expected to execute, set it to complete.
-			if priceMapOfferStatus[offer.OfferId.Uuid].Status == esi.PriceMapOfferStatus_EXECUTING {
-				// The time when is in nanoseconds, and duration is in seconds.
-				if (offer.When.Seconds + offer.PriceMap.Duration.Seconds) <= unixSeconds() {
-					priceMapOfferStatus[offer.OfferId.Uuid].Status = esi.PriceMapOfferStatus_COMPLETED
-
-					log.WithFields(log.Fields{
-						"uuid": uuid,
-					}).Info("Offer has completed")
-
-					// Create a new feedback.
-					newFeedback := esi.PriceMapOfferFeedback{
-						Route:            offer.Route,
-						OfferId:          offer.OfferId,
-						ObligationStatus: 2,
-					}
-
-					// Get feedback from exchange.
-					err := esi.GetPriceMapOfferFeedback(coordinationNodeClient, &newFeedback)
-					if err != nil {
-						log.Error(err.Error())
-					}
-				}
-			}
-		}
+		stateMutex.Unlock()
 
 		// Do these actions at a regular interval.
 		time.Sleep(time.Second * 20)
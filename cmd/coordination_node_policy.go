@@ -0,0 +1,125 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+)
+
+// peerRole is a relationship that a peer has with the coordination node.
+//
+// Roles are bit flags, so that a policy can allow several roles and a peer can hold several roles at once.
+type peerRole uint
+
+const (
+	// anyRole is held by every peer.
+	anyRole peerRole = 1 << iota
+	// exchangeRole is held by registered exchanges.
+	exchangeRole
+	// facilityRole is held by registered facilities.
+	facilityRole
+	// pendingExchangeRole is held by exchanges that a registration form has been requested from.
+	pendingExchangeRole
+	// applicantRole is held by facilities that have been sent a registration form.
+	applicantRole
+	// registryRole is held by registries that have been signed up to or queried.
+	registryRole
+)
+
+var (
+	// coordinationNodeMessagePolicy maps each CoordinationNodeMessage case to the roles allowed to send it.
+	//
+	// Any case that is not listed is denied.
+	coordinationNodeMessagePolicy = map[string]peerRole{
+		"SendKnownDerFacility":              registryRole,
+		"GetDerFacilityRegistrationForm":    anyRole,
+		"SendDerFacilityRegistrationForm":   pendingExchangeRole,
+		"SubmitDerFacilityRegistrationForm": applicantRole,
+		"CompleteDerFacilityRegistration":   pendingExchangeRole,
+		"GetResourceCharacteristics":        exchangeRole,
+		"SendResourceCharacteristics":       facilityRole,
+		"GetPriceMap":                       exchangeRole,
+		"SendPriceMap":                      facilityRole,
+		"ProposePriceMapOffer":              exchangeRole | facilityRole,
+		"SendPriceMapOfferResponse":         exchangeRole | facilityRole,
+		"GetPriceMapOfferFeedback":          facilityRole,
+		"ProvidePriceMapOfferFeedback":      exchangeRole,
+		"ProvidePrices":                     exchangeRole,
+		"ListPowerProfile":                  exchangeRole,
+		"GetPowerParameters":                facilityRole,
+		"SetPowerParameters":                exchangeRole,
+		"ListPrices":                        exchangeRole,
+		"AnnounceKeyRotation":               exchangeRole | facilityRole | pendingExchangeRole | applicantRole,
+		"DeregisterFacility":                facilityRole,
+		"RevokeRegistration":                exchangeRole,
+		"SendPriceMapOfferError":            exchangeRole | facilityRole,
+		"ExpirePriceMapOffer":               exchangeRole | facilityRole,
+		"CancelPriceMapOffer":               exchangeRole | facilityRole,
+		"GetPriceMapCatalogue":              exchangeRole,
+		"SendPriceMapCatalogue":             facilityRole,
+		"RequestBids":                       exchangeRole,
+		"SubmitBid":                         facilityRole,
+		"SendPowerProfile":                  facilityRole,
+		"DisputePriceMapOffer":              exchangeRole | facilityRole,
+		"ResolvePriceMapOfferDispute":       exchangeRole | facilityRole,
+	}
+
+	// deniedMessages is the number of denied messages by CoordinationNodeMessage case.
+	deniedMessages = make(map[string]int)
+)
+
+// peerRoles returns the roles held by a peer.
+func peerRoles(publicKey string) peerRole {
+	roles := anyRole
+	if _, ok := registeredExchanges[publicKey]; ok {
+		roles |= exchangeRole
+	}
+	if registeredFacilities[publicKey] {
+		roles |= facilityRole
+	}
+	if pendingExchanges[publicKey] {
+		roles |= pendingExchangeRole
+	}
+	if registrationApplicants[publicKey] > 0 {
+		roles |= applicantRole
+	}
+	if knownRegistries[publicKey] {
+		roles |= registryRole
+	}
+
+	return roles
+}
+
+// authorizeCoordinationNodeMessage returns true if the source is allowed to send the message.
+//
+// Denied messages are logged and counted.
+func authorizeCoordinationNodeMessage(src string, message *esi.CoordinationNodeMessage) bool {
+	name := chunkName(message)
+	if coordinationNodeMessagePolicy[name]&peerRoles(src) != 0 {
+		return true
+	}
+
+	deniedMessages[name] += 1
+	log.WithFields(log.Fields{
+		"src":     src,
+		"message": name,
+		"denied":  deniedMessages[name],
+	}).Warn("Denied message")
+
+	return false
+}
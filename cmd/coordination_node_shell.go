@@ -26,17 +26,15 @@ import (
 )
 
 var (
-	// priceMap is the currently stored price map.
+	// priceMap is the local price map, given to any exchange registered with afterwards.
 	priceMap = esi.PriceMap{}
-	// resourceCharacteristics is the currently stored DER characteristics.
-	resourceCharacteristics = esi.DerCharacteristics{}
+	// resourceCharacteristics is the local DER characteristics, given to any exchange registered with afterwards.
+	resourceCharacteristics = &esi.DerCharacteristics{}
 
 	// receivedRegistrationForms is a map of the currently stored registration forms.
 	receivedRegistrationForms = make(map[string]*esi.DerFacilityRegistrationForm)
-	// registeredExchange is the public key of the engaged customer facility.
-	//
-	// As opposed to facilities, there should only ever be one customer at any given time.
-	registeredExchange = ""
+	// registeredExchanges is a map of all exchanges registered with in a facility role.
+	registeredExchanges = make(map[string]*exchangeRegistration)
 	// registeredFacilities is a map of all other facilities registered in a facility role.
 	registeredFacilities = make(map[string]bool)
 	// priceMapOffers is a map of the current price map offers by uuid.
@@ -47,6 +45,14 @@ var (
 	facilityPriceMaps = make(map[string]*esi.PriceMap)
 	// facilityCharacteristics are the characteristics of the currently stored facilities engaged in a facility role.
 	facilityCharacteristics = make(map[string]*esi.DerCharacteristics)
+	// knownRegistries is a map of the registries this coordination node has signed up to or queried.
+	knownRegistries = make(map[string]bool)
+	// pendingExchanges is a map of the exchanges a registration form has been requested from.
+	pendingExchanges = make(map[string]bool)
+	// registrationApplicants is the number of unsubmitted registration forms sent to each facility.
+	registrationApplicants = make(map[string]int)
+	// coordinationNodeRateLimiter limits the messages received from each peer.
+	coordinationNodeRateLimiter = newRateLimiter()
 
 	// autoMoney is the money interface used for auto purchasing.
 	autoMoney = esi.Money{
@@ -54,16 +60,16 @@ var (
 		Units:        100,
 		Nanos:        0,
 	}
-	// avoidMoney is the money interface used for avoid purchasing. Currently, this is not used.
+	// avoidMoney is the money interface used for avoid purchasing.
 	avoidMoney = esi.Money{
 		CurrencyCode: "USD",
 		Units:        1000,
 		Nanos:        0,
 	}
-	// autoPrice is the price parameters used for auto purchasing.
+	// autoPrice is the price parameters used for auto purchasing, unless set in the negotiation config.
 	autoPrice = esi.PriceParameters{
 		AlwaysBuyBelowPrice: &autoMoney,
-		AvoidBuyOverPrice:   &avoidMoney, // unused!
+		AvoidBuyOverPrice:   &avoidMoney,
 	}
 
 	// voltageRange is the voltage range in volts.
@@ -81,7 +87,7 @@ var (
 		Min: 59,
 		Max: 61,
 	}
-	//powerParameters is the expected power parameters.
+	// powerParameters is the expected power parameters, given to facilities registered in an exchange role.
 	powerParameters = esi.PowerParameters{
 		VoltageRange:     &voltageRange,
 		PowerFactorRange: &powerFactorRange,
@@ -97,6 +103,14 @@ func coordinationNodeShell() {
 	log.SetOutput(logFile)
 	log.SetLevel(log.InfoLevel)
 
+	// Restore any offers from before a restart, before anything can change them.
+	err := loadOffers(offersPath())
+	if err != nil {
+		log.Error(err.Error())
+	}
+	resumeDispatch()
+	resumeVerification()
+
 	wg := &sync.WaitGroup{}
 	wg.Add(1)
 	go coordinationNodeMessageReceiver() // receive incoming messages
@@ -104,6 +118,10 @@ func coordinationNodeShell() {
 	go coordinationNodeInputReceiver() // receive user input
 	wg.Add(3)
 	go coordinationNodePeriodicMessenger() // send regular information to any facilities
+	wg.Add(4)
+	go coordinationNodeOfferScheduler() // move offers through their lifecycle when due
+	wg.Add(5)
+	go coordinationNodeTelemetryRecorder() // record the power measured by the dispatch adapter
 
 	wg.Wait()
 }
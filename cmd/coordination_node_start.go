@@ -19,13 +19,21 @@ package cmd
 import (
 	"github.com/nknorg/nkn-sdk-go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
-	// coordinationNodeClient is the Multiclient opened representing the Facility.
+	// coordinationNodeClient is the Multiclient opened representing the Facility, replaced on a key rotation and so
+	// only used under stateMutex.
 	coordinationNodeClient *nkn.MultiClient
 	// coordinationNodePath is the name of what to initialize the new coordination node as.
 	coordinationNodePath string
+	// coordinationNodeSecretPath is the path of the secret key of the coordination node.
+	coordinationNodeSecretPath string
+	// coordinationNodePrivateKey is the secret key of the coordination node.
+	coordinationNodePrivateKey []byte
+	// registrationFormsPath is the path of the registration forms file sent in an exchange role.
+	registrationFormsPath string
 )
 
 // coordinationNodeStartCmd represents the start command.
@@ -42,6 +50,7 @@ func init() {
 	coordinationNodeCmd.AddCommand(coordinationNodeStartCmd)
 
 	coordinationNodeStartCmd.Flags().IntVarP(&numSubClients, "subclients", "s", defaultNumSubClients, "number of subclients to use in multiclient")
+	coordinationNodeStartCmd.Flags().StringVarP(&registrationFormsPath, "forms", "f", "", "registration forms file (JSON or YAML)")
 }
 
 // coordinationNodeStart is the function run by coordinationNodeStartCmd.
@@ -51,14 +60,42 @@ func coordinationNodeStart(cmd *cobra.Command, args []string) error {
 	// The path to the coordination-node-config config should be the first argument.
 	coordinationNodePath = args[0]
 	// The private key associated with the Facility.
-	privateKey, err := readPrivateKey(args[1])
+	coordinationNodeSecretPath = args[1]
+	privateKey, err := readPrivateKey(coordinationNodeSecretPath)
 	if err != nil {
 		return err
 	}
+	coordinationNodePrivateKey = privateKey
 
 	// Get the coordination-node-config config located at coordinationNodePath.
 	err = readCoordinationNodeConfig(coordinationNodePath)
 
+	// Get the registration forms, if any are given by flag or config.
+	if registrationFormsPath == "" {
+		registrationFormsPath = viper.GetString(registrationFormsCfgKey)
+	}
+	if registrationFormsPath != "" {
+		forms, err := readRegistrationForms(registrationFormsPath)
+		if err != nil {
+			return err
+		}
+		registrationForms = *forms
+	}
+
+	// Get the dispatch adapter used to carry out offers.
+	settings, err := readDispatchSettings()
+	if err != nil {
+		return err
+	}
+	dispatcher, err = newDispatchAdapter(settings)
+	if err != nil {
+		return err
+	}
+	verification, err = readVerificationSettings()
+	if err != nil {
+		return err
+	}
+
 	// Open a Multiclient with the private key and the desired number of subclients.
 	coordinationNodeClient, err = newMultiClient(privateKey, numSubClients)
 	if err != nil {
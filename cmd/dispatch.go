@@ -0,0 +1,329 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"sync"
+	"time"
+)
+
+const (
+	// dispatchCfgKey is the config key containing the dispatch settings.
+	dispatchCfgKey = "dispatch"
+
+	// simulatedAdapterName simulates a battery, without any equipment.
+	simulatedAdapterName = "simulated"
+
+	// defaultSimulatedMaxPower is the default max charge and discharge power of the simulated battery, in W.
+	defaultSimulatedMaxPower = 100
+	// defaultSimulatedCapacity is the default storage capacity of the simulated battery, in Wh.
+	defaultSimulatedCapacity = 100
+	// defaultSimulatedCharge is the default energy stored in the simulated battery when started, in Wh.
+	defaultSimulatedCharge = 50
+)
+
+// dispatchAdapter carries out offers on the equipment of a coordination node behaving as a facility.
+//
+// Positive real power is supplied to the grid, for example by discharging a battery, and negative real power is drawn
+// from it as load.
+type dispatchAdapter interface {
+	// start begins delivering the power of an offer, or returns an error if the equipment cannot.
+	start(uuid string, power *esi.PowerComponents) error
+	// stop ends delivering the power of an offer, or returns an error if the power was not delivered in full.
+	stop(uuid string, power *esi.PowerComponents) error
+	// measure returns the power being delivered.
+	measure() (*esi.PowerComponents, error)
+}
+
+// dispatchMutex guards the dispatch adapter, which is used both to carry out offers and to record power samples.
+var dispatchMutex sync.Mutex
+
+// dispatchStarted is the time each running offer started being carried out, by uuid.
+var dispatchStarted = make(map[string]time.Time)
+
+// dispatcher is the dispatch adapter used to carry out offers.
+var dispatcher dispatchAdapter = newSimulatedBattery(simulatedSettings{
+	MaxChargePower:    defaultSimulatedMaxPower,
+	MaxDischargePower: defaultSimulatedMaxPower,
+	Capacity:          defaultSimulatedCapacity,
+	Charge:            defaultSimulatedCharge,
+})
+
+// dispatchSettings are the dispatch settings, read from the config file.
+type dispatchSettings struct {
+	// Adapter is the name of the dispatch adapter used.
+	Adapter string `mapstructure:"adapter"`
+	// Simulated are the settings of the simulated battery.
+	Simulated simulatedSettings `mapstructure:"simulated"`
+	// Modbus are the settings of the Modbus TCP adapter.
+	Modbus modbusSettings `mapstructure:"modbus"`
+}
+
+// simulatedSettings are the settings of the simulated battery.
+type simulatedSettings struct {
+	// MaxChargePower and MaxDischargePower are the max power the battery can draw and supply, in W.
+	MaxChargePower    int64 `mapstructure:"max-charge-power"`
+	MaxDischargePower int64 `mapstructure:"max-discharge-power"`
+	// Capacity is the storage capacity of the battery, in Wh.
+	Capacity float64 `mapstructure:"capacity"`
+	// Charge is the energy stored in the battery when started, in Wh.
+	Charge float64 `mapstructure:"charge"`
+}
+
+// readDispatchSettings returns the configured dispatch settings.
+func readDispatchSettings() (dispatchSettings, error) {
+	settings := dispatchSettings{
+		Adapter: simulatedAdapterName,
+		Simulated: simulatedSettings{
+			MaxChargePower:    defaultSimulatedMaxPower,
+			MaxDischargePower: defaultSimulatedMaxPower,
+			Capacity:          defaultSimulatedCapacity,
+			Charge:            defaultSimulatedCharge,
+		},
+		Modbus: defaultModbusSettings(),
+	}
+	if viper.IsSet(dispatchCfgKey) {
+		err := viper.UnmarshalKey(dispatchCfgKey, &settings)
+		if err != nil {
+			return settings, err
+		}
+	}
+
+	return settings, nil
+}
+
+// newDispatchAdapter returns the configured dispatch adapter.
+func newDispatchAdapter(settings dispatchSettings) (dispatchAdapter, error) {
+	switch settings.Adapter {
+	case simulatedAdapterName:
+		s := settings.Simulated
+		if s.Capacity < 0 || s.Charge < 0 || s.Charge > s.Capacity {
+			return nil, fmt.Errorf("simulated battery charge must be between 0 and its capacity")
+		}
+		return newSimulatedBattery(s), nil
+	case modbusAdapterName:
+		return newModbusAdapter(settings.Modbus)
+	}
+
+	return nil, fmt.Errorf("unknown dispatch adapter: '%s'", settings.Adapter)
+}
+
+// simulatedBattery is a dispatch adapter which simulates a battery, charging for load and discharging for supply.
+type simulatedBattery struct {
+	settings simulatedSettings
+	// charge is the energy stored, in Wh.
+	charge float64
+	// started is the time each running offer started, by uuid.
+	started map[string]time.Time
+	// running is the real power of each running offer, by uuid.
+	running map[string]int64
+}
+
+// newSimulatedBattery returns a new simulated battery.
+func newSimulatedBattery(settings simulatedSettings) *simulatedBattery {
+	return &simulatedBattery{
+		settings: settings,
+		charge:   settings.Charge,
+		started:  make(map[string]time.Time),
+		running:  make(map[string]int64),
+	}
+}
+
+// start implements dispatchAdapter.
+//
+// The battery refuses to start if the power of every running offer together would go over its max power, or if it is
+// already empty when asked to supply or full when asked to draw.
+func (b *simulatedBattery) start(uuid string, power *esi.PowerComponents) error {
+	realPower := power.GetRealPower()
+	total := realPower
+	for _, p := range b.running {
+		total += p
+	}
+	if total > b.settings.MaxDischargePower {
+		return fmt.Errorf("supply of %d W is over the max discharge power of %d W", total, b.settings.MaxDischargePower)
+	}
+	if -total > b.settings.MaxChargePower {
+		return fmt.Errorf("load of %d W is over the max charge power of %d W", -total, b.settings.MaxChargePower)
+	}
+	if realPower > 0 && b.charge <= 0 {
+		return fmt.Errorf("battery is empty")
+	}
+	if realPower < 0 && b.charge >= b.settings.Capacity {
+		return fmt.Errorf("battery is full")
+	}
+
+	b.started[uuid] = time.Now()
+	b.running[uuid] = realPower
+
+	log.WithFields(log.Fields{
+		"uuid":   uuid,
+		"power":  realPower,
+		"charge": b.charge,
+	}).Info("Simulated battery started")
+
+	return nil
+}
+
+// stop implements dispatchAdapter.
+//
+// The energy delivered since the offer started is taken from or added to the charge. If the battery ran empty or full
+// before the offer ended, the charge stops at that limit and an error is returned.
+func (b *simulatedBattery) stop(uuid string, power *esi.PowerComponents) error {
+	started, ok := b.started[uuid]
+	if !ok {
+		return fmt.Errorf("offer '%s' was not started", uuid)
+	}
+	realPower := b.running[uuid]
+	delete(b.started, uuid)
+	delete(b.running, uuid)
+
+	b.charge -= float64(realPower) * time.Since(started).Hours()
+
+	var err error
+	if b.charge < 0 {
+		b.charge = 0
+		err = fmt.Errorf("battery ran empty")
+	}
+	if b.charge > b.settings.Capacity {
+		b.charge = b.settings.Capacity
+		err = fmt.Errorf("battery ran full")
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":   uuid,
+		"power":  realPower,
+		"charge": b.charge,
+	}).Info("Simulated battery stopped")
+
+	return err
+}
+
+// measure implements dispatchAdapter.
+//
+// The battery delivers exactly the power of every running offer.
+func (b *simulatedBattery) measure() (*esi.PowerComponents, error) {
+	power := &esi.PowerComponents{}
+	for _, p := range b.running {
+		power.RealPower += p
+	}
+
+	return power, nil
+}
+
+// startDispatch starts carrying out an offer which has started executing, and fails the offer if it cannot be.
+//
+// The power is sampled as soon as the offer starts, so that even a short offer is measured.
+func startDispatch(uuid string) {
+	offer := priceMapOffers[uuid]
+	dispatchMutex.Lock()
+	err := dispatcher.start(uuid, offer.GetPriceMap().GetPowerComponents())
+	if err == nil {
+		dispatchStarted[uuid] = time.Now()
+		measurePowerSample()
+	}
+	dispatchMutex.Unlock()
+	if err != nil {
+		failOffer(uuid, err)
+	}
+}
+
+// resumeDispatch starts carrying out again every offer which was executing when the coordination node stopped, as the
+// dispatch adapter does not keep running offers across restarts.
+//
+// Offers split between downstream facilities in aggregator mode are carried out by those facilities instead.
+func resumeDispatch() {
+	for uuid, offer := range priceMapOffers {
+		if offer.Route.GetFacilityKey() != coordinationNodeInfo.GetPublicKey() || aggregatedOffer(uuid) {
+			continue
+		}
+		if offerStatus(uuid) == esi.PriceMapOfferStatus_EXECUTING {
+			log.WithFields(log.Fields{
+				"uuid": uuid,
+			}).Info("Resuming offer")
+			startDispatch(uuid)
+		}
+	}
+}
+
+// stopDispatch stops carrying out an offer which has finished executing, and completes or fails the offer.
+//
+// The power is sampled once more just before the offer stops, and a completed offer is measured against its baseline
+// to tell the exchange how much of it was delivered.
+func stopDispatch(uuid string) {
+	offer := priceMapOffers[uuid]
+	dispatchMutex.Lock()
+	measurePowerSample()
+	err := dispatcher.stop(uuid, offer.GetPriceMap().GetPowerComponents())
+	started := dispatchStarted[uuid]
+	delete(dispatchStarted, uuid)
+	dispatchMutex.Unlock()
+	if err != nil {
+		failOffer(uuid, err)
+		return
+	}
+
+	_ = transitionOffer(uuid, esi.PriceMapOfferStatus_COMPLETED)
+
+	outcome := verifyOffer(offer, started, verification)
+
+	log.WithFields(log.Fields{
+		"uuid":      uuid,
+		"claim":     outcome.status,
+		"delivered": fmt.Sprintf("%.1f%%", outcome.deliveredPercentage),
+	}).Info("Offer has completed")
+
+	sendOfferFeedback(offer, outcome)
+}
+
+// failOffer moves an executing offer to FAILED, and tells the exchange why.
+func failOffer(uuid string, dispatchErr error) {
+	_ = transitionOffer(uuid, esi.PriceMapOfferStatus_FAILED)
+
+	log.WithFields(log.Fields{
+		"uuid":  uuid,
+		"error": dispatchErr.Error(),
+	}).Warn("Offer has failed")
+
+	sendOfferFeedback(priceMapOffers[uuid], offerVerification{
+		status:  esi.PriceMapOfferFeedback_UNSATISFIED,
+		message: dispatchErr.Error(),
+	})
+}
+
+// sendOfferFeedback sends the outcome of an offer to the exchange.
+func sendOfferFeedback(offer *esi.PriceMapOffer, outcome offerVerification) {
+	newFeedback := esi.PriceMapOfferFeedback{
+		Route:               offer.Route,
+		OfferId:             offer.OfferId,
+		ObligationStatus:    outcome.status,
+		Message:             outcome.message,
+		DeliveredPercentage: outcome.deliveredPercentage,
+		Baseline:            outcome.baseline,
+		Measured:            outcome.measured,
+	}
+	offerFeedback[offer.OfferId.GetUuid()] = &newFeedback
+
+	// Get feedback from exchange.
+	err := esi.GetPriceMapOfferFeedback(coordinationNodeClient, &newFeedback)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
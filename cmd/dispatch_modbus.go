@@ -0,0 +1,325 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"time"
+)
+
+const (
+	// modbusAdapterName sends offers as power setpoints to an inverter or battery over Modbus TCP.
+	modbusAdapterName = "modbus"
+
+	// defaultModbusAddress is the default address of the Modbus TCP server.
+	defaultModbusAddress = "127.0.0.1:5020"
+	// defaultModbusTimeoutSeconds is the default number of seconds to wait for the Modbus TCP server.
+	defaultModbusTimeoutSeconds = 5
+	// defaultModbusTolerance is the default fraction the measured power may differ from the setpoint by.
+	defaultModbusTolerance = 0.1
+)
+
+// modbusSettings are the settings of the Modbus TCP dispatch adapter.
+type modbusSettings struct {
+	// Address is the host and port of the Modbus TCP server.
+	Address string `mapstructure:"address"`
+	// UnitId is the unit ID of the device behind the server.
+	UnitId uint8 `mapstructure:"unit-id"`
+	// TimeoutSeconds is the number of seconds to wait for the server.
+	TimeoutSeconds int `mapstructure:"timeout-seconds"`
+	// Tolerance is the fraction the measured power may differ from the setpoint by when an offer ends.
+	Tolerance float64 `mapstructure:"tolerance"`
+	// Simulate starts an in-process Modbus TCP server on the address, whose measured power follows its setpoints.
+	Simulate bool `mapstructure:"simulate"`
+
+	// RealPowerSetpoint and ReactivePowerSetpoint are the registers the power of an offer is written to.
+	RealPowerSetpoint     modbusPoint `mapstructure:"real-power-setpoint"`
+	ReactivePowerSetpoint modbusPoint `mapstructure:"reactive-power-setpoint"`
+	// RealPower and ReactivePower are the registers the measured power is read from.
+	RealPower     modbusPoint `mapstructure:"real-power"`
+	ReactivePower modbusPoint `mapstructure:"reactive-power"`
+}
+
+// modbusPoint is a signed 16 bit holding register, scaled by a power of ten as in SunSpec models.
+type modbusPoint struct {
+	// Address is the protocol address of the register, counting from 0.
+	Address uint16 `mapstructure:"address"`
+	// ScaleFactor is the power of ten the register is multiplied by, unless read from ScaleFactorAddress.
+	ScaleFactor int16 `mapstructure:"scale-factor"`
+	// ScaleFactorAddress is the address of a register holding the scale factor, if any.
+	ScaleFactorAddress *uint16 `mapstructure:"scale-factor-address"`
+}
+
+// defaultModbusSettings returns the default Modbus settings, with registers laid out after the SunSpec base address.
+func defaultModbusSettings() modbusSettings {
+	return modbusSettings{
+		Address:               defaultModbusAddress,
+		UnitId:                1,
+		TimeoutSeconds:        defaultModbusTimeoutSeconds,
+		Tolerance:             defaultModbusTolerance,
+		RealPowerSetpoint:     modbusPoint{Address: 40100},
+		ReactivePowerSetpoint: modbusPoint{Address: 40101},
+		RealPower:             modbusPoint{Address: 40110},
+		ReactivePower:         modbusPoint{Address: 40111},
+	}
+}
+
+// decodeModbusPoint returns the value of a register with a scale factor.
+func decodeModbusPoint(raw uint16, scaleFactor int16) int64 {
+	return int64(math.Round(float64(int16(raw)) * math.Pow10(int(scaleFactor))))
+}
+
+// encodeModbusPoint returns the register holding a value with a scale factor, or an error if it does not fit.
+func encodeModbusPoint(value int64, scaleFactor int16) (uint16, error) {
+	scaled := math.Round(float64(value) / math.Pow10(int(scaleFactor)))
+	if scaled < math.MinInt16 || scaled > math.MaxInt16 {
+		return 0, fmt.Errorf("%d does not fit in a register with scale factor %d", value, scaleFactor)
+	}
+
+	return uint16(int16(scaled)), nil
+}
+
+// modbusAdapter is a dispatch adapter which writes the power of offers to the setpoint registers of an inverter or
+// battery over Modbus TCP.
+//
+// The setpoints in place before the first offer starts are kept as a baseline. While offers are running, the setpoints
+// are the baseline plus the power of every running offer, and once the last offer ends they revert to the baseline.
+type modbusAdapter struct {
+	settings modbusSettings
+	client   *modbusClient
+	// baseline is the setpoint before any offer started.
+	baseline *esi.PowerComponents
+	// running is the power of each running offer, by uuid.
+	running map[string]*esi.PowerComponents
+}
+
+// newModbusAdapter returns a new Modbus TCP dispatch adapter, starting a simulated server first if configured.
+func newModbusAdapter(settings modbusSettings) (*modbusAdapter, error) {
+	if settings.Simulate {
+		_, err := newModbusServer(settings.Address, settings.simulate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &modbusAdapter{
+		settings: settings,
+		client: &modbusClient{
+			address: settings.Address,
+			unitId:  settings.UnitId,
+			timeout: time.Duration(settings.TimeoutSeconds) * time.Second,
+		},
+		running: make(map[string]*esi.PowerComponents),
+	}, nil
+}
+
+// simulate makes the measured power of a simulated server follow its setpoints, as a device would.
+func (s modbusSettings) simulate(registers *[65536]uint16) {
+	scaleFactor := func(p modbusPoint) int16 {
+		if p.ScaleFactorAddress != nil {
+			return int16(registers[*p.ScaleFactorAddress])
+		}
+		return p.ScaleFactor
+	}
+	follow := func(setpoint modbusPoint, measured modbusPoint) {
+		value := decodeModbusPoint(registers[setpoint.Address], scaleFactor(setpoint))
+		raw, err := encodeModbusPoint(value, scaleFactor(measured))
+		if err == nil {
+			registers[measured.Address] = raw
+		}
+	}
+	follow(s.RealPowerSetpoint, s.RealPower)
+	follow(s.ReactivePowerSetpoint, s.ReactivePower)
+}
+
+// scaleFactor returns the scale factor of a point, reading it from its register if it has one.
+func (a *modbusAdapter) scaleFactor(p modbusPoint) (int16, error) {
+	if p.ScaleFactorAddress == nil {
+		return p.ScaleFactor, nil
+	}
+	values, err := a.client.readRegisters(*p.ScaleFactorAddress, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return int16(values[0]), nil
+}
+
+// readPoint returns the value of a point.
+func (a *modbusAdapter) readPoint(p modbusPoint) (int64, error) {
+	scaleFactor, err := a.scaleFactor(p)
+	if err != nil {
+		return 0, err
+	}
+	values, err := a.client.readRegisters(p.Address, 1)
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeModbusPoint(values[0], scaleFactor), nil
+}
+
+// writePoint writes the value of a point.
+func (a *modbusAdapter) writePoint(p modbusPoint, value int64) error {
+	scaleFactor, err := a.scaleFactor(p)
+	if err != nil {
+		return err
+	}
+	raw, err := encodeModbusPoint(value, scaleFactor)
+	if err != nil {
+		return err
+	}
+
+	return a.client.writeRegisters(p.Address, []uint16{raw})
+}
+
+// readPower returns the power held by two points.
+func (a *modbusAdapter) readPower(real modbusPoint, reactive modbusPoint) (*esi.PowerComponents, error) {
+	realPower, err := a.readPoint(real)
+	if err != nil {
+		return nil, err
+	}
+	reactivePower, err := a.readPoint(reactive)
+	if err != nil {
+		return nil, err
+	}
+
+	return &esi.PowerComponents{
+		RealPower:     realPower,
+		ReactivePower: reactivePower,
+	}, nil
+}
+
+// setpoint returns the setpoint for the baseline and every running offer.
+func (a *modbusAdapter) setpoint() *esi.PowerComponents {
+	setpoint := &esi.PowerComponents{
+		RealPower:     a.baseline.GetRealPower(),
+		ReactivePower: a.baseline.GetReactivePower(),
+	}
+	for _, power := range a.running {
+		setpoint.RealPower += power.GetRealPower()
+		setpoint.ReactivePower += power.GetReactivePower()
+	}
+
+	return setpoint
+}
+
+// writeSetpoint writes the setpoint for the baseline and every running offer, and reads it back to check the device
+// took it.
+func (a *modbusAdapter) writeSetpoint() error {
+	setpoint := a.setpoint()
+	err := a.writePoint(a.settings.RealPowerSetpoint, setpoint.RealPower)
+	if err != nil {
+		return err
+	}
+	err = a.writePoint(a.settings.ReactivePowerSetpoint, setpoint.ReactivePower)
+	if err != nil {
+		return err
+	}
+
+	written, err := a.readPower(a.settings.RealPowerSetpoint, a.settings.ReactivePowerSetpoint)
+	if err != nil {
+		return err
+	}
+	if !a.within(written, setpoint) {
+		return fmt.Errorf("device holds a setpoint of %d W and %d var, not %d W and %d var",
+			written.RealPower, written.ReactivePower, setpoint.RealPower, setpoint.ReactivePower)
+	}
+
+	return nil
+}
+
+// within returns true if power is within the tolerance of a target, allowing at least 1 for rounding.
+func (a *modbusAdapter) within(power *esi.PowerComponents, target *esi.PowerComponents) bool {
+	near := func(value int64, target int64) bool {
+		allowed := math.Max(a.settings.Tolerance*math.Abs(float64(target)), 1)
+		return math.Abs(float64(value-target)) <= allowed
+	}
+
+	return near(power.GetRealPower(), target.GetRealPower()) && near(power.GetReactivePower(), target.GetReactivePower())
+}
+
+// start implements dispatchAdapter.
+func (a *modbusAdapter) start(uuid string, power *esi.PowerComponents) error {
+	if len(a.running) == 0 {
+		baseline, err := a.readPower(a.settings.RealPowerSetpoint, a.settings.ReactivePowerSetpoint)
+		if err != nil {
+			return err
+		}
+		a.baseline = baseline
+	}
+
+	a.running[uuid] = power
+	err := a.writeSetpoint()
+	if err != nil {
+		// Put back the setpoint of the other running offers.
+		delete(a.running, uuid)
+		_ = a.writeSetpoint()
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":     uuid,
+		"real":     a.setpoint().RealPower,
+		"reactive": a.setpoint().ReactivePower,
+	}).Info("Wrote modbus setpoint")
+
+	return nil
+}
+
+// stop implements dispatchAdapter.
+//
+// The measured power is read back before the setpoint of the offer is removed, and the offer fails if it is not within
+// the tolerance of the setpoint.
+func (a *modbusAdapter) stop(uuid string, power *esi.PowerComponents) error {
+	if _, ok := a.running[uuid]; !ok {
+		return fmt.Errorf("offer '%s' was not started", uuid)
+	}
+
+	target := a.setpoint()
+	measured, measureErr := a.readPower(a.settings.RealPower, a.settings.ReactivePower)
+
+	delete(a.running, uuid)
+	err := a.writeSetpoint()
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":     uuid,
+		"real":     a.setpoint().RealPower,
+		"reactive": a.setpoint().ReactivePower,
+	}).Info("Reverted modbus setpoint")
+
+	if measureErr != nil {
+		return measureErr
+	}
+	if !a.within(measured, target) {
+		return fmt.Errorf("device measured %d W and %d var, not %d W and %d var",
+			measured.RealPower, measured.ReactivePower, target.RealPower, target.ReactivePower)
+	}
+
+	return nil
+}
+
+// measure implements dispatchAdapter.
+func (a *modbusAdapter) measure() (*esi.PowerComponents, error) {
+	return a.readPower(a.settings.RealPower, a.settings.ReactivePower)
+}
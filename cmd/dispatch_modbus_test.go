@@ -0,0 +1,230 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"testing"
+)
+
+// testModbusAdapter starts a Modbus TCP server on a free port and returns an adapter connected to it.
+//
+// If follow is true, the measured power of the server follows its setpoints, as a device would.
+func testModbusAdapter(t *testing.T, settings modbusSettings, follow bool) (*modbusAdapter, *modbusServer) {
+	t.Helper()
+	var written func(registers *[65536]uint16)
+	if follow {
+		written = settings.simulate
+	}
+	server, err := newModbusServer("127.0.0.1:0", written)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.listener.Close()
+	})
+
+	settings.Address = server.listener.Addr().String()
+	adapter, err := newModbusAdapter(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return adapter, server
+}
+
+// register returns the raw value of a register of a server.
+func (s *modbusServer) register(address uint16) uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.registers[address]
+}
+
+// setRegister sets the raw value of a register of a server.
+func (s *modbusServer) setRegister(address uint16, value uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.registers[address] = value
+}
+
+func TestModbusSetpointFixedScaleFactor(t *testing.T) {
+	settings := defaultModbusSettings()
+	settings.RealPowerSetpoint.ScaleFactor = 1
+	settings.RealPower.ScaleFactor = 1
+	adapter, server := testModbusAdapter(t, settings, true)
+
+	err := adapter.start("offer", &esi.PowerComponents{RealPower: 1230, ReactivePower: -40})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.register(settings.RealPowerSetpoint.Address); got != 123 {
+		t.Errorf("real power setpoint register = %d, want 123", got)
+	}
+	if got := int16(server.register(settings.ReactivePowerSetpoint.Address)); got != -40 {
+		t.Errorf("reactive power setpoint register = %d, want -40", got)
+	}
+}
+
+func TestModbusSetpointRegisterScaleFactor(t *testing.T) {
+	scaleFactorAddress := uint16(40102)
+	settings := defaultModbusSettings()
+	settings.RealPowerSetpoint.ScaleFactorAddress = &scaleFactorAddress
+	settings.RealPower.ScaleFactorAddress = &scaleFactorAddress
+	adapter, server := testModbusAdapter(t, settings, true)
+	minusOne := int16(-1)
+	server.setRegister(scaleFactorAddress, uint16(minusOne))
+
+	err := adapter.start("offer", &esi.PowerComponents{RealPower: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.register(settings.RealPowerSetpoint.Address); got != 500 {
+		t.Errorf("real power setpoint register = %d, want 500", got)
+	}
+	measured, err := adapter.measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measured.RealPower != 50 {
+		t.Errorf("measured real power = %d, want 50", measured.RealPower)
+	}
+}
+
+func TestModbusReadBackAfterStart(t *testing.T) {
+	adapter, _ := testModbusAdapter(t, defaultModbusSettings(), true)
+
+	err := adapter.start("first", &esi.PowerComponents{RealPower: 30, ReactivePower: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = adapter.start("second", &esi.PowerComponents{RealPower: -10, ReactivePower: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setpoint, err := adapter.readPower(adapter.settings.RealPowerSetpoint, adapter.settings.ReactivePowerSetpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setpoint.RealPower != 20 || setpoint.ReactivePower != 6 {
+		t.Errorf("setpoint = %d W and %d var, want 20 W and 6 var", setpoint.RealPower, setpoint.ReactivePower)
+	}
+	measured, err := adapter.measure()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if measured.RealPower != 20 || measured.ReactivePower != 6 {
+		t.Errorf("measured = %d W and %d var, want 20 W and 6 var", measured.RealPower, measured.ReactivePower)
+	}
+}
+
+func TestModbusStopRevertsToBaseline(t *testing.T) {
+	adapter, server := testModbusAdapter(t, defaultModbusSettings(), true)
+	server.setRegister(adapter.settings.RealPowerSetpoint.Address, 100)
+	server.setRegister(adapter.settings.ReactivePowerSetpoint.Address, 7)
+
+	power := &esi.PowerComponents{RealPower: 200, ReactivePower: 3}
+	err := adapter.start("offer", power)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.register(adapter.settings.RealPowerSetpoint.Address); got != 300 {
+		t.Errorf("real power setpoint register while running = %d, want 300", got)
+	}
+
+	err = adapter.stop("offer", power)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := server.register(adapter.settings.RealPowerSetpoint.Address); got != 100 {
+		t.Errorf("real power setpoint register after stop = %d, want the baseline 100", got)
+	}
+	if got := server.register(adapter.settings.ReactivePowerSetpoint.Address); got != 7 {
+		t.Errorf("reactive power setpoint register after stop = %d, want the baseline 7", got)
+	}
+
+	if err = adapter.stop("offer", power); err == nil {
+		t.Error("stopping an offer twice succeeded")
+	}
+}
+
+func TestModbusStopOutsideTolerance(t *testing.T) {
+	// The measured power of the server never follows its setpoints.
+	adapter, server := testModbusAdapter(t, defaultModbusSettings(), false)
+
+	power := &esi.PowerComponents{RealPower: 100}
+	err := adapter.start("offer", power)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.setRegister(adapter.settings.RealPower.Address, 95)
+	if err = adapter.stop("offer", power); err != nil {
+		t.Errorf("stop within tolerance = %v", err)
+	}
+
+	err = adapter.start("offer", power)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.setRegister(adapter.settings.RealPower.Address, 80)
+	if err = adapter.stop("offer", power); err == nil {
+		t.Error("stop outside tolerance succeeded")
+	}
+	// The setpoint reverts even if the offer was not delivered.
+	if got := server.register(adapter.settings.RealPowerSetpoint.Address); got != 0 {
+		t.Errorf("real power setpoint register after a failed stop = %d, want 0", got)
+	}
+}
+
+func TestEncodeModbusPoint(t *testing.T) {
+	tests := []struct {
+		value       int64
+		scaleFactor int16
+		want        uint16
+		overflow    bool
+	}{
+		{value: 0, scaleFactor: 0, want: 0},
+		{value: 32767, scaleFactor: 0, want: 32767},
+		{value: -32768, scaleFactor: 0, want: 0x8000},
+		{value: -1, scaleFactor: 0, want: 0xffff},
+		{value: 32768, scaleFactor: 0, overflow: true},
+		{value: -32769, scaleFactor: 0, overflow: true},
+		{value: 327670, scaleFactor: 1, want: 32767},
+		{value: 327680, scaleFactor: 1, overflow: true},
+		{value: 3276, scaleFactor: -1, want: 32760},
+		{value: 3277, scaleFactor: -1, overflow: true},
+		{value: -4, scaleFactor: -4, overflow: true},
+	}
+
+	for _, test := range tests {
+		got, err := encodeModbusPoint(test.value, test.scaleFactor)
+		if test.overflow {
+			if err == nil {
+				t.Errorf("encodeModbusPoint(%d, %d) = %d, want an overflow", test.value, test.scaleFactor, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("encodeModbusPoint(%d, %d) = %d, %v, want %d", test.value, test.scaleFactor, got, err, test.want)
+		}
+		if decoded := decodeModbusPoint(got, test.scaleFactor); decoded != test.value {
+			t.Errorf("decodeModbusPoint(%d, %d) = %d, want %d", got, test.scaleFactor, decoded, test.value)
+		}
+	}
+}
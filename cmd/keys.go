@@ -0,0 +1,423 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/nknorg/nkn-sdk-go"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	// oldSecretKeySuffix is the suffix appended to a secret key replaced by a rotation.
+	oldSecretKeySuffix = ".old"
+	// keyRotationTimeout is the time to wait for a new client to connect when rotating a key.
+	keyRotationTimeout = 30 * time.Second
+)
+
+var (
+	// invalidKeyRotationErr is raised when a key rotation signature does not match the old key.
+	invalidKeyRotationErr = errors.New("key rotation signature is invalid")
+	// missingPasswordErr is raised when a wallet is exported or imported without a password.
+	missingPasswordErr = errors.New("a password is required")
+
+	// walletPassword is the password used to encrypt or decrypt an exported wallet.
+	walletPassword string
+	// notifyCoordinationNodes are the coordination nodes to notify of a key rotation.
+	notifyCoordinationNodes []string
+	// notifyRegistries are the registries to notify of a key rotation.
+	notifyRegistries []string
+)
+
+// keysCmd represents the keys command.
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage the key pair of an existing configuration",
+	Long: `Manage the key pair of an existing configuration.
+
+Keys can be shown, generated, rotated, exported to an encrypted NKN wallet and
+imported from one. Both coordination node and registry configurations are
+supported.`,
+}
+
+// keysShowCmd represents the keys show command.
+var keysShowCmd = &cobra.Command{
+	Use:   "show <config.json> [key.secret]",
+	Short: "Print the public key of a configuration",
+	Long: `Print the public key of a configuration.
+
+If a secret key is given, it is validated against the configuration.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: keysShow,
+}
+
+// keysGenerateCmd represents the keys generate command.
+var keysGenerateCmd = &cobra.Command{
+	Use:   "generate <name>",
+	Short: "Generate a new secret key without a configuration",
+	Long:  `Generate a new secret key without a configuration.`,
+	Args:  cobra.ExactArgs(1),
+	RunE:  keysGenerate,
+}
+
+// keysRotateCmd represents the keys rotate command.
+var keysRotateCmd = &cobra.Command{
+	Use:   "rotate <config.json> <key.secret>",
+	Short: "Replace the key pair of a configuration",
+	Long: `Replace the key pair of a configuration.
+
+The old secret key is kept alongside the new one with an .old suffix. Any
+coordination nodes or registries given are sent the new public key, signed by
+the old key, so that they can keep any existing relationships.
+
+A running coordination node should instead use 'keys rotate' in its shell, which
+notifies all of its known peers.`,
+	Args: cobra.ExactArgs(2),
+	RunE: keysRotate,
+}
+
+// keysExportCmd represents the keys export command.
+var keysExportCmd = &cobra.Command{
+	Use:   "export <config.json> <key.secret> <wallet.json>",
+	Short: "Export a secret key to an encrypted NKN wallet",
+	Long:  `Export a secret key to an encrypted NKN wallet.`,
+	Args:  cobra.ExactArgs(3),
+	RunE:  keysExport,
+}
+
+// keysImportCmd represents the keys import command.
+var keysImportCmd = &cobra.Command{
+	Use:   "import <config.json> <wallet.json> <key.secret>",
+	Short: "Import a secret key from an encrypted NKN wallet",
+	Long: `Import a secret key from an encrypted NKN wallet.
+
+The public key of the configuration is replaced with the imported key.`,
+	Args: cobra.ExactArgs(3),
+	RunE: keysImport,
+}
+
+// init initializes keys.go.
+func init() {
+	rootCmd.AddCommand(keysCmd)
+	keysCmd.AddCommand(keysShowCmd)
+	keysCmd.AddCommand(keysGenerateCmd)
+	keysCmd.AddCommand(keysRotateCmd)
+	keysCmd.AddCommand(keysExportCmd)
+	keysCmd.AddCommand(keysImportCmd)
+
+	keysRotateCmd.Flags().StringSliceVar(&notifyCoordinationNodes, "notify", nil, "public key of a coordination node to notify")
+	keysRotateCmd.Flags().StringSliceVar(&notifyRegistries, "registry", nil, "public key of a registry to notify")
+	keysRotateCmd.Flags().IntVarP(&numSubClients, "subclients", "s", defaultNumSubClients, "number of subclients to use in multiclient")
+	keysExportCmd.Flags().StringVarP(&walletPassword, "password", "p", "", "password used to encrypt the wallet")
+	keysImportCmd.Flags().StringVarP(&walletPassword, "password", "p", "", "password used to decrypt the wallet")
+}
+
+// keysShow is the function run by keysShowCmd.
+func keysShow(cmd *cobra.Command, args []string) error {
+	info, err := readKeyConfig(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(info.GetPublicKey())
+
+	if len(args) == 2 {
+		seed, err := readPrivateKey(args[1])
+		if err != nil {
+			return err
+		}
+		publicKey, err := publicKeyFromSeed(seed)
+		if err != nil {
+			return err
+		}
+		if publicKey != info.GetPublicKey() {
+			return invalidKeyPairErr
+		}
+		fmt.Println("key pair is valid")
+	}
+
+	return nil
+}
+
+// keysGenerate is the function run by keysGenerateCmd.
+func keysGenerate(cmd *cobra.Command, args []string) error {
+	seed, err := newNKNPrivateKey()
+	if err != nil {
+		return err
+	}
+	err = writeSeed(args[0]+secretKeySuffix, seed)
+	if err != nil {
+		return err
+	}
+	publicKey, err := publicKeyFromSeed(seed)
+	if err != nil {
+		return err
+	}
+	fmt.Println(publicKey)
+
+	return nil
+}
+
+// keysRotate is the function run by keysRotateCmd.
+func keysRotate(cmd *cobra.Command, args []string) error {
+	configPath := args[0]
+	secretPath := args[1]
+
+	info, err := readKeyConfig(configPath)
+	if err != nil {
+		return err
+	}
+	oldSeed, err := readPrivateKey(secretPath)
+	if err != nil {
+		return err
+	}
+	oldPublicKey, err := publicKeyFromSeed(oldSeed)
+	if err != nil {
+		return err
+	}
+	if oldPublicKey != info.GetPublicKey() {
+		return invalidKeyPairErr
+	}
+
+	newSeed, err := newNKNPrivateKey()
+	if err != nil {
+		return err
+	}
+	newPublicKey, err := publicKeyFromSeed(newSeed)
+	if err != nil {
+		return err
+	}
+
+	// Announce the rotation with the old key before it is replaced.
+	if len(notifyCoordinationNodes) > 0 || len(notifyRegistries) > 0 {
+		rotation, err := newKeyRotation(oldSeed, oldPublicKey, newPublicKey)
+		if err != nil {
+			return err
+		}
+		client, err := newMultiClient(oldSeed, numSubClients)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+
+		select {
+		case <-client.OnConnect.C:
+		case <-time.After(keyRotationTimeout):
+			return errors.New("timed out connecting with the old key")
+		}
+		for _, publicKey := range notifyCoordinationNodes {
+			err = esi.AnnounceKeyRotation(client, publicKey, rotation)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("notified coordination node %s\n", publicKey)
+		}
+		for _, publicKey := range notifyRegistries {
+			err = esi.RotateCoordinationNodeKey(client, publicKey, rotation)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("notified registry %s\n", publicKey)
+		}
+	}
+
+	err = writeRotatedKey(configPath, secretPath, newSeed)
+	if err != nil {
+		return err
+	}
+	fmt.Println(newPublicKey)
+
+	return nil
+}
+
+// keysExport is the function run by keysExportCmd.
+func keysExport(cmd *cobra.Command, args []string) error {
+	if walletPassword == "" {
+		return missingPasswordErr
+	}
+	info, err := readKeyConfig(args[0])
+	if err != nil {
+		return err
+	}
+	seed, err := readPrivateKey(args[1])
+	if err != nil {
+		return err
+	}
+	account, err := nkn.NewAccount(seed)
+	if err != nil {
+		return err
+	}
+	if formatBinary(account.PubKey()) != info.GetPublicKey() {
+		return invalidKeyPairErr
+	}
+
+	wallet, err := nkn.NewWallet(account, &nkn.WalletConfig{Password: walletPassword})
+	if err != nil {
+		return err
+	}
+	walletJson, err := wallet.ToJSON()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(args[2], []byte(walletJson), 0600)
+}
+
+// keysImport is the function run by keysImportCmd.
+func keysImport(cmd *cobra.Command, args []string) error {
+	if walletPassword == "" {
+		return missingPasswordErr
+	}
+	info, err := readKeyConfig(args[0])
+	if err != nil {
+		return err
+	}
+	walletJson, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	wallet, err := nkn.WalletFromJSON(string(walletJson), &nkn.WalletConfig{Password: walletPassword})
+	if err != nil {
+		return err
+	}
+
+	err = writeSeed(args[2], wallet.Seed())
+	if err != nil {
+		return err
+	}
+	info.PublicKey = formatBinary(wallet.PubKey())
+	err = writeKeyConfig(args[0], info)
+	if err != nil {
+		return err
+	}
+	fmt.Println(info.GetPublicKey())
+
+	return nil
+}
+
+// readKeyConfig reads a coordination node or registry config.
+//
+// A registry config is a subset of a coordination node config, so both can be read and written without loss.
+func readKeyConfig(path string) (*esi.DerFacilityExchangeInfo, error) {
+	byteValue, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	info := esi.DerFacilityExchangeInfo{}
+	err = json.Unmarshal(byteValue, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// writeKeyConfig writes a coordination node or registry config.
+func writeKeyConfig(path string, info *esi.DerFacilityExchangeInfo) error {
+	jsonBytes, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, jsonBytes, os.ModePerm)
+}
+
+// writeRotatedKey replaces the secret key and config public key with a new seed, keeping the old secret key.
+func writeRotatedKey(configPath string, secretPath string, seed []byte) error {
+	info, err := readKeyConfig(configPath)
+	if err != nil {
+		return err
+	}
+	publicKey, err := publicKeyFromSeed(seed)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(secretPath, secretPath+oldSecretKeySuffix)
+	if err != nil {
+		return err
+	}
+	err = writeSeed(secretPath, seed)
+	if err != nil {
+		return err
+	}
+	info.PublicKey = publicKey
+
+	return writeKeyConfig(configPath, info)
+}
+
+// publicKeyFromSeed returns the formatted public key of a secret seed.
+func publicKeyFromSeed(seed []byte) (string, error) {
+	account, err := nkn.NewAccount(seed)
+	if err != nil {
+		return "", err
+	}
+
+	return formatBinary(account.PubKey()), nil
+}
+
+// newKeyRotation returns a new key rotation signed by the old seed.
+func newKeyRotation(oldSeed []byte, oldPublicKey string, newPublicKey string) (*esi.KeyRotation, error) {
+	if len(oldSeed) != ed25519.SeedSize {
+		return nil, invalidKeyPairErr
+	}
+	rotation := esi.KeyRotation{
+		OldPublicKey: oldPublicKey,
+		NewPublicKey: newPublicKey,
+		Ts:           timestamppb.New(time.Now().UTC()),
+	}
+	rotation.Signature = ed25519.Sign(ed25519.NewKeyFromSeed(oldSeed), keyRotationPayload(&rotation))
+
+	return &rotation, nil
+}
+
+// verifyKeyRotation verifies that a key rotation was signed by the old key.
+func verifyKeyRotation(rotation *esi.KeyRotation) error {
+	publicKey, err := hex.DecodeString(rotation.GetOldPublicKey())
+	if err != nil {
+		return err
+	}
+	if len(publicKey) != ed25519.PublicKeySize || rotation.GetNewPublicKey() == "" {
+		return invalidKeyRotationErr
+	}
+	if !ed25519.Verify(publicKey, keyRotationPayload(rotation), rotation.GetSignature()) {
+		return invalidKeyRotationErr
+	}
+
+	return nil
+}
+
+// keyRotationPayload returns the bytes signed by a key rotation, as documented in key_rotation.proto.
+func keyRotationPayload(rotation *esi.KeyRotation) []byte {
+	var payload bytes.Buffer
+	payload.WriteString(rotation.GetOldPublicKey())
+	payload.WriteString(rotation.GetNewPublicKey())
+	_ = binary.Write(&payload, binary.BigEndian, rotation.GetTs().GetSeconds())
+	_ = binary.Write(&payload, binary.BigEndian, rotation.GetTs().GetNanos())
+
+	return payload.Bytes()
+}
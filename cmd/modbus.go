@@ -0,0 +1,275 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// modbusReadHoldingRegisters is the Modbus function code to read holding registers.
+	modbusReadHoldingRegisters = 0x03
+	// modbusWriteMultipleRegisters is the Modbus function code to write multiple holding registers.
+	modbusWriteMultipleRegisters = 0x10
+	// modbusException is set in the function code of a response which is an exception.
+	modbusException = 0x80
+
+	// modbusIllegalFunction is the exception code for an unsupported function.
+	modbusIllegalFunction = 0x01
+	// modbusIllegalDataAddress is the exception code for registers out of range.
+	modbusIllegalDataAddress = 0x02
+	// modbusIllegalDataValue is the exception code for a malformed request.
+	modbusIllegalDataValue = 0x03
+
+	// modbusMaxRegisters is the most registers read or written by one request.
+	modbusMaxRegisters = 123
+	// modbusHeaderLength is the length of the Modbus TCP (MBAP) header, including the unit ID.
+	modbusHeaderLength = 7
+)
+
+// modbusClient is a Modbus TCP client, which connects to a server for each request.
+type modbusClient struct {
+	address string
+	unitId  byte
+	timeout time.Duration
+	// transactionId is the ID of the last request.
+	transactionId uint16
+}
+
+// readRegisters reads holding registers from a start address.
+func (c *modbusClient) readRegisters(address uint16, quantity uint16) ([]uint16, error) {
+	if quantity == 0 || quantity > modbusMaxRegisters {
+		return nil, fmt.Errorf("cannot read %d registers", quantity)
+	}
+	request := make([]byte, 5)
+	request[0] = modbusReadHoldingRegisters
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], quantity)
+
+	response, err := c.send(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) != 2+2*int(quantity) || int(response[1]) != 2*int(quantity) {
+		return nil, fmt.Errorf("modbus response has the wrong length")
+	}
+
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(response[2+2*i:])
+	}
+
+	return values, nil
+}
+
+// writeRegisters writes holding registers from a start address.
+func (c *modbusClient) writeRegisters(address uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > modbusMaxRegisters {
+		return fmt.Errorf("cannot write %d registers", len(values))
+	}
+	request := make([]byte, 6+2*len(values))
+	request[0] = modbusWriteMultipleRegisters
+	binary.BigEndian.PutUint16(request[1:], address)
+	binary.BigEndian.PutUint16(request[3:], uint16(len(values)))
+	request[5] = byte(2 * len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(request[6+2*i:], value)
+	}
+
+	response, err := c.send(request)
+	if err != nil {
+		return err
+	}
+	if len(response) != 5 || binary.BigEndian.Uint16(response[1:]) != address ||
+		binary.BigEndian.Uint16(response[3:]) != uint16(len(values)) {
+		return fmt.Errorf("modbus response does not match the write")
+	}
+
+	return nil
+}
+
+// send sends a request PDU and returns the response PDU, or an error if the server returns an exception.
+func (c *modbusClient) send(pdu []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	c.transactionId += 1
+	err = writeModbusFrame(conn, c.transactionId, c.unitId, pdu)
+	if err != nil {
+		return nil, err
+	}
+	transactionId, _, response, err := readModbusFrame(conn)
+	if err != nil {
+		return nil, err
+	}
+	if transactionId != c.transactionId {
+		return nil, fmt.Errorf("modbus response is for another request")
+	}
+	if len(response) == 2 && response[0] == pdu[0]|modbusException {
+		return nil, fmt.Errorf("modbus exception %d", response[1])
+	}
+	if len(response) == 0 || response[0] != pdu[0] {
+		return nil, fmt.Errorf("modbus response has the wrong function")
+	}
+
+	return response, nil
+}
+
+// writeModbusFrame writes a PDU with a Modbus TCP header.
+func writeModbusFrame(w io.Writer, transactionId uint16, unitId byte, pdu []byte) error {
+	frame := make([]byte, modbusHeaderLength+len(pdu))
+	binary.BigEndian.PutUint16(frame[0:], transactionId)
+	// The protocol ID is always 0 for Modbus.
+	binary.BigEndian.PutUint16(frame[2:], 0)
+	binary.BigEndian.PutUint16(frame[4:], uint16(1+len(pdu)))
+	frame[6] = unitId
+	copy(frame[modbusHeaderLength:], pdu)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+// readModbusFrame reads a PDU with a Modbus TCP header.
+func readModbusFrame(r io.Reader) (uint16, byte, []byte, error) {
+	header := make([]byte, modbusHeaderLength)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if binary.BigEndian.Uint16(header[2:]) != 0 || length < 2 || length > 254 {
+		return 0, 0, nil, fmt.Errorf("invalid modbus header")
+	}
+	pdu := make([]byte, length-1)
+	_, err = io.ReadFull(r, pdu)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	return binary.BigEndian.Uint16(header[0:]), header[6], pdu, nil
+}
+
+// modbusServer is a minimal in-process Modbus TCP server holding 65536 holding registers.
+//
+// It stands in for an inverter or battery when none is available, for example to try the Modbus dispatch adapter.
+type modbusServer struct {
+	mutex     sync.Mutex
+	registers [65536]uint16
+	// written is called with the registers, while locked, after every write.
+	written  func(registers *[65536]uint16)
+	listener net.Listener
+}
+
+// newModbusServer starts a Modbus TCP server listening on an address.
+func newModbusServer(address string, written func(registers *[65536]uint16)) (*modbusServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := &modbusServer{
+		written:  written,
+		listener: listener,
+	}
+	go server.serve()
+
+	return server, nil
+}
+
+// serve accepts connections until the listener is closed.
+func (s *modbusServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers every request on a connection until it is closed.
+func (s *modbusServer) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		transactionId, unitId, request, err := readModbusFrame(conn)
+		if err != nil {
+			return
+		}
+		err = writeModbusFrame(conn, transactionId, unitId, s.respond(request))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// respond returns the response PDU to a request PDU.
+func (s *modbusServer) respond(request []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	exception := func(code byte) []byte {
+		return []byte{request[0] | modbusException, code}
+	}
+	if len(request) < 5 {
+		return exception(modbusIllegalDataValue)
+	}
+	address := int(binary.BigEndian.Uint16(request[1:]))
+	quantity := int(binary.BigEndian.Uint16(request[3:]))
+	if quantity == 0 || quantity > modbusMaxRegisters {
+		return exception(modbusIllegalDataValue)
+	}
+	if address+quantity > len(s.registers) {
+		return exception(modbusIllegalDataAddress)
+	}
+
+	switch request[0] {
+	case modbusReadHoldingRegisters:
+		response := make([]byte, 2+2*quantity)
+		response[0] = request[0]
+		response[1] = byte(2 * quantity)
+		for i := 0; i < quantity; i++ {
+			binary.BigEndian.PutUint16(response[2+2*i:], s.registers[address+i])
+		}
+		return response
+
+	case modbusWriteMultipleRegisters:
+		if len(request) != 6+2*quantity || int(request[5]) != 2*quantity {
+			return exception(modbusIllegalDataValue)
+		}
+		for i := 0; i < quantity; i++ {
+			s.registers[address+i] = binary.BigEndian.Uint16(request[6+2*i:])
+		}
+		if s.written != nil {
+			s.written(&s.registers)
+		}
+		return request[:5]
+	}
+
+	return exception(modbusIllegalFunction)
+}
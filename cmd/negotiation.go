@@ -0,0 +1,481 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"math"
+	"time"
+)
+
+const (
+	// negotiationCfgKey is the config key containing the automated negotiation settings.
+	negotiationCfgKey = "negotiation"
+
+	// manualStrategyName leaves every offer to be evaluated in the shell.
+	manualStrategyName = "manual"
+	// thresholdStrategyName accepts offers past one price and rejects offers past another.
+	thresholdStrategyName = "threshold"
+	// splitDifferenceStrategyName concedes half of the difference each round.
+	splitDifferenceStrategyName = "split-difference"
+	// timeOfDayStrategyName accepts offers within a reservation price which depends on the time of day.
+	timeOfDayStrategyName = "time-of-day"
+
+	// defaultMaxRounds is the default number of offers in a negotiation before it is ended.
+	defaultMaxRounds = 5
+)
+
+// negotiationAction is the action decided on by a negotiation strategy.
+type negotiationAction int
+
+const (
+	// evaluateAction leaves the offer to be evaluated in the shell.
+	evaluateAction negotiationAction = iota
+	// acceptAction accepts the offer.
+	acceptAction
+	// rejectAction rejects the offer, ending the negotiation.
+	rejectAction
+	// counterAction rejects the offer and proposes a counter offer.
+	counterAction
+)
+
+// String implements fmt.Stringer.
+func (a negotiationAction) String() string {
+	switch a {
+	case acceptAction:
+		return "accept"
+	case rejectAction:
+		return "reject"
+	case counterAction:
+		return "counter"
+	}
+
+	return "evaluate"
+}
+
+// negotiationDecision is the decision of a negotiation strategy on an offer.
+type negotiationDecision struct {
+	action negotiationAction
+	// price is the price of the counter offer in nano units, if countering.
+	price int64
+	// reason is a human-friendly description of the decision.
+	reason string
+}
+
+// negotiationStrategy decides how to answer an offer automatically.
+type negotiationStrategy interface {
+	// decide returns the decision on an offer, given the number of offers in its negotiation so far and the time.
+	decide(offer *esi.PriceMapOffer, round int, now time.Time) negotiationDecision
+}
+
+// negotiationSettings are the automated negotiation settings, read from the config file.
+//
+// An exchange buys from a facility, so it uses the buy prices, and a facility sells to an exchange, so it uses the
+// sell prices. Prices are in the currency units of Currency, and may be fractional.
+type negotiationSettings struct {
+	// Strategy is the name of the strategy used: manual, threshold, split-difference or time-of-day.
+	Strategy string `mapstructure:"strategy"`
+	// MaxRounds is the number of offers in a negotiation before it is ended, or no limit if not positive.
+	MaxRounds int `mapstructure:"max-rounds"`
+	// Currency is the currency code of the prices, and only offers in it are negotiated.
+	Currency string `mapstructure:"currency"`
+	// AlwaysBuyBelow is the price below which an offer is always accepted.
+	AlwaysBuyBelow float64 `mapstructure:"always-buy-below"`
+	// AvoidBuyOver is the price above which an offer is avoided.
+	AvoidBuyOver float64 `mapstructure:"avoid-buy-over"`
+	// AlwaysSellOver is the price above which an offer is always accepted by a facility.
+	AlwaysSellOver float64 `mapstructure:"always-sell-over"`
+	// AvoidSellBelow is the price below which an offer is avoided by a facility.
+	AvoidSellBelow float64 `mapstructure:"avoid-sell-below"`
+	// ReservationPrices are the reservation prices by time of day, for the time-of-day strategy.
+	ReservationPrices []reservationPrice `mapstructure:"reservation-prices"`
+}
+
+// reservationPrice is the highest price accepted when buying, or the lowest when selling, between two times of day.
+type reservationPrice struct {
+	// From and To are the local times of day the price applies between, as "15:04". If To is before From, the price
+	// applies overnight.
+	From  string  `mapstructure:"from"`
+	To    string  `mapstructure:"to"`
+	Price float64 `mapstructure:"price"`
+}
+
+// readNegotiationSettings returns the configured negotiation settings, using the auto price parameters for any price
+// that is not set. A facility sells at what an exchange would avoid buying over, and avoids selling at what an exchange
+// would always buy below.
+func readNegotiationSettings() negotiationSettings {
+	settings := negotiationSettings{
+		Strategy:       manualStrategyName,
+		MaxRounds:      defaultMaxRounds,
+		Currency:       autoPrice.AlwaysBuyBelowPrice.GetCurrencyCode(),
+		AlwaysBuyBelow: nanosUnits(moneyNanos(autoPrice.AlwaysBuyBelowPrice)),
+		AvoidBuyOver:   nanosUnits(moneyNanos(autoPrice.AvoidBuyOverPrice)),
+		AlwaysSellOver: nanosUnits(moneyNanos(autoPrice.AvoidBuyOverPrice)),
+		AvoidSellBelow: nanosUnits(moneyNanos(autoPrice.AlwaysBuyBelowPrice)),
+	}
+	if viper.IsSet(negotiationCfgKey) {
+		err := viper.UnmarshalKey(negotiationCfgKey, &settings)
+		if err != nil {
+			log.Warn(fmt.Sprintf("Invalid negotiation settings: %s", err))
+		}
+	}
+
+	return settings
+}
+
+// newNegotiationStrategy returns the configured negotiation strategy.
+func newNegotiationStrategy(settings negotiationSettings) (negotiationStrategy, error) {
+	switch settings.Strategy {
+	case manualStrategyName:
+		return manualStrategy{}, nil
+	case thresholdStrategyName:
+		return thresholdStrategy{
+			alwaysBuyBelow: unitsNanos(settings.AlwaysBuyBelow),
+			avoidBuyOver:   unitsNanos(settings.AvoidBuyOver),
+			alwaysSellOver: unitsNanos(settings.AlwaysSellOver),
+			avoidSellBelow: unitsNanos(settings.AvoidSellBelow),
+		}, nil
+	case splitDifferenceStrategyName:
+		return splitDifferenceStrategy{
+			buyTarget:  unitsNanos(settings.AlwaysBuyBelow),
+			sellTarget: unitsNanos(settings.AlwaysSellOver),
+			maxRounds:  settings.MaxRounds,
+		}, nil
+	case timeOfDayStrategyName:
+		for _, reservation := range settings.ReservationPrices {
+			_, err := time.Parse(timeOfDayLayout, reservation.From)
+			if err != nil {
+				return nil, err
+			}
+			_, err = time.Parse(timeOfDayLayout, reservation.To)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return timeOfDayStrategy{
+			reservations: settings.ReservationPrices,
+			buyFallback:  unitsNanos(settings.AlwaysBuyBelow),
+			sellFallback: unitsNanos(settings.AvoidSellBelow),
+			maxRounds:    settings.MaxRounds,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown negotiation strategy: '%s'", settings.Strategy)
+}
+
+// offerPrice returns the price of an offer in nano units.
+func offerPrice(offer *esi.PriceMapOffer) int64 {
+	return moneyNanos(offer.GetPriceMap().GetPrice().GetApparentEnergyPrice())
+}
+
+// unitsNanos returns a configured price in currency units as nano units.
+func unitsNanos(units float64) int64 {
+	return int64(math.Round(units * nanosPerUnit))
+}
+
+// nanosUnits returns a price in nano units as currency units.
+func nanosUnits(nanos int64) float64 {
+	return float64(nanos) / nanosPerUnit
+}
+
+// nanosMoney returns an amount in nano units as money in a currency.
+//
+// The units and nanos of the money have the same sign, as division truncates towards zero.
+func nanosMoney(nanos int64, currency string) *esi.Money {
+	return &esi.Money{
+		CurrencyCode: currency,
+		Units:        nanos / nanosPerUnit,
+		Nanos:        int32(nanos % nanosPerUnit),
+	}
+}
+
+// sellingOffer returns true if this coordination node sells in an offer, which it does as the facility of its route.
+func sellingOffer(offer *esi.PriceMapOffer) bool {
+	return offer.GetRoute().GetFacilityKey() == coordinationNodeInfo.GetPublicKey()
+}
+
+// betterPrice returns true if a price is at least as good as a limit, which is at or below it when buying and at or
+// above it when selling.
+func betterPrice(price int64, limit int64, selling bool) bool {
+	if selling {
+		return price >= limit
+	}
+
+	return price <= limit
+}
+
+// manualStrategy leaves every offer to be evaluated in the shell.
+type manualStrategy struct{}
+
+// decide implements negotiationStrategy.
+func (manualStrategy) decide(offer *esi.PriceMapOffer, round int, now time.Time) negotiationDecision {
+	return negotiationDecision{action: evaluateAction}
+}
+
+// thresholdStrategy accepts any offer below one price and rejects any offer above another when buying, and accepts any
+// offer above one price and rejects any offer below another when selling.
+//
+// Offers between the two prices are left to be evaluated in the shell. Prices are in nano units.
+type thresholdStrategy struct {
+	alwaysBuyBelow int64
+	avoidBuyOver   int64
+	alwaysSellOver int64
+	avoidSellBelow int64
+}
+
+// decide implements negotiationStrategy.
+func (s thresholdStrategy) decide(offer *esi.PriceMapOffer, round int, now time.Time) negotiationDecision {
+	price := offerPrice(offer)
+	if sellingOffer(offer) {
+		if price > s.alwaysSellOver {
+			return negotiationDecision{action: acceptAction, reason: fmt.Sprintf("price over %s", formatNanos(s.alwaysSellOver))}
+		}
+		if price < s.avoidSellBelow {
+			return negotiationDecision{action: rejectAction, reason: fmt.Sprintf("price below %s", formatNanos(s.avoidSellBelow))}
+		}
+		return negotiationDecision{action: evaluateAction}
+	}
+	if price < s.alwaysBuyBelow {
+		return negotiationDecision{action: acceptAction, reason: fmt.Sprintf("price below %s", formatNanos(s.alwaysBuyBelow))}
+	}
+	if price > s.avoidBuyOver {
+		return negotiationDecision{action: rejectAction, reason: fmt.Sprintf("price over %s", formatNanos(s.avoidBuyOver))}
+	}
+
+	return negotiationDecision{action: evaluateAction}
+}
+
+// splitDifferenceStrategy counters each offer with the price half way between it and the last price offered in
+// return, starting from a target price to buy or sell at, until the prices meet or the negotiation runs out of rounds.
+// Prices are in nano units.
+type splitDifferenceStrategy struct {
+	buyTarget  int64
+	sellTarget int64
+	maxRounds  int
+}
+
+// decide implements negotiationStrategy.
+func (s splitDifferenceStrategy) decide(offer *esi.PriceMapOffer, round int, now time.Time) negotiationDecision {
+	price := offerPrice(offer)
+	selling := sellingOffer(offer)
+	target := s.buyTarget
+	if selling {
+		target = s.sellTarget
+	}
+	if betterPrice(price, target, selling) {
+		return negotiationDecision{action: acceptAction, reason: fmt.Sprintf("price at or better than %s", formatNanos(target))}
+	}
+
+	// The last price offered in return is the offer this one counters, if any.
+	last := target
+	if previous, ok := priceMapOffers[previousOffers[offer.GetOfferId().GetUuid()]]; ok {
+		last = offerPrice(previous)
+	}
+	// Once the offer meets the last price, or the prices are a nano unit apart, there is no difference left to split.
+	// Otherwise, the counter is half way between the prices, rounded towards the last price so that it never matches
+	// the offer.
+	difference := price - last
+	if betterPrice(price, last, selling) || difference == 1 || difference == -1 {
+		return negotiationDecision{action: acceptAction, reason: "prices have met"}
+	}
+	counter := last + difference/2
+	if s.maxRounds > 0 && round >= s.maxRounds {
+		return negotiationDecision{action: rejectAction, reason: fmt.Sprintf("no agreement after %d rounds", round)}
+	}
+
+	return negotiationDecision{action: counterAction, price: counter, reason: "split the difference"}
+}
+
+// timeOfDayLayout is the layout of the times of day of reservation prices.
+const timeOfDayLayout = "15:04"
+
+// timeOfDayStrategy accepts any offer at or below the reservation price for the time of day when buying, or at or
+// above it when selling, and otherwise counters at the reservation price until the negotiation runs out of rounds.
+type timeOfDayStrategy struct {
+	reservations []reservationPrice
+	// buyFallback and sellFallback are the reservation prices outside of every reservation, in nano units.
+	buyFallback  int64
+	sellFallback int64
+	maxRounds    int
+}
+
+// reservation returns the reservation price at a time in nano units, falling back to the price for a side.
+func (s timeOfDayStrategy) reservation(now time.Time, selling bool) int64 {
+	minutes := now.Hour()*60 + now.Minute()
+	for _, reservation := range s.reservations {
+		from, _ := time.Parse(timeOfDayLayout, reservation.From)
+		to, _ := time.Parse(timeOfDayLayout, reservation.To)
+		start := from.Hour()*60 + from.Minute()
+		end := to.Hour()*60 + to.Minute()
+
+		if start <= end && minutes >= start && minutes < end {
+			return unitsNanos(reservation.Price)
+		}
+		if start > end && (minutes >= start || minutes < end) {
+			return unitsNanos(reservation.Price)
+		}
+	}
+
+	if selling {
+		return s.sellFallback
+	}
+
+	return s.buyFallback
+}
+
+// decide implements negotiationStrategy.
+func (s timeOfDayStrategy) decide(offer *esi.PriceMapOffer, round int, now time.Time) negotiationDecision {
+	price := offerPrice(offer)
+	selling := sellingOffer(offer)
+	reservation := s.reservation(now, selling)
+	if betterPrice(price, reservation, selling) {
+		return negotiationDecision{action: acceptAction, reason: fmt.Sprintf("price at or better than reservation %s", formatNanos(reservation))}
+	}
+	if s.maxRounds > 0 && round >= s.maxRounds {
+		return negotiationDecision{action: rejectAction, reason: fmt.Sprintf("no agreement after %d rounds", round)}
+	}
+
+	return negotiationDecision{action: counterAction, price: reservation, reason: fmt.Sprintf("price worse than reservation %s", formatNanos(reservation))}
+}
+
+// responseParty returns the party that a response to an offer is sent to.
+func responseParty(offer *esi.PriceMapOffer) *esi.NodeType {
+	if offer.GetNode().GetType() == esi.NodeType_FACILITY {
+		return &esi.NodeType{Type: esi.NodeType_EXCHANGE}
+	}
+
+	return &esi.NodeType{Type: esi.NodeType_FACILITY}
+}
+
+// counterOffer rejects an offer and tracks a counter offer with a new price map signed by this coordination node,
+// returning the response to send.
+func counterOffer(previous *esi.PriceMapOffer, priceMap *esi.PriceMap) (*esi.PriceMapOfferResponse, error) {
+	err := checkOfferRounds(previous.OfferId.GetUuid())
+	if err != nil {
+		return nil, err
+	}
+	uuid, err := newUuid()
+	if err != nil {
+		return nil, err
+	}
+
+	response := esi.PriceMapOfferResponse{
+		Route:         previous.Route,
+		PreviousOffer: previous.OfferId,
+		OfferId:       &esi.Uuid{Uuid: uuid},
+		AcceptOneof:   &esi.PriceMapOfferResponse_CounterOffer{CounterOffer: priceMap},
+		Node:          responseParty(previous),
+		RespondBy:     newRespondBy(previous.When),
+	}
+	// In the new offer, use the time specified by the previous offer.
+	newOffer := esi.PriceMapOffer{
+		Route:     previous.Route,
+		OfferId:   response.OfferId,
+		When:      previous.When,
+		PriceMap:  priceMap,
+		Node:      response.Node,
+		RespondBy: response.RespondBy,
+		// A counter offer is made against the same catalogue entry as the offer it answers.
+		CatalogueEntry: previous.GetCatalogueEntry(),
+	}
+	newOffer.Signature, err = signOffer(&newOffer)
+	if err != nil {
+		return nil, err
+	}
+	response.OfferSignature = newOffer.Signature
+
+	err = transitionOffer(previous.OfferId.GetUuid(), esi.PriceMapOfferStatus_REJECTED)
+	if err != nil {
+		return nil, err
+	}
+	err = trackOffer(&newOffer, coordinationNodeInfo.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	previousOffers[uuid] = previous.OfferId.GetUuid()
+
+	return &response, nil
+}
+
+// negotiate answers a received offer with the configured negotiation strategy.
+//
+// It returns false if the offer is left to be evaluated in the shell.
+func negotiate(offer *esi.PriceMapOffer) bool {
+	uuid := offer.OfferId.GetUuid()
+	settings := readNegotiationSettings()
+	strategy, err := newNegotiationStrategy(settings)
+	if err != nil {
+		log.Error(err.Error())
+		return false
+	}
+
+	// The prices of the strategy are in one currency, so an offer in any other is left to be evaluated in the shell.
+	if currency := offer.GetPriceMap().GetPrice().GetApparentEnergyPrice().GetCurrencyCode(); settings.Strategy != manualStrategyName && currency != settings.Currency {
+		log.WithFields(log.Fields{
+			"uuid":     uuid,
+			"currency": currency,
+			"expected": settings.Currency,
+		}).Warn("Cannot negotiate an offer in another currency")
+		return false
+	}
+
+	decision := strategy.decide(offer, offerRound(uuid), time.Now())
+	var response *esi.PriceMapOfferResponse
+	switch decision.action {
+	case evaluateAction:
+		return false
+	case acceptAction:
+		response, err = acceptOffer(offer, responseParty(offer))
+		if err == nil {
+			err = transitionOffer(uuid, esi.PriceMapOfferStatus_ACCEPTED)
+		}
+	case rejectAction:
+		err = transitionOffer(uuid, esi.PriceMapOfferStatus_REJECTED)
+		response = rejectOffer(offer.Route, offer.OfferId, responseParty(offer), decision.reason)
+	case counterAction:
+		if offer.GetPriceMap().GetPrice().GetApparentEnergyPrice() == nil {
+			log.Warn("Cannot counter an offer without a price")
+			return false
+		}
+		priceMap := proto.Clone(offer.PriceMap).(*esi.PriceMap)
+		priceMap.Price.ApparentEnergyPrice = nanosMoney(decision.price, priceMap.Price.ApparentEnergyPrice.GetCurrencyCode())
+		response, err = counterOffer(offer, priceMap)
+	}
+	if err != nil {
+		log.Error(err.Error())
+		return false
+	}
+
+	err = esi.SendPriceMapOfferResponse(coordinationNodeClient, response)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":     uuid,
+		"strategy": settings.Strategy,
+		"action":   decision.action,
+		"price":    formatNanos(decision.price),
+		"reason":   decision.reason,
+	}).Info("Negotiated offer")
+
+	return true
+}
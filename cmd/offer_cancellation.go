@@ -0,0 +1,155 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	// cancellationPenaltiesCfgKey is the config key containing the cancellation penalty rules by offer status.
+	//
+	// For example, "cancellation-penalties.ACCEPTED.rate" is the fraction of the offer value charged to a party which
+	// cancels an accepted offer, and "cancellation-penalties.ACCEPTED.exempt" are the reasons which are never charged.
+	cancellationPenaltiesCfgKey = "cancellation-penalties"
+)
+
+// cancellationPenalty is a rule for charging the party which cancels an offer.
+type cancellationPenalty struct {
+	// Rate is the fraction of the offer value charged.
+	Rate float64 `mapstructure:"rate"`
+	// Exempt are the names of the cancellation reasons which are never charged.
+	Exempt []string `mapstructure:"exempt"`
+}
+
+// offerPenalty is a penalty charged for cancelling an offer.
+type offerPenalty struct {
+	// payer is the public key of the party which cancelled the offer.
+	payer string
+	// reason is the reason the offer was cancelled.
+	reason esi.PriceMapOfferCancellation_Reason
+	// nanos is the penalty, in nano units of the currency of the offer price.
+	nanos int64
+	// time is when the offer was cancelled.
+	time time.Time
+}
+
+// defaultCancellationPenalties are the cancellation penalty rules used when none are configured.
+//
+// Withdrawing an unanswered offer is free, but cancelling an accepted offer is charged unless it is due to a grid
+// emergency.
+var defaultCancellationPenalties = map[string]cancellationPenalty{
+	esi.PriceMapOfferStatus_UNKNOWN.String():  {Rate: 0},
+	esi.PriceMapOfferStatus_ACCEPTED.String(): {Rate: 0.1, Exempt: []string{esi.PriceMapOfferCancellation_GRID_EMERGENCY.String()}},
+}
+
+// offerPenalties are the penalties charged for cancelled offers by uuid.
+var offerPenalties = make(map[string]*offerPenalty)
+
+// penaltyOf returns the cancellation penalty rule for an offer status.
+//
+// A rule set in the config file replaces the default rule for that status.
+func penaltyOf(status esi.PriceMapOfferStatus_Status) cancellationPenalty {
+	key := cancellationPenaltiesCfgKey + "." + status.String()
+	if viper.IsSet(key) {
+		penalty := cancellationPenalty{}
+		err := viper.UnmarshalKey(key, &penalty)
+		if err == nil {
+			return penalty
+		}
+		log.WithFields(log.Fields{
+			"status": status,
+		}).Warn("Invalid cancellation penalty, using default")
+	}
+
+	return defaultCancellationPenalties[status.String()]
+}
+
+// cancellationPenaltyNanos returns the penalty for cancelling an offer in a status for a reason, in nano units.
+//
+// The penalty is a fraction of the value of the offer, which is its price per VAh for all of the apparent energy it
+// would deliver, so that it is owed exactly as a delivery would be.
+func cancellationPenaltyNanos(offer *esi.PriceMapOffer, status esi.PriceMapOfferStatus_Status, reason esi.PriceMapOfferCancellation_Reason) int64 {
+	penalty := penaltyOf(status)
+	for _, exempt := range penalty.Exempt {
+		if strings.EqualFold(exempt, reason.String()) {
+			return 0
+		}
+	}
+
+	value := float64(moneyNanos(offer.GetPriceMap().GetPrice().GetApparentEnergyPrice())) * offerEnergy(offer, 100)
+	return int64(math.Round(value * penalty.Rate))
+}
+
+// cancelOffer cancels an offer on behalf of a party, and charges it any penalty.
+//
+// The status of the offer before it was cancelled decides the penalty, so that withdrawing an unanswered offer can be
+// treated differently to cancelling an accepted one. Only the party which made an unanswered offer may withdraw it, as
+// the party it was made to rejects it instead.
+func cancelOffer(uuid string, payer string, reason esi.PriceMapOfferCancellation_Reason) error {
+	status := offerStatus(uuid)
+	if status == esi.PriceMapOfferStatus_UNKNOWN && offerProposers[uuid] != payer {
+		return fmt.Errorf("offer '%s' can only be withdrawn by the party which made it, reject it instead", uuid)
+	}
+	err := transitionOffer(uuid, esi.PriceMapOfferStatus_CANCELLED)
+	if err != nil {
+		return err
+	}
+
+	nanos := cancellationPenaltyNanos(priceMapOffers[uuid], status, reason)
+	if nanos > 0 {
+		offerPenalties[uuid] = &offerPenalty{
+			payer:  payer,
+			reason: reason,
+			nanos:  nanos,
+			time:   time.Now(),
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"uuid":    uuid,
+		"reason":  reason,
+		"from":    status,
+		"payer":   payer,
+		"penalty": formatNanos(nanos),
+	}).Info("Offer cancelled")
+
+	// The offers an aggregated offer was split into are cancelled with it.
+	cancelDownstreamOffers(uuid, reason)
+
+	return nil
+}
+
+// sendOfferCancellation tells the other party of an offer that it has been cancelled by this coordination node.
+func sendOfferCancellation(offer *esi.PriceMapOffer, reason esi.PriceMapOfferCancellation_Reason, message string) {
+	cancellation := esi.PriceMapOfferCancellation{
+		Route:   offer.Route,
+		OfferId: offer.OfferId,
+		Reason:  reason,
+		Message: message,
+	}
+	err := esi.CancelPriceMapOffer(coordinationNodeClient, offerPeer(offer), &cancellation)
+	if err != nil {
+		log.Error(err.Error())
+	}
+}
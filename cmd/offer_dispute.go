@@ -0,0 +1,294 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// offerDispute is a dispute of the outcome of an offer, raised by either party.
+type offerDispute struct {
+	// raisedBy is the public key of the party which raised the dispute.
+	raisedBy string
+	// previous is the status of the offer before it was disputed.
+	previous esi.PriceMapOfferStatus_Status
+	// dispute is the dispute and its evidence.
+	dispute *esi.PriceMapOfferDispute
+	// resolution is the final resolution of the dispute, once resolved.
+	resolution *esi.PriceMapOfferDisputeResolution
+}
+
+// offerDisputes are the disputes raised by or with this coordination node, by uuid.
+//
+// An offer may only be disputed once, so that its resolution is final.
+var offerDisputes = make(map[string]*offerDispute)
+
+// offerEvidence returns the power profile of the facility of an offer over the offer, signed by the facility, or nil
+// if there is none.
+//
+// A facility signs every power sample it recorded over the offer, and an exchange gives the latest power profile it
+// received from the facility, which is signed by the facility and covers the offer once its feedback was verified.
+func offerEvidence(offer *esi.PriceMapOffer) *esi.PowerProfile {
+	if offer.Route.GetFacilityKey() != coordinationNodeInfo.GetPublicKey() {
+		return facilityPowerProfiles[offer.Route.GetFacilityKey()]
+	}
+
+	start := time.Unix(offer.GetWhen().GetSeconds(), 0)
+	end := time.Unix(offerEnd(offer), 0).Add(time.Second)
+	datum, err := powerProfile(&esi.DatumRequest{
+		TimeUnit: esi.TimeUnit_INSTANT,
+		TimeStyleOneof: &esi.DatumRequest_TimeRange{
+			TimeRange: &esi.TimestampRange{Min: timestamppb.New(start), Max: timestamppb.New(end)},
+		},
+	})
+	if err != nil {
+		return nil
+	}
+	profile := &esi.PowerProfile{Route: offer.Route, Datum: datum}
+	if signProfile(profile) != nil {
+		return nil
+	}
+
+	return profile
+}
+
+// raiseDispute disputes the outcome of a completed or failed offer with the other party, with evidence, the offer
+// signed by this coordination node, and the signature the other party gave when it proposed or accepted the offer.
+//
+// The offer is moved to DISPUTED straight away, and moved back to its previous status if the other party refuses the
+// dispute.
+func raiseDispute(uuid string, reason string, percentage float32) error {
+	offer, ok := priceMapOffers[uuid]
+	if !ok {
+		return &offerTransitionError{uuid: uuid}
+	}
+	if _, ok := offerDisputes[uuid]; ok {
+		return fmt.Errorf("offer '%s' has already been disputed", uuid)
+	}
+	counterpartySignature, ok := counterpartySignatures[uuid]
+	if !ok {
+		return fmt.Errorf("offer '%s' was not signed by the other party", uuid)
+	}
+	signature, err := signOffer(offer)
+	if err != nil {
+		return err
+	}
+	previous := offerStatus(uuid)
+	err = transitionOffer(uuid, esi.PriceMapOfferStatus_DISPUTED)
+	if err != nil {
+		return err
+	}
+
+	dispute := esi.PriceMapOfferDispute{
+		Route:                 offer.Route,
+		OfferId:               offer.OfferId,
+		Reason:                reason,
+		DeliveredPercentage:   percentage,
+		Evidence:              offerEvidence(offer),
+		Offer:                 offer,
+		OfferSignature:        signature,
+		CounterpartySignature: counterpartySignature,
+	}
+	offerDisputes[uuid] = &offerDispute{
+		raisedBy: coordinationNodeInfo.GetPublicKey(),
+		previous: previous,
+		dispute:  &dispute,
+	}
+
+	err = esi.DisputePriceMapOffer(coordinationNodeClient, offerPeer(offer), &dispute)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"dest":      offerPeer(offer),
+		"uuid":      uuid,
+		"reason":    reason,
+		"delivered": fmt.Sprintf("%.1f%%", percentage),
+		"evidence":  len(dispute.GetEvidence().GetDatum()),
+	}).Warn("Disputed offer")
+
+	return nil
+}
+
+// withdrawDispute withdraws a dispute raised by this coordination node which the other party refused, moving the offer
+// back to the status it had before it was disputed. It returns false if the error is not a refusal of such a dispute.
+//
+// An offer which the other party holds as DISPUTED had the dispute accepted, whatever the error was about.
+func withdrawDispute(src string, offerError *esi.PriceMapOfferError) bool {
+	uuid := offerError.OfferId.GetUuid()
+	d, ok := offerDisputes[uuid]
+	if !ok || d.raisedBy != coordinationNodeInfo.GetPublicKey() || d.resolution != nil {
+		return false
+	}
+	if offerPeer(priceMapOffers[uuid]) != src || offerError.Status == esi.PriceMapOfferStatus_DISPUTED {
+		return false
+	}
+	err := transitionOffer(uuid, d.previous)
+	if err != nil {
+		log.Error(err.Error())
+		return false
+	}
+	delete(offerDisputes, uuid)
+
+	log.WithFields(log.Fields{
+		"src":    src,
+		"uuid":   uuid,
+		"status": d.previous,
+		"error":  offerError.GetMessage(),
+	}).Warn("Dispute was refused by peer, and has been withdrawn")
+
+	return true
+}
+
+// receiveDispute records a dispute raised by the other party of an offer, once its signed offer is checked against
+// the offer held by this coordination node.
+func receiveDispute(src string, dispute *esi.PriceMapOfferDispute) error {
+	uuid := dispute.OfferId.GetUuid()
+	offer, err := peerOffer(src, uuid)
+	if err != nil {
+		return err
+	}
+	if _, ok := offerDisputes[uuid]; ok {
+		return fmt.Errorf("offer '%s' has already been disputed", uuid)
+	}
+	if !proto.Equal(dispute.GetOffer(), offer) {
+		return fmt.Errorf("disputed offer does not match offer '%s'", uuid)
+	}
+	err = verifyOfferSignature(src, dispute.GetOffer(), dispute.GetOfferSignature())
+	if err != nil {
+		return err
+	}
+	err = verifyOfferSignature(coordinationNodeInfo.GetPublicKey(), dispute.GetOffer(), dispute.GetCounterpartySignature())
+	if err != nil {
+		return fmt.Errorf("offer '%s' was not signed by this node: %s", uuid, err.Error())
+	}
+	if dispute.GetEvidence() != nil {
+		err = verifyProfileSignature(offer.Route.GetFacilityKey(), dispute.GetEvidence())
+		if err != nil {
+			return err
+		}
+	}
+	previous := offerStatus(uuid)
+	err = transitionOffer(uuid, esi.PriceMapOfferStatus_DISPUTED)
+	if err != nil {
+		return err
+	}
+
+	offerDisputes[uuid] = &offerDispute{
+		raisedBy: src,
+		previous: previous,
+		dispute:  dispute,
+	}
+
+	log.WithFields(log.Fields{
+		"src":       src,
+		"uuid":      uuid,
+		"reason":    dispute.GetReason(),
+		"delivered": fmt.Sprintf("%.1f%%", dispute.GetDeliveredPercentage()),
+		"evidence":  len(dispute.GetEvidence().GetDatum()),
+	}).Warn("Offer has been disputed")
+
+	return nil
+}
+
+// resolveDispute settles a dispute raised with this coordination node, moving the offer to its final status and
+// sending the resolution to the party which raised it.
+func resolveDispute(uuid string, outcome esi.PriceMapOfferStatus_Status, percentage float32, message string) error {
+	d, ok := offerDisputes[uuid]
+	if !ok {
+		return fmt.Errorf("offer '%s' has not been disputed", uuid)
+	}
+	if d.raisedBy == coordinationNodeInfo.GetPublicKey() {
+		return fmt.Errorf("offer '%s' was disputed by this node, and is resolved by the other party", uuid)
+	}
+	if d.resolution != nil {
+		return fmt.Errorf("offer '%s' has already been resolved", uuid)
+	}
+	if outcome != esi.PriceMapOfferStatus_COMPLETED && outcome != esi.PriceMapOfferStatus_FAILED {
+		return fmt.Errorf("a dispute cannot be resolved as %s", outcome)
+	}
+	err := transitionOffer(uuid, outcome)
+	if err != nil {
+		return err
+	}
+
+	offer := priceMapOffers[uuid]
+	resolution := esi.PriceMapOfferDisputeResolution{
+		Route:               offer.Route,
+		OfferId:             offer.OfferId,
+		Outcome:             outcome,
+		DeliveredPercentage: percentage,
+		Message:             message,
+	}
+	d.resolution = &resolution
+
+	err = esi.ResolvePriceMapOfferDispute(coordinationNodeClient, d.raisedBy, &resolution)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"dest":      d.raisedBy,
+		"uuid":      uuid,
+		"outcome":   outcome,
+		"delivered": fmt.Sprintf("%.1f%%", percentage),
+	}).Info("Resolved dispute")
+
+	return nil
+}
+
+// receiveResolution records the resolution of a dispute raised by this coordination node, moving the offer to its
+// final status.
+func receiveResolution(src string, resolution *esi.PriceMapOfferDisputeResolution) error {
+	uuid := resolution.OfferId.GetUuid()
+	_, err := peerOffer(src, uuid)
+	if err != nil {
+		return err
+	}
+	d, ok := offerDisputes[uuid]
+	if !ok || d.raisedBy != coordinationNodeInfo.GetPublicKey() {
+		return fmt.Errorf("offer '%s' has not been disputed by this node", uuid)
+	}
+	if d.resolution != nil {
+		return fmt.Errorf("offer '%s' has already been resolved", uuid)
+	}
+	if resolution.Outcome != esi.PriceMapOfferStatus_COMPLETED && resolution.Outcome != esi.PriceMapOfferStatus_FAILED {
+		return fmt.Errorf("a dispute cannot be resolved as %s", resolution.Outcome)
+	}
+	err = transitionOffer(uuid, resolution.Outcome)
+	if err != nil {
+		return err
+	}
+
+	d.resolution = resolution
+
+	log.WithFields(log.Fields{
+		"src":       src,
+		"uuid":      uuid,
+		"outcome":   resolution.Outcome,
+		"delivered": fmt.Sprintf("%.1f%%", resolution.DeliveredPercentage),
+		"message":   resolution.Message,
+	}).Info("Dispute has been resolved")
+
+	return nil
+}
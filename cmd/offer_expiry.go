@@ -0,0 +1,106 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// offerResponseSecondsCfgKey is the config key of the number of seconds given to answer an offer.
+	offerResponseSecondsCfgKey = "offer-response-seconds"
+	// defaultOfferResponseSeconds is the default number of seconds given to answer an offer.
+	defaultOfferResponseSeconds = 30
+)
+
+// offerResponseSeconds returns the configured number of seconds given to answer an offer.
+func offerResponseSeconds() int64 {
+	if viper.IsSet(offerResponseSecondsCfgKey) {
+		return viper.GetInt64(offerResponseSecondsCfgKey)
+	}
+
+	return defaultOfferResponseSeconds
+}
+
+// newRespondBy returns the time by which a new offer must be answered.
+//
+// An offer can never be answered after it should be executed, so the response time is capped at its start time.
+func newRespondBy(when *timestamppb.Timestamp) *timestamppb.Timestamp {
+	respondBy := unixSeconds() + offerResponseSeconds()
+	if when != nil && when.Seconds < respondBy {
+		respondBy = when.Seconds
+	}
+
+	return &timestamppb.Timestamp{
+		Seconds: respondBy,
+		Nanos:   0,
+	}
+}
+
+// offerDeadline returns the time in unix seconds by which an offer must be accepted.
+//
+// This is the earlier of its response time, if given, and its start time.
+func offerDeadline(offer *esi.PriceMapOffer) int64 {
+	deadline := offer.GetWhen().GetSeconds()
+	if offer.GetRespondBy() != nil && offer.GetRespondBy().GetSeconds() < deadline {
+		deadline = offer.GetRespondBy().GetSeconds()
+	}
+
+	return deadline
+}
+
+// offerPeer returns the public key of the other party to an offer.
+func offerPeer(offer *esi.PriceMapOffer) string {
+	if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
+		return offer.Route.GetExchangeKey()
+	}
+
+	return offer.Route.GetFacilityKey()
+}
+
+// expireOfferIfDue expires an unanswered offer if its deadline has passed, and notifies the other party.
+//
+// It returns true if the offer was expired.
+func expireOfferIfDue(uuid string) bool {
+	offer, ok := priceMapOffers[uuid]
+	if !ok || offerStatus(uuid) != esi.PriceMapOfferStatus_UNKNOWN || offerDeadline(offer) > unixSeconds() {
+		return false
+	}
+	_ = transitionOffer(uuid, esi.PriceMapOfferStatus_EXPIRED)
+
+	err := esi.ExpirePriceMapOffer(coordinationNodeClient, offerPeer(offer), priceMapOfferStatus[uuid])
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"uuid": uuid,
+		"dest": offerPeer(offer),
+	}).Info("Offer has expired")
+
+	return true
+}
+
+// expireOffers expires every unanswered offer whose deadline has passed.
+func expireOffers() {
+	for uuid := range priceMapOffers {
+		expireOfferIfDue(uuid)
+	}
+}
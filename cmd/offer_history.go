@@ -0,0 +1,70 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// previousOffers is the uuid of the offer each counter offer answers, by uuid.
+	previousOffers = make(map[string]string)
+	// offerTimes is the time each offer was made or received, by uuid.
+	offerTimes = make(map[string]time.Time)
+)
+
+// offerRound returns the number of offers in the negotiation up to and including an offer.
+func offerRound(uuid string) int {
+	round := 1
+	for previous, ok := previousOffers[uuid]; ok; previous, ok = previousOffers[previous] {
+		round += 1
+	}
+
+	return round
+}
+
+// offerThread returns the uuids of every offer in the negotiation of an offer, from the root offer to the latest
+// counter offer.
+func offerThread(uuid string) []string {
+	root := uuid
+	for previous, ok := previousOffers[root]; ok; previous, ok = previousOffers[previous] {
+		root = previous
+	}
+
+	// Each offer is answered by at most one counter offer, as answering it rejects it.
+	next := make(map[string]string)
+	for counter, previous := range previousOffers {
+		next[previous] = counter
+	}
+	thread := []string{root}
+	for counter, ok := next[root]; ok; counter, ok = next[counter] {
+		thread = append(thread, counter)
+	}
+
+	return thread
+}
+
+// checkOfferRounds returns an error if an offer cannot be countered without going over the configured max rounds.
+func checkOfferRounds(uuid string) error {
+	maxRounds := readNegotiationSettings().MaxRounds
+	if maxRounds > 0 && offerRound(uuid) >= maxRounds {
+		return fmt.Errorf("negotiation of offer '%s' has reached the max of %d rounds", uuid, maxRounds)
+	}
+
+	return nil
+}
@@ -0,0 +1,363 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// offerSchedulerWake wakes the offer scheduler to look at the offers again, after an offer is tracked or changes
+// status.
+var offerSchedulerWake = make(chan struct{}, 1)
+
+// storedOffer is an offer as persisted between restarts.
+type storedOffer struct {
+	// Offer is the offer in protobuf JSON.
+	Offer json.RawMessage `json:"offer"`
+	// Status is the name of the status of the offer.
+	Status string `json:"status"`
+	// Previous is the uuid of the offer this offer counters, if any.
+	Previous string `json:"previous,omitempty"`
+	// Proposer is the public key of the party which made the offer.
+	Proposer string `json:"proposer"`
+	// CounterpartySignature is the signature of the offer by the other party, once given.
+	CounterpartySignature []byte `json:"counterparty-signature,omitempty"`
+	// Time is the time the offer was made or received.
+	Time time.Time `json:"time"`
+	// Feedback is the feedback on the offer in protobuf JSON, once finished.
+	Feedback json.RawMessage `json:"feedback,omitempty"`
+	// FeedbackAccepted is true if the exchange accepted the feedback.
+	FeedbackAccepted bool `json:"feedback-accepted,omitempty"`
+	// Dispute is the dispute of the offer in protobuf JSON, if disputed.
+	Dispute json.RawMessage `json:"dispute,omitempty"`
+	// DisputedBy is the public key of the party which disputed the offer, if disputed.
+	DisputedBy string `json:"disputed-by,omitempty"`
+	// DisputedFrom is the name of the status of the offer before it was disputed, if disputed.
+	DisputedFrom string `json:"disputed-from,omitempty"`
+	// Resolution is the resolution of the dispute in protobuf JSON, once resolved.
+	Resolution json.RawMessage `json:"resolution,omitempty"`
+	// Penalty is the penalty charged for cancelling the offer, if any.
+	Penalty *storedPenalty `json:"penalty,omitempty"`
+	// Downstream are the uuids of the offers made to downstream facilities for the offer in aggregator mode, if any.
+	Downstream []string `json:"downstream,omitempty"`
+}
+
+// storedPenalty is a cancellation penalty as persisted between restarts.
+type storedPenalty struct {
+	// Payer is the public key of the party which cancelled the offer.
+	Payer string `json:"payer"`
+	// Reason is the name of the reason the offer was cancelled.
+	Reason string `json:"reason"`
+	// Nanos is the penalty, in nano units of the currency of the offer price.
+	Nanos int64 `json:"nanos"`
+	// Time is when the offer was cancelled.
+	Time time.Time `json:"time"`
+}
+
+// scheduleOffers wakes the offer scheduler, without blocking if it is already due to wake.
+func scheduleOffers() {
+	select {
+	case offerSchedulerWake <- struct{}{}:
+	default:
+	}
+}
+
+// coordinationNodeOfferScheduler moves offers through their lifecycle at the time each step is due.
+//
+// Rather than checking the offers at a regular period, the scheduler sleeps until the next offer is due to be
+// answered, start or finish, or until an offer changes, so that every step happens on time.
+func coordinationNodeOfferScheduler() {
+	for {
+		stateMutex.Lock()
+		runDueOffers()
+
+		err := saveOffers(offersPath())
+		if err != nil {
+			log.Error(err.Error())
+		}
+
+		next, ok := nextOfferEvent()
+		stateMutex.Unlock()
+		if !ok {
+			<-offerSchedulerWake
+			continue
+		}
+		// Offer times are in whole seconds, so anything still due now is waited on until the next second.
+		if next <= unixSeconds() {
+			next = unixSeconds() + 1
+		}
+		timer := time.NewTimer(time.Until(time.Unix(next, 0)))
+		select {
+		case <-timer.C:
+		case <-offerSchedulerWake:
+			timer.Stop()
+		}
+	}
+}
+
+// nextOfferEvent returns the time in unix seconds of the next step due for any offer or call for bids, or false if
+// there is none.
+func nextOfferEvent() (int64, bool) {
+	var next int64
+	found := false
+	due := func(when int64) {
+		if !found || when < next {
+			next = when
+			found = true
+		}
+	}
+
+	for uuid, offer := range priceMapOffers {
+		switch offerStatus(uuid) {
+		case esi.PriceMapOfferStatus_UNKNOWN:
+			due(offerDeadline(offer))
+		case esi.PriceMapOfferStatus_ACCEPTED:
+			due(offer.GetWhen().GetSeconds())
+		case esi.PriceMapOfferStatus_EXECUTING:
+			// The exchange completes the offer once it receives feedback. An aggregated offer which has ended is
+			// waiting on the downstream offers instead, which wake the scheduler when they finish.
+			if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() {
+				if aggregatedOffer(uuid) && offerEnd(offer) <= unixSeconds() {
+					continue
+				}
+				due(offerEnd(offer))
+			}
+		}
+	}
+	for _, calls := range callsForBids {
+		if !calls.closed {
+			due(calls.call.Deadline.GetSeconds())
+		}
+	}
+
+	return next, found
+}
+
+// offerEnd returns the time in unix seconds an offer finishes executing.
+func offerEnd(offer *esi.PriceMapOffer) int64 {
+	return offer.GetWhen().GetSeconds() + offer.GetPriceMap().GetDuration().GetSeconds()
+}
+
+// runDueOffers carries out every step which is due for any offer or call for bids.
+func runDueOffers() {
+	// Expire any offers which were not answered in time.
+	expireOffers()
+
+	// Award any calls for bids which have passed their deadline.
+	closeCallsForBids()
+
+	for uuid, offer := range priceMapOffers {
+		// If the offer has been accepted, then check to see if the time expected has passed.
+		if offerStatus(uuid) == esi.PriceMapOfferStatus_ACCEPTED && offer.GetWhen().GetSeconds() <= unixSeconds() {
+			_ = transitionOffer(uuid, esi.PriceMapOfferStatus_EXECUTING)
+
+			log.WithFields(log.Fields{
+				"uuid": uuid,
+			}).Info("Offer is executing")
+
+			// A facility starts carrying out the offer on its equipment, unless the offer was split between downstream
+			// facilities which carry it out instead.
+			if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() && !aggregatedOffer(uuid) {
+				startDispatch(uuid)
+			}
+		}
+
+		// Actions specifically relating to the facility.
+		//
+		// If the offer is executing and has passed the time expected to execute, stop carrying it out, which completes
+		// or fails it. An aggregated offer is finished from the downstream offers instead. The exchange completes the
+		// offer once it receives feedback.
+		if offer.Route.GetFacilityKey() == coordinationNodeInfo.GetPublicKey() && offerStatus(uuid) == esi.PriceMapOfferStatus_EXECUTING {
+			if offerEnd(offer) <= unixSeconds() {
+				if aggregatedOffer(uuid) {
+					finishAggregatedOffer(uuid)
+				} else {
+					stopDispatch(uuid)
+				}
+			}
+		}
+	}
+}
+
+// offersPath returns the path of the file the offers of the coordination node are persisted to, next to its config.
+func offersPath() string {
+	return strings.TrimSuffix(coordinationNodePath, filepath.Ext(coordinationNodePath)) + offersSuffix
+}
+
+// saveOffers persists every offer and its status to a file.
+//
+// The file is written in full and then renamed, so that a restart never reads a partly written file.
+func saveOffers(path string) error {
+	var stored []storedOffer
+	for uuid, offer := range priceMapOffers {
+		offerJson, err := protojson.Marshal(offer)
+		if err != nil {
+			return err
+		}
+		s := storedOffer{
+			Offer:                 offerJson,
+			Status:                offerStatus(uuid).String(),
+			Previous:              previousOffers[uuid],
+			Proposer:              offerProposers[uuid],
+			Time:                  offerTimes[uuid],
+			Downstream:            downstreamOffers[uuid],
+			CounterpartySignature: counterpartySignatures[uuid],
+		}
+		if feedback, ok := offerFeedback[uuid]; ok {
+			s.Feedback, err = protojson.Marshal(feedback)
+			if err != nil {
+				return err
+			}
+			s.FeedbackAccepted = offerFeedbackAccepted[uuid]
+		}
+		if penalty, ok := offerPenalties[uuid]; ok {
+			s.Penalty = &storedPenalty{
+				Payer:  penalty.payer,
+				Reason: penalty.reason.String(),
+				Nanos:  penalty.nanos,
+				Time:   penalty.time,
+			}
+		}
+		if d, ok := offerDisputes[uuid]; ok {
+			s.DisputedBy = d.raisedBy
+			s.DisputedFrom = d.previous.String()
+			s.Dispute, err = protojson.Marshal(d.dispute)
+			if err != nil {
+				return err
+			}
+			if d.resolution != nil {
+				s.Resolution, err = protojson.Marshal(d.resolution)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		stored = append(stored, s)
+	}
+
+	jsonBytes, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", jsonBytes, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// loadOffers restores the offers persisted to a file, if it exists.
+//
+// Any step that fell due while the coordination node was stopped is carried out when the offer scheduler starts.
+func loadOffers(path string) error {
+	byteValue, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var stored []storedOffer
+	err = json.Unmarshal(byteValue, &stored)
+	if err != nil {
+		return err
+	}
+	for _, s := range stored {
+		offer := &esi.PriceMapOffer{}
+		err = protojson.Unmarshal(s.Offer, offer)
+		if err != nil {
+			return err
+		}
+		status, ok := esi.PriceMapOfferStatus_Status_value[s.Status]
+		if !ok {
+			return fmt.Errorf("unknown offer status: '%s'", s.Status)
+		}
+
+		uuid := offer.OfferId.GetUuid()
+		priceMapOffers[uuid] = offer
+		priceMapOfferStatus[uuid] = &esi.PriceMapOfferStatus{
+			Route:   offer.Route,
+			OfferId: offer.OfferId,
+			Status:  esi.PriceMapOfferStatus_Status(status),
+		}
+		offerTimes[uuid] = s.Time
+		offerProposers[uuid] = s.Proposer
+		if s.Previous != "" {
+			previousOffers[uuid] = s.Previous
+		}
+		if len(s.Downstream) > 0 {
+			downstreamOffers[uuid] = s.Downstream
+		}
+		if s.CounterpartySignature != nil {
+			counterpartySignatures[uuid] = s.CounterpartySignature
+		}
+		if s.Feedback != nil {
+			feedback := &esi.PriceMapOfferFeedback{}
+			err = protojson.Unmarshal(s.Feedback, feedback)
+			if err != nil {
+				return err
+			}
+			offerFeedback[uuid] = feedback
+			offerFeedbackAccepted[uuid] = s.FeedbackAccepted
+		}
+		if s.Penalty != nil {
+			offerPenalties[uuid] = &offerPenalty{
+				payer:  s.Penalty.Payer,
+				reason: esi.PriceMapOfferCancellation_Reason(esi.PriceMapOfferCancellation_Reason_value[s.Penalty.Reason]),
+				nanos:  s.Penalty.Nanos,
+				time:   s.Penalty.Time,
+			}
+		}
+		if s.Dispute != nil {
+			d := &offerDispute{
+				raisedBy: s.DisputedBy,
+				previous: esi.PriceMapOfferStatus_Status(esi.PriceMapOfferStatus_Status_value[s.DisputedFrom]),
+				dispute:  &esi.PriceMapOfferDispute{},
+			}
+			err = protojson.Unmarshal(s.Dispute, d.dispute)
+			if err != nil {
+				return err
+			}
+			if s.Resolution != nil {
+				d.resolution = &esi.PriceMapOfferDisputeResolution{}
+				err = protojson.Unmarshal(s.Resolution, d.resolution)
+				if err != nil {
+					return err
+				}
+			}
+			offerDisputes[uuid] = d
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"path":   path,
+		"offers": len(stored),
+	}).Info("Loaded offers")
+
+	return nil
+}
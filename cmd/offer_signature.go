@@ -0,0 +1,119 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	// invalidOfferSignatureErr is returned when an offer was not signed by the party it should have been.
+	invalidOfferSignatureErr = errors.New("offer signature is invalid")
+	// invalidProfileSignatureErr is returned when a power profile was not signed by its facility.
+	invalidProfileSignatureErr = errors.New("power profile signature is invalid")
+)
+
+// counterpartySignatures are the signatures of each offer by the other party, given when it proposed or accepted the
+// offer, by uuid.
+var counterpartySignatures = make(map[string][]byte)
+
+// offerSignaturePayload returns the bytes signed for an offer: its deterministic encoding without its signature.
+func offerSignaturePayload(offer *esi.PriceMapOffer) ([]byte, error) {
+	unsigned := proto.Clone(offer).(*esi.PriceMapOffer)
+	unsigned.Signature = nil
+
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+// profileSignaturePayload returns the bytes signed for a power profile: its deterministic encoding without its
+// signature.
+func profileSignaturePayload(profile *esi.PowerProfile) ([]byte, error) {
+	unsigned := proto.Clone(profile).(*esi.PowerProfile)
+	unsigned.Signature = nil
+
+	return proto.MarshalOptions{Deterministic: true}.Marshal(unsigned)
+}
+
+// sign returns the signature of a payload by the key of this coordination node.
+func sign(payload []byte) ([]byte, error) {
+	if len(coordinationNodePrivateKey) != ed25519.SeedSize {
+		return nil, invalidKeyPairErr
+	}
+
+	return ed25519.Sign(ed25519.NewKeyFromSeed(coordinationNodePrivateKey), payload), nil
+}
+
+// validSignature returns true if a payload was signed by a public key.
+func validSignature(publicKey string, payload []byte, signature []byte) bool {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+
+	return ed25519.Verify(key, payload, signature)
+}
+
+// signOffer returns the signature of an offer by the key of this coordination node.
+func signOffer(offer *esi.PriceMapOffer) ([]byte, error) {
+	payload, err := offerSignaturePayload(offer)
+	if err != nil {
+		return nil, err
+	}
+
+	return sign(payload)
+}
+
+// verifyOfferSignature verifies that an offer was signed by a public key.
+func verifyOfferSignature(publicKey string, offer *esi.PriceMapOffer, signature []byte) error {
+	payload, err := offerSignaturePayload(offer)
+	if err != nil {
+		return err
+	}
+	if !validSignature(publicKey, payload, signature) {
+		return invalidOfferSignatureErr
+	}
+
+	return nil
+}
+
+// signProfile signs a power profile with the key of this coordination node.
+func signProfile(profile *esi.PowerProfile) error {
+	payload, err := profileSignaturePayload(profile)
+	if err != nil {
+		return err
+	}
+	profile.Signature, err = sign(payload)
+
+	return err
+}
+
+// verifyProfileSignature verifies that a power profile was signed by a public key.
+func verifyProfileSignature(publicKey string, profile *esi.PowerProfile) error {
+	payload, err := profileSignaturePayload(profile)
+	if err != nil {
+		return err
+	}
+	if !validSignature(publicKey, payload, profile.GetSignature()) {
+		return invalidProfileSignatureErr
+	}
+
+	return nil
+}
@@ -0,0 +1,251 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+)
+
+// testKey is a key pair used to sign in tests.
+type testKey struct {
+	seed      []byte
+	publicKey string
+}
+
+// newTestKey returns a key pair made from a seed byte.
+func newTestKey(b byte) testKey {
+	seed := make([]byte, ed25519.SeedSize)
+	for i := range seed {
+		seed[i] = b
+	}
+
+	return testKey{
+		seed:      seed,
+		publicKey: hex.EncodeToString(ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)),
+	}
+}
+
+// sign returns the signature of a payload by the key.
+func (k testKey) sign(payload []byte) []byte {
+	return ed25519.Sign(ed25519.NewKeyFromSeed(k.seed), payload)
+}
+
+// useTestKey makes a key the key of this coordination node until the returned function is called.
+func useTestKey(k testKey) func() {
+	seed, publicKey := coordinationNodePrivateKey, coordinationNodeInfo.PublicKey
+	coordinationNodePrivateKey, coordinationNodeInfo.PublicKey = k.seed, k.publicKey
+
+	return func() {
+		coordinationNodePrivateKey, coordinationNodeInfo.PublicKey = seed, publicKey
+	}
+}
+
+// testSignedOffer returns an offer from an exchange to a facility at a price.
+func testSignedOffer(exchangeKey string, facilityKey string, units int64) *esi.PriceMapOffer {
+	return &esi.PriceMapOffer{
+		Route:   &esi.DerRoute{ExchangeKey: exchangeKey, FacilityKey: facilityKey},
+		OfferId: &esi.Uuid{Uuid: "offer"},
+		When:    &timestamppb.Timestamp{Seconds: 1600000000},
+		PriceMap: &esi.PriceMap{
+			PowerComponents: &esi.PowerComponents{RealPower: 100},
+			Price: &esi.PriceComponents{
+				ApparentEnergyPrice: &esi.Money{CurrencyCode: "USD", Units: units},
+			},
+		},
+		Node: &esi.NodeType{Type: esi.NodeType_FACILITY},
+	}
+}
+
+// testProfile returns a power profile of a facility with one datum.
+func testProfile(facilityKey string, realPower int64) *esi.PowerProfile {
+	return &esi.PowerProfile{
+		Route: &esi.DerRoute{FacilityKey: facilityKey},
+		Datum: []*esi.PowerProfileDatum{{
+			Ts:              &timestamppb.Timestamp{Seconds: 1600000000},
+			PowerComponents: &esi.PowerComponents{RealPower: realPower},
+		}},
+	}
+}
+
+func TestVerifyOfferSignature(t *testing.T) {
+	self, other := newTestKey(1), newTestKey(2)
+	defer useTestKey(self)()
+
+	offer := testSignedOffer(self.publicKey, other.publicKey, 5)
+	signature, err := signOffer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// signed is the offer carrying its own signature, which is left out of what is signed.
+	signed := proto.Clone(offer).(*esi.PriceMapOffer)
+	signed.Signature = signature
+	changed := proto.Clone(offer).(*esi.PriceMapOffer)
+	changed.PriceMap.Price.ApparentEnergyPrice.Nanos = 1
+
+	tests := []struct {
+		name      string
+		publicKey string
+		offer     *esi.PriceMapOffer
+		signature []byte
+		ok        bool
+	}{
+		{"signed", self.publicKey, offer, signature, true},
+		{"carrying its signature", self.publicKey, signed, signature, true},
+		{"other key", other.publicKey, offer, signature, false},
+		{"changed price", self.publicKey, changed, signature, false},
+		{"truncated signature", self.publicKey, offer, signature[:len(signature)-1], false},
+		{"no signature", self.publicKey, offer, nil, false},
+		{"invalid public key", "not hex", offer, signature, false},
+	}
+
+	for _, test := range tests {
+		err := verifyOfferSignature(test.publicKey, test.offer, test.signature)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verifyOfferSignature = %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestVerifyProfileSignature(t *testing.T) {
+	self, other := newTestKey(1), newTestKey(2)
+	defer useTestKey(self)()
+
+	profile := testProfile(self.publicKey, 100)
+	if err := signProfile(profile); err != nil {
+		t.Fatal(err)
+	}
+	changed := proto.Clone(profile).(*esi.PowerProfile)
+	changed.Datum[0].PowerComponents.RealPower = 101
+	unsigned := proto.Clone(profile).(*esi.PowerProfile)
+	unsigned.Signature = nil
+
+	tests := []struct {
+		name      string
+		publicKey string
+		profile   *esi.PowerProfile
+		ok        bool
+	}{
+		{"signed", self.publicKey, profile, true},
+		{"other key", other.publicKey, profile, false},
+		{"changed power", self.publicKey, changed, false},
+		{"unsigned", self.publicKey, unsigned, false},
+	}
+
+	for _, test := range tests {
+		err := verifyProfileSignature(test.publicKey, test.profile)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verifyProfileSignature = %v, want ok %t", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestReceiveDispute(t *testing.T) {
+	self, facility, stranger := newTestKey(1), newTestKey(2), newTestKey(3)
+	defer useTestKey(self)()
+
+	offer := testSignedOffer(self.publicKey, facility.publicKey, 5)
+	payload, err := offerSignaturePayload(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence := testProfile(facility.publicKey, 90)
+	profilePayload, err := profileSignaturePayload(evidence)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evidence.Signature = facility.sign(profilePayload)
+
+	// dispute returns a valid dispute by the facility, changed by a function.
+	dispute := func(change func(d *esi.PriceMapOfferDispute)) *esi.PriceMapOfferDispute {
+		d := &esi.PriceMapOfferDispute{
+			Route:                 offer.Route,
+			OfferId:               offer.OfferId,
+			Offer:                 proto.Clone(offer).(*esi.PriceMapOffer),
+			OfferSignature:        facility.sign(payload),
+			CounterpartySignature: self.sign(payload),
+			Evidence:              proto.Clone(evidence).(*esi.PowerProfile),
+			DeliveredPercentage:   90,
+		}
+		if change != nil {
+			change(d)
+		}
+		return d
+	}
+
+	tests := []struct {
+		name    string
+		src     string
+		dispute *esi.PriceMapOfferDispute
+		ok      bool
+	}{
+		{"valid", facility.publicKey, dispute(nil), true},
+		{"without evidence", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) { d.Evidence = nil }), true},
+		{"from a stranger", stranger.publicKey, dispute(nil), false},
+		{"changed offer", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.Offer.PriceMap.Price.ApparentEnergyPrice.Units = 6
+		}), false},
+		{"signed by another key", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.OfferSignature = stranger.sign(payload)
+		}), false},
+		{"no counterparty signature", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.CounterpartySignature = nil
+		}), false},
+		{"counterparty signature by the disputer", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.CounterpartySignature = facility.sign(payload)
+		}), false},
+		{"evidence not signed by the facility", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.Evidence.Signature = self.sign(profilePayload)
+		}), false},
+		{"changed evidence", facility.publicKey, dispute(func(d *esi.PriceMapOfferDispute) {
+			d.Evidence.Datum[0].PowerComponents.RealPower = 100
+		}), false},
+	}
+
+	for _, test := range tests {
+		resetOffers()
+		offerDisputes = make(map[string]*offerDispute)
+		if err := trackOffer(proto.Clone(offer).(*esi.PriceMapOffer), self.publicKey); err != nil {
+			t.Fatal(err)
+		}
+		for _, status := range statuses(esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_EXECUTING, esi.PriceMapOfferStatus_COMPLETED) {
+			if err := transitionOffer("offer", status); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := receiveDispute(test.src, test.dispute)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: receiveDispute = %v, want ok %t", test.name, err, test.ok)
+		}
+		want := esi.PriceMapOfferStatus_COMPLETED
+		if test.ok {
+			want = esi.PriceMapOfferStatus_DISPUTED
+			if err := receiveDispute(test.src, test.dispute); err == nil {
+				t.Errorf("%s: receiveDispute accepted the same dispute twice", test.name)
+			}
+		}
+		if got := offerStatus("offer"); got != want {
+			t.Errorf("%s: offerStatus = %s, want %s", test.name, got, want)
+		}
+	}
+	offerDisputes = make(map[string]*offerDispute)
+}
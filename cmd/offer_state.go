@@ -0,0 +1,244 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"time"
+)
+
+// offerTransitions maps each offer status to the statuses it may move to.
+//
+// An offer starts UNKNOWN, is then either ACCEPTED or REJECTED (a counter offer rejects the previous offer), and an
+// ACCEPTED offer is EXECUTING from its start time until it is COMPLETED, or FAILED if the facility could not carry it
+// out. An offer may also be EXPIRED if it is never answered, or CANCELLED before it starts executing. Either party may
+// dispute a COMPLETED or FAILED offer once, which is DISPUTED until resolved as COMPLETED or FAILED. Any status not
+// listed is final.
+var offerTransitions = map[esi.PriceMapOfferStatus_Status][]esi.PriceMapOfferStatus_Status{
+	esi.PriceMapOfferStatus_UNKNOWN: {
+		esi.PriceMapOfferStatus_ACCEPTED,
+		esi.PriceMapOfferStatus_REJECTED,
+		esi.PriceMapOfferStatus_EXPIRED,
+		esi.PriceMapOfferStatus_CANCELLED,
+	},
+	esi.PriceMapOfferStatus_ACCEPTED: {
+		esi.PriceMapOfferStatus_EXECUTING,
+		esi.PriceMapOfferStatus_CANCELLED,
+	},
+	esi.PriceMapOfferStatus_EXECUTING: {
+		esi.PriceMapOfferStatus_COMPLETED,
+		esi.PriceMapOfferStatus_FAILED,
+	},
+	esi.PriceMapOfferStatus_COMPLETED: {
+		esi.PriceMapOfferStatus_DISPUTED,
+	},
+	esi.PriceMapOfferStatus_FAILED: {
+		esi.PriceMapOfferStatus_DISPUTED,
+	},
+	esi.PriceMapOfferStatus_DISPUTED: {
+		esi.PriceMapOfferStatus_COMPLETED,
+		esi.PriceMapOfferStatus_FAILED,
+	},
+}
+
+// offerProposers is the public key of the party which made each offer, by uuid.
+var offerProposers = make(map[string]string)
+
+// offerTransitionError is returned when an offer cannot move to a status.
+type offerTransitionError struct {
+	uuid string
+	from esi.PriceMapOfferStatus_Status
+	to   esi.PriceMapOfferStatus_Status
+}
+
+// Error implements error.
+func (e *offerTransitionError) Error() string {
+	if e.from == esi.PriceMapOfferStatus_NONE {
+		return fmt.Sprintf("no offer with the uuid: '%s'", e.uuid)
+	}
+	return fmt.Sprintf("offer '%s' cannot move from %s to %s", e.uuid, e.from, e.to)
+}
+
+// canTransitionOffer returns true if an offer may move from one status to another.
+func canTransitionOffer(from esi.PriceMapOfferStatus_Status, to esi.PriceMapOfferStatus_Status) bool {
+	for _, status := range offerTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// offerStatus returns the current status of an offer, or NONE if the offer is unknown.
+func offerStatus(uuid string) esi.PriceMapOfferStatus_Status {
+	return priceMapOfferStatus[uuid].GetStatus()
+}
+
+// trackOffer stores a new offer made by a proposer with the status UNKNOWN.
+//
+// An offer ID may only be used once, so an error is returned if the offer is already known.
+func trackOffer(offer *esi.PriceMapOffer, proposer string) error {
+	uuid := offer.GetOfferId().GetUuid()
+	if uuid == "" {
+		return fmt.Errorf("offer has no uuid")
+	}
+	if _, ok := priceMapOffers[uuid]; ok {
+		return fmt.Errorf("offer '%s' already exists", uuid)
+	}
+
+	priceMapOffers[uuid] = offer
+	offerProposers[uuid] = proposer
+	offerTimes[uuid] = time.Now()
+	priceMapOfferStatus[uuid] = &esi.PriceMapOfferStatus{
+		Route:   offer.Route,
+		OfferId: offer.OfferId,
+		Status:  esi.PriceMapOfferStatus_UNKNOWN,
+	}
+	scheduleOffers()
+
+	return nil
+}
+
+// proposeOffer proposes a new offer to a facility signed by this coordination node, stored with the status UNKNOWN.
+//
+// An offer may be made against an entry of the facility price map catalogue, or 0 if not.
+func proposeOffer(facilityKey string, priceMap *esi.PriceMap, when *timestamppb.Timestamp, catalogueEntry uint32) (*esi.PriceMapOffer, error) {
+	uuid, err := newUuid()
+	if err != nil {
+		return nil, err
+	}
+	offer := esi.PriceMapOffer{
+		Route: &esi.DerRoute{
+			FacilityKey: facilityKey,
+			ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+		},
+		OfferId:        &esi.Uuid{Uuid: uuid},
+		When:           when,
+		PriceMap:       priceMap,
+		Node:           &esi.NodeType{Type: esi.NodeType_FACILITY},
+		RespondBy:      newRespondBy(when),
+		CatalogueEntry: catalogueEntry,
+	}
+	offer.Signature, err = signOffer(&offer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = trackOffer(&offer, coordinationNodeInfo.GetPublicKey())
+	if err != nil {
+		return nil, err
+	}
+	err = esi.ProposePriceMapOffer(coordinationNodeClient, &offer)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"dest": facilityKey,
+		"uuid": uuid,
+	}).Info("Sent proposal")
+
+	return &offer, nil
+}
+
+// transitionOffer moves an offer to a new status, if allowed by offerTransitions.
+func transitionOffer(uuid string, to esi.PriceMapOfferStatus_Status) error {
+	from := offerStatus(uuid)
+	if !canTransitionOffer(from, to) {
+		return &offerTransitionError{uuid: uuid, from: from, to: to}
+	}
+	priceMapOfferStatus[uuid].Status = to
+	scheduleOffers()
+
+	log.WithFields(log.Fields{
+		"uuid": uuid,
+		"from": from,
+		"to":   to,
+	}).Debug("Offer status changed")
+
+	switch to {
+	case esi.PriceMapOfferStatus_ACCEPTED:
+		// An accepted upstream offer is passed on to the downstream facilities in aggregator mode.
+		disaggregateOffer(uuid)
+	case esi.PriceMapOfferStatus_REJECTED, esi.PriceMapOfferStatus_EXPIRED, esi.PriceMapOfferStatus_CANCELLED:
+		// A downstream offer which will never be carried out leaves part of its upstream offer uncovered.
+		dropDownstreamOffer(uuid)
+	}
+
+	return nil
+}
+
+// routeCounterparty returns the public key of the other party of a route to a party.
+func routeCounterparty(route *esi.DerRoute, publicKey string) string {
+	if route.GetFacilityKey() == publicKey {
+		return route.GetExchangeKey()
+	}
+
+	return route.GetFacilityKey()
+}
+
+// offerRecipient returns the public key of the party an offer was made to, which alone may answer it.
+func offerRecipient(uuid string) string {
+	return routeCounterparty(priceMapOffers[uuid].GetRoute(), offerProposers[uuid])
+}
+
+// checkOfferRecipient returns an error if a party is not the one an offer was made to.
+func checkOfferRecipient(src string, uuid string) error {
+	if offerRecipient(uuid) != src {
+		return fmt.Errorf("offer '%s' was not made to '%s'", uuid, src)
+	}
+
+	return nil
+}
+
+// peerOffer returns an offer that a peer is party to, or an error if the offer is unknown or the peer is not party to
+// it.
+func peerOffer(src string, uuid string) (*esi.PriceMapOffer, error) {
+	offer, ok := priceMapOffers[uuid]
+	if !ok {
+		return nil, &offerTransitionError{uuid: uuid}
+	}
+	if offer.Route.GetFacilityKey() != src && offer.Route.GetExchangeKey() != src {
+		return nil, fmt.Errorf("not a party to offer '%s'", uuid)
+	}
+
+	return offer, nil
+}
+
+// sendOfferError returns an error for an offer message to the peer that sent it.
+func sendOfferError(dest string, route *esi.DerRoute, offerId *esi.Uuid, offerErr error) {
+	offerError := esi.PriceMapOfferError{
+		Route:   route,
+		OfferId: offerId,
+		Status:  offerStatus(offerId.GetUuid()),
+		Message: offerErr.Error(),
+	}
+	err := esi.SendPriceMapOfferError(coordinationNodeClient, dest, &offerError)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"dest":  dest,
+		"uuid":  offerId.GetUuid(),
+		"error": offerErr.Error(),
+	}).Warn("Rejected offer message")
+}
@@ -0,0 +1,155 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"testing"
+)
+
+// resetOffers clears the offer state shared between tests.
+func resetOffers() {
+	priceMapOffers = make(map[string]*esi.PriceMapOffer)
+	priceMapOfferStatus = make(map[string]*esi.PriceMapOfferStatus)
+	offerProposers = make(map[string]string)
+}
+
+// testOffer tracks an offer from an exchange to a facility and moves it to a status through the allowed transitions.
+func testOffer(t *testing.T, uuid string, path ...esi.PriceMapOfferStatus_Status) {
+	t.Helper()
+	offer := &esi.PriceMapOffer{
+		Route:   &esi.DerRoute{FacilityKey: "facility", ExchangeKey: "exchange"},
+		OfferId: &esi.Uuid{Uuid: uuid},
+	}
+	if err := trackOffer(offer, "exchange"); err != nil {
+		t.Fatalf("trackOffer(%s) = %v", uuid, err)
+	}
+	for _, status := range path {
+		if err := transitionOffer(uuid, status); err != nil {
+			t.Fatalf("transitionOffer(%s, %s) = %v", uuid, status, err)
+		}
+	}
+}
+
+// statuses returns a list of offer statuses.
+func statuses(s ...esi.PriceMapOfferStatus_Status) []esi.PriceMapOfferStatus_Status {
+	return s
+}
+
+func TestTransitionOfferLifecycles(t *testing.T) {
+	const (
+		accepted  = esi.PriceMapOfferStatus_ACCEPTED
+		rejected  = esi.PriceMapOfferStatus_REJECTED
+		expired   = esi.PriceMapOfferStatus_EXPIRED
+		cancelled = esi.PriceMapOfferStatus_CANCELLED
+		executing = esi.PriceMapOfferStatus_EXECUTING
+		completed = esi.PriceMapOfferStatus_COMPLETED
+		failed    = esi.PriceMapOfferStatus_FAILED
+		disputed  = esi.PriceMapOfferStatus_DISPUTED
+	)
+	tests := []struct {
+		name string
+		// path is the moves which must succeed from UNKNOWN.
+		path []esi.PriceMapOfferStatus_Status
+		// illegal are the moves which must fail from the end of the path.
+		illegal []esi.PriceMapOfferStatus_Status
+	}{
+		{"accepted", statuses(accepted), statuses(accepted, rejected, expired, completed, disputed)},
+		{"cancelled after accepting", statuses(accepted, cancelled), statuses(accepted, executing)},
+		{"executing", statuses(accepted, executing), statuses(cancelled, expired, disputed)},
+		{"completed", statuses(accepted, executing, completed), statuses(failed, cancelled, executing)},
+		{"failed", statuses(accepted, executing, failed), statuses(completed, cancelled, executing)},
+		{"disputed", statuses(accepted, executing, completed, disputed), statuses(disputed, cancelled, executing)},
+		{"resolved", statuses(accepted, executing, failed, disputed, completed), statuses(failed, executing)},
+	}
+
+	for _, test := range tests {
+		resetOffers()
+		testOffer(t, "offer", test.path...)
+		want := test.path[len(test.path)-1]
+		for _, to := range test.illegal {
+			if err := transitionOffer("offer", to); err == nil {
+				t.Errorf("%s: transitionOffer to %s succeeded", test.name, to)
+			}
+			if got := offerStatus("offer"); got != want {
+				t.Fatalf("%s: offerStatus after an illegal move to %s = %s, want %s", test.name, to, got, want)
+			}
+		}
+	}
+}
+
+func TestTransitionOfferUnknownUuid(t *testing.T) {
+	resetOffers()
+
+	err := transitionOffer("missing", esi.PriceMapOfferStatus_ACCEPTED)
+	if err == nil {
+		t.Fatal("transitionOffer of an unknown uuid succeeded")
+	}
+	if e, ok := err.(*offerTransitionError); !ok || e.from != esi.PriceMapOfferStatus_NONE {
+		t.Errorf("transitionOffer of an unknown uuid = %v, want an offerTransitionError from NONE", err)
+	}
+}
+
+func TestTransitionOfferIllegalMove(t *testing.T) {
+	resetOffers()
+	testOffer(t, "offer")
+
+	err := transitionOffer("offer", esi.PriceMapOfferStatus_COMPLETED)
+	if err == nil {
+		t.Fatal("transitionOffer from UNKNOWN to COMPLETED succeeded")
+	}
+	if got := offerStatus("offer"); got != esi.PriceMapOfferStatus_UNKNOWN {
+		t.Errorf("offerStatus after an illegal move = %s, want UNKNOWN", got)
+	}
+}
+
+func TestTransitionOfferFinalStatuses(t *testing.T) {
+	finals := statuses(
+		esi.PriceMapOfferStatus_REJECTED,
+		esi.PriceMapOfferStatus_EXPIRED,
+		esi.PriceMapOfferStatus_CANCELLED,
+	)
+
+	for _, final := range finals {
+		resetOffers()
+		testOffer(t, "offer", final)
+		for toValue := range esi.PriceMapOfferStatus_Status_name {
+			to := esi.PriceMapOfferStatus_Status(toValue)
+			if err := transitionOffer("offer", to); err == nil {
+				t.Errorf("transitionOffer from %s to %s succeeded", final, to)
+			}
+			if got := offerStatus("offer"); got != final {
+				t.Fatalf("offerStatus after leaving %s = %s", final, got)
+			}
+		}
+	}
+}
+
+func TestOfferRecipient(t *testing.T) {
+	resetOffers()
+	testOffer(t, "offer")
+
+	if got := offerRecipient("offer"); got != "facility" {
+		t.Errorf("offerRecipient = %s, want facility", got)
+	}
+	if err := checkOfferRecipient("exchange", "offer"); err == nil {
+		t.Error("checkOfferRecipient accepted the proposer")
+	}
+	if err := checkOfferRecipient("facility", "offer"); err != nil {
+		t.Errorf("checkOfferRecipient(facility) = %v", err)
+	}
+}
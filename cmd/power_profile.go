@@ -0,0 +1,345 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/abiosoft/ishell"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// telemetrySampleSecondsCfgKey is the config key of the number of seconds between power samples.
+	telemetrySampleSecondsCfgKey = "telemetry.sample-seconds"
+	// telemetryMaxSamplesCfgKey is the config key of the number of power samples kept.
+	telemetryMaxSamplesCfgKey = "telemetry.max-samples"
+
+	// defaultTelemetrySampleSeconds is the default number of seconds between power samples.
+	defaultTelemetrySampleSeconds = 5
+	// defaultTelemetryMaxSamples is the default number of power samples kept, a day of samples every 5 seconds.
+	defaultTelemetryMaxSamples = 17280
+)
+
+// powerSample is the power measured at a time.
+type powerSample struct {
+	time  time.Time
+	power *esi.PowerComponents
+}
+
+var (
+	// powerSamples are the power samples recorded by this coordination node, from earliest to latest.
+	powerSamples []powerSample
+	// powerSamplesMutex guards powerSamples, which are recorded and read on different goroutines.
+	powerSamplesMutex sync.Mutex
+	// facilityPowerProfiles are the latest power profiles received from facilities engaged in an exchange role.
+	facilityPowerProfiles = make(map[string]*esi.PowerProfile)
+)
+
+// coordinationNodeTelemetryRecorder records the power measured by the dispatch adapter at a regular period.
+func coordinationNodeTelemetryRecorder() {
+	sampleSeconds := viper.GetInt64(telemetrySampleSecondsCfgKey)
+	if sampleSeconds <= 0 {
+		sampleSeconds = defaultTelemetrySampleSeconds
+	}
+
+	for {
+		dispatchMutex.Lock()
+		measurePowerSample()
+		dispatchMutex.Unlock()
+
+		time.Sleep(time.Second * time.Duration(sampleSeconds))
+	}
+}
+
+// measurePowerSample records the power measured by the dispatch adapter, which must be locked.
+//
+// The sample is timed before measuring, so that a sample is never timed after an offer starts or stops being carried
+// out while measuring the power before it.
+func measurePowerSample() {
+	now := time.Now()
+	power, err := dispatcher.measure()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warn("Could not measure power")
+		return
+	}
+
+	recordPowerSample(powerSample{time: now, power: power})
+}
+
+// recordPowerSample records a power sample, dropping the earliest samples to keep at most the configured number.
+func recordPowerSample(sample powerSample) {
+	maxSamples := viper.GetInt(telemetryMaxSamplesCfgKey)
+	if maxSamples <= 0 {
+		maxSamples = defaultTelemetryMaxSamples
+	}
+
+	powerSamplesMutex.Lock()
+	defer powerSamplesMutex.Unlock()
+
+	powerSamples = append(powerSamples, sample)
+	if len(powerSamples) > maxSamples {
+		powerSamples = powerSamples[len(powerSamples)-maxSamples:]
+	}
+}
+
+// timeUnitBucket returns the start and end of the span of time units containing a time.
+//
+// Spans are aligned to whole multiples of the coalesced time unit in UTC, so that the same request always gives the
+// same spans. Weeks start on a Monday.
+func timeUnitBucket(t time.Time, unit esi.TimeUnit, coalescence int) (time.Time, time.Time, error) {
+	t = t.UTC()
+	n := coalescence
+	if n < 1 {
+		n = 1
+	}
+
+	var size time.Duration
+	switch unit {
+	case esi.TimeUnit_SECOND:
+		size = time.Second
+	case esi.TimeUnit_MINUTE:
+		size = time.Minute
+	case esi.TimeUnit_HOUR:
+		size = time.Hour
+	case esi.TimeUnit_DAY:
+		size = 24 * time.Hour
+	case esi.TimeUnit_WEEK:
+		size = 7 * 24 * time.Hour
+	case esi.TimeUnit_MONTH:
+		months := t.Year()*12 + int(t.Month()) - 1
+		months -= months % n
+		start := time.Date(months/12, time.Month(months%12+1), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, n, 0), nil
+	case esi.TimeUnit_YEAR:
+		year := t.Year() - t.Year()%n
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(n, 0, 0), nil
+	default:
+		return time.Time{}, time.Time{}, fmt.Errorf("cannot group by %s", unit)
+	}
+
+	// Truncate aligns to multiples of the size since the zero time, which is a Monday.
+	start := t.Truncate(size * time.Duration(n))
+
+	return start, start.Add(size * time.Duration(n)), nil
+}
+
+// powerProfile returns the power profile of this coordination node for a datum request.
+//
+// In aggregator mode, the profile is the combined power of the downstream facilities, which carry out its offers.
+func powerProfile(request *esi.DatumRequest) ([]*esi.PowerProfileDatum, error) {
+	if aggregatorEnabled() {
+		return samplesProfile(aggregatedPowerSamples(), request)
+	}
+
+	powerSamplesMutex.Lock()
+	samples := append([]powerSample{}, powerSamples...)
+	powerSamplesMutex.Unlock()
+
+	return samplesProfile(samples, request)
+}
+
+// samplesProfile returns the power profile of power samples for a datum request.
+//
+// Instant requests give every sample as its own datum. Otherwise samples are grouped into spans of the requested time
+// unit and coalescence, and each span gives the mean power of its samples. A time range gives every sample or span
+// within it, and the most recent time concept gives only the latest sample or span.
+func samplesProfile(samples []powerSample, request *esi.DatumRequest) ([]*esi.PowerProfileDatum, error) {
+	timeRange := request.GetTimeRange()
+	if timeRange != nil {
+		var inRange []powerSample
+		for _, sample := range samples {
+			if !sample.time.Before(timeRange.GetMin().AsTime()) && sample.time.Before(timeRange.GetMax().AsTime()) {
+				inRange = append(inRange, sample)
+			}
+		}
+		samples = inRange
+	}
+
+	var profile []*esi.PowerProfileDatum
+	if request.TimeUnit == esi.TimeUnit_INSTANT {
+		for _, sample := range samples {
+			profile = append(profile, &esi.PowerProfileDatum{
+				Ts:              timestamppb.New(sample.time),
+				TimeUnit:        esi.TimeUnit_INSTANT,
+				PowerComponents: sample.power,
+			})
+		}
+	} else {
+		var bucket []powerSample
+		var bucketStart, bucketEnd time.Time
+		flush := func() {
+			if len(bucket) > 0 {
+				profile = append(profile, &esi.PowerProfileDatum{
+					Ts:              timestamppb.New(bucketStart),
+					TimeLength:      uint32(math.Max(float64(request.TimeUnitCoalescence), 1)),
+					TimeUnit:        request.TimeUnit,
+					PowerComponents: meanPower(bucket),
+				})
+			}
+		}
+		for _, sample := range samples {
+			if len(bucket) == 0 || !sample.time.Before(bucketEnd) {
+				flush()
+				start, end, err := timeUnitBucket(sample.time, request.TimeUnit, int(request.TimeUnitCoalescence))
+				if err != nil {
+					return nil, err
+				}
+				bucket, bucketStart, bucketEnd = nil, start, end
+			}
+			bucket = append(bucket, sample)
+		}
+		flush()
+	}
+
+	// Anything but a time range asks for the most recent datum.
+	if timeRange == nil && len(profile) > 0 {
+		profile = profile[len(profile)-1:]
+	}
+
+	return profile, nil
+}
+
+// profileSamples returns the power samples of a power profile, from earliest to latest.
+func profileSamples(datum []*esi.PowerProfileDatum) []powerSample {
+	samples := make([]powerSample, 0, len(datum))
+	for _, d := range datum {
+		samples = append(samples, powerSample{time: d.GetTs().AsTime(), power: d.GetPowerComponents()})
+	}
+	sort.SliceStable(samples, func(i, j int) bool {
+		return samples[i].time.Before(samples[j].time)
+	})
+
+	return samples
+}
+
+// aggregatedPowerSamples returns the combined power of the facilities engaged in an exchange role, from the latest
+// power profiles received from them.
+//
+// Each facility is taken to hold the power of its latest datum until its next one, and no power before its first, so
+// that there is a sample at every time any facility measured its power.
+func aggregatedPowerSamples() []powerSample {
+	type facilitySample struct {
+		facilityKey string
+		sample      powerSample
+	}
+	var all []facilitySample
+	for facilityKey, profile := range facilityPowerProfiles {
+		for _, sample := range profileSamples(profile.GetDatum()) {
+			all = append(all, facilitySample{facilityKey: facilityKey, sample: sample})
+		}
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].sample.time.Before(all[j].sample.time)
+	})
+
+	var samples []powerSample
+	latest := make(map[string]*esi.PowerComponents)
+	for i, s := range all {
+		latest[s.facilityKey] = s.sample.power
+		// Every facility measured at the same time is counted before the combined sample is taken.
+		if i+1 < len(all) && all[i+1].sample.time.Equal(s.sample.time) {
+			continue
+		}
+		total := &esi.PowerComponents{}
+		for _, power := range latest {
+			total.RealPower += power.GetRealPower()
+			total.ReactivePower += power.GetReactivePower()
+		}
+		samples = append(samples, powerSample{time: s.sample.time, power: total})
+	}
+
+	return samples
+}
+
+// meanPower returns the mean power of several samples, rounded to the nearest whole unit.
+func meanPower(samples []powerSample) *esi.PowerComponents {
+	var real, reactive float64
+	for _, sample := range samples {
+		real += float64(sample.power.GetRealPower())
+		reactive += float64(sample.power.GetReactivePower())
+	}
+
+	return &esi.PowerComponents{
+		RealPower:     int64(math.Round(real / float64(len(samples)))),
+		ReactivePower: int64(math.Round(reactive / float64(len(samples)))),
+	}
+}
+
+// newDatumRequest prompts for a new datum request, without a route.
+//
+// No number of seconds asks for the most recent datum, otherwise every datum over that many seconds until now.
+func newDatumRequest(shell *ishell.Shell, c *ishell.Context) (*esi.DatumRequest, error) {
+	shell.Printf("Time Unit [%s]: ", esi.TimeUnit_INSTANT)
+	unitString := strings.ToUpper(c.ReadLine())
+	if unitString == "" {
+		unitString = esi.TimeUnit_INSTANT.String()
+	}
+	unit, ok := esi.TimeUnit_value[unitString]
+	if !ok {
+		return nil, fmt.Errorf("unknown time unit: '%s'", unitString)
+	}
+
+	shell.Print("Coalescence [1]: ")
+	coalescenceString := c.ReadLine()
+	if coalescenceString == "" {
+		coalescenceString = "1"
+	}
+	coalescence, err := strconv.ParseUint(coalescenceString, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &esi.DatumRequest{
+		TimeUnit:            esi.TimeUnit(unit),
+		TimeUnitCoalescence: uint32(coalescence),
+	}
+
+	shell.Print("Seconds Back [most recent]: ")
+	secondsString := c.ReadLine()
+	if secondsString == "" {
+		request.TimeStyleOneof = &esi.DatumRequest_TimeConcept{TimeConcept: esi.TimeConcept_MOST_RECENT}
+		return request, nil
+	}
+	seconds, err := strconv.ParseInt(secondsString, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if seconds <= 0 {
+		return nil, fmt.Errorf("seconds back must be positive")
+	}
+	now := time.Now()
+	request.TimeStyleOneof = &esi.DatumRequest_TimeRange{
+		TimeRange: &esi.TimestampRange{
+			Min: timestamppb.New(now.Add(-time.Duration(seconds) * time.Second)),
+			Max: timestamppb.New(now.Add(time.Second)),
+		},
+	}
+
+	return request, nil
+}
@@ -0,0 +1,131 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/abiosoft/ishell"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/duration"
+	"strconv"
+)
+
+var (
+	// priceMapCatalogue is the catalogue of price maps offered by a coordination node behaving as a facility.
+	//
+	// Each entry describes a capability of the facility, for example 10 kW for 30 minutes at one price and 50 kW for 5
+	// minutes at another, and exchanges make offers against a chosen entry. Entries are numbered by their position, so
+	// a removed entry is left as a tombstone rather than renumbering the entries after it.
+	priceMapCatalogue []*esi.PriceMap
+	// facilityCatalogues are the price map catalogues of the currently stored facilities engaged in an exchange role.
+	facilityCatalogues = make(map[string]*esi.PriceMapCharacteristics)
+)
+
+// catalogueEntry returns an entry of a price map catalogue, counting from 1.
+func catalogueEntry(catalogue []*esi.PriceMap, entry uint32) (*esi.PriceMap, error) {
+	if entry == 0 || int(entry) > len(catalogue) || removedCatalogueEntry(catalogue[entry-1]) {
+		return nil, fmt.Errorf("no catalogue entry %d", entry)
+	}
+
+	return catalogue[entry-1], nil
+}
+
+// removedCatalogueEntry returns true if a catalogue entry is the tombstone of a removed entry.
+//
+// Every entry is added with a duration, so an entry without one has been removed.
+func removedCatalogueEntry(entry *esi.PriceMap) bool {
+	return entry.GetDuration() == nil
+}
+
+// removeCatalogueEntry replaces an entry of the local price map catalogue with a tombstone, keeping the numbers of
+// the other entries.
+func removeCatalogueEntry(entry uint32) error {
+	_, err := catalogueEntry(priceMapCatalogue, entry)
+	if err != nil {
+		return err
+	}
+	priceMapCatalogue[entry-1] = &esi.PriceMap{}
+
+	return nil
+}
+
+// checkCatalogueOffer returns an error if an offer made against the local price map catalogue does not match its
+// entry.
+//
+// The price may be negotiated, but the power and duration of the entry are what the facility is able to deliver.
+func checkCatalogueOffer(offer *esi.PriceMapOffer) error {
+	if offer.GetCatalogueEntry() == 0 {
+		return nil
+	}
+	entry, err := catalogueEntry(priceMapCatalogue, offer.GetCatalogueEntry())
+	if err != nil {
+		return err
+	}
+
+	if !proto.Equal(entry.GetPowerComponents(), offer.GetPriceMap().GetPowerComponents()) ||
+		!proto.Equal(entry.GetDuration(), offer.GetPriceMap().GetDuration()) {
+		return fmt.Errorf("offer does not match catalogue entry %d", offer.GetCatalogueEntry())
+	}
+
+	return nil
+}
+
+// newCatalogueEntry prompts for a new price map with a duration, to be added to the price map catalogue.
+func newCatalogueEntry(shell *ishell.Shell, c *ishell.Context) (*esi.PriceMap, error) {
+	entry, err := newPriceMap(shell, c, defaultRealPower, defaultReactivePower, defaultUnits)
+	if err != nil {
+		return nil, err
+	}
+
+	shell.Printf("Duration Seconds [%d]: ", defaultDuration)
+	secondsString := c.ReadLine()
+	if secondsString == "" {
+		secondsString = strconv.Itoa(defaultDuration)
+	}
+	seconds, err := strconv.ParseInt(secondsString, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if seconds <= 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	}
+	entry.Duration = &duration.Duration{
+		Seconds: seconds,
+		Nanos:   0,
+	}
+
+	return entry, nil
+}
+
+// printCatalogue prints each entry of a price map catalogue with its number, skipping removed entries.
+func printCatalogue(shell *ishell.Shell, catalogue []*esi.PriceMap) {
+	empty := true
+	for i, entry := range catalogue {
+		if removedCatalogueEntry(entry) {
+			continue
+		}
+		empty = false
+		shell.Printf("\n%s %d\n%s\n",
+			boldMsgColorFunc("Entry:"),
+			i+1,
+			proto.MarshalTextString(entry))
+	}
+	if empty {
+		shell.Println("catalogue is empty")
+	}
+}
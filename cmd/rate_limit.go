@@ -0,0 +1,188 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"math"
+	"time"
+)
+
+const (
+	// rateLimitsCfgKey is the config key containing the rate limits by message type.
+	//
+	// For example, "rate-limits.QueryDerFacilities.rate" is the number of QueryDerFacilities messages a sender may send
+	// each second, and "rate-limits.QueryDerFacilities.burst" is the number it may send at once. The limit named
+	// "default" is used for any message type without its own limit.
+	rateLimitsCfgKey = "rate-limits"
+	// defaultRateLimitName is the name of the rate limit used for message types without their own limit.
+	defaultRateLimitName = "default"
+
+	// maxPendingFormsCfgKey is the config key of the max number of unsubmitted registration forms per facility.
+	maxPendingFormsCfgKey = "max-pending-forms"
+	// defaultMaxPendingForms is the default max number of unsubmitted registration forms per facility.
+	defaultMaxPendingForms = 3
+	// maxPendingOffersCfgKey is the config key of the max number of unanswered offers per peer.
+	maxPendingOffersCfgKey = "max-pending-offers"
+	// defaultMaxPendingOffers is the default max number of unanswered offers per peer.
+	defaultMaxPendingOffers = 10
+
+	// bucketSweepInterval is how often token buckets which have refilled are evicted.
+	bucketSweepInterval = time.Minute
+)
+
+// defaultRateLimits are the rate limits used when none are configured.
+//
+// Messages which cause work for anyone on the network, such as generating a registration form or searching a registry,
+// are limited more strictly.
+var defaultRateLimits = map[string]rateLimit{
+	defaultRateLimitName:             {Rate: 5, Burst: 20},
+	"GetDerFacilityRegistrationForm": {Rate: 1.0 / 60, Burst: 3},
+	"SignupRegistry":                 {Rate: 1.0 / 60, Burst: 3},
+	"QueryDerFacilities":             {Rate: 1, Burst: 5},
+}
+
+// rateLimit is the number of messages a sender may send each second, and the number it may send at once.
+type rateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// tokenBucket is the remaining allowance of a sender for a message type.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  rateLimit
+}
+
+// refill adds the tokens earned since the bucket was last refilled, up to the burst.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// rateLimiter drops messages from senders which exceed the rate limit of a message type.
+type rateLimiter struct {
+	// buckets are the token buckets by sender and message type.
+	buckets map[string]*tokenBucket
+	// dropped is the number of dropped messages by message type.
+	dropped map[string]int
+	// lastSweep is when token buckets were last evicted.
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a new rate limiter.
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets:   make(map[string]*tokenBucket),
+		dropped:   make(map[string]int),
+		lastSweep: time.Now(),
+	}
+}
+
+// limitOf returns the rate limit of a message type, as configured or by default.
+func limitOf(message string) rateLimit {
+	for _, name := range []string{message, defaultRateLimitName} {
+		key := fmt.Sprintf("%s.%s", rateLimitsCfgKey, name)
+		if viper.IsSet(key) {
+			return rateLimit{
+				Rate:  viper.GetFloat64(key + ".rate"),
+				Burst: viper.GetFloat64(key + ".burst"),
+			}
+		}
+		if limit, ok := defaultRateLimits[name]; ok {
+			return limit
+		}
+	}
+
+	return defaultRateLimits[defaultRateLimitName]
+}
+
+// allow returns true if the sender is within the rate limit of the message type, and takes a token if so.
+//
+// Dropped messages are logged and counted.
+func (r *rateLimiter) allow(src string, message string) bool {
+	now := time.Now()
+	if now.Sub(r.lastSweep) >= bucketSweepInterval {
+		r.sweep(now)
+	}
+
+	key := src + "/" + message
+	bucket, ok := r.buckets[key]
+	if !ok {
+		limit := limitOf(message)
+		bucket = &tokenBucket{tokens: limit.Burst, last: now, limit: limit}
+		r.buckets[key] = bucket
+	}
+
+	// Refill the bucket for the time passed, up to the burst.
+	bucket.refill(now)
+
+	if bucket.tokens >= 1 {
+		bucket.tokens -= 1
+		return true
+	}
+
+	r.drop(src, message, "rate limit exceeded")
+
+	return false
+}
+
+// sweep evicts every token bucket which has refilled to its burst.
+//
+// A full bucket allows exactly what a new bucket would, so evicting it changes nothing for the sender, and keeps the
+// buckets from growing with every sender ever seen.
+func (r *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range r.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.limit.Burst {
+			delete(r.buckets, key)
+		}
+	}
+	r.lastSweep = now
+}
+
+// drop logs and counts a dropped message.
+func (r *rateLimiter) drop(src string, message string, reason string) {
+	r.dropped[message] += 1
+	log.WithFields(log.Fields{
+		"src":     src,
+		"message": message,
+		"reason":  reason,
+		"dropped": r.dropped[message],
+	}).Warn("Dropped message")
+}
+
+// maxPendingForms returns the configured max number of unsubmitted registration forms per facility.
+func maxPendingForms() int {
+	if viper.IsSet(maxPendingFormsCfgKey) {
+		return viper.GetInt(maxPendingFormsCfgKey)
+	}
+
+	return defaultMaxPendingForms
+}
+
+// maxPendingOffers returns the configured max number of unanswered offers per peer.
+func maxPendingOffers() int {
+	if viper.IsSet(maxPendingOffersCfgKey) {
+		return viper.GetInt(maxPendingOffersCfgKey)
+	}
+
+	return defaultMaxPendingOffers
+}
@@ -0,0 +1,195 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// automaticApproval approves any registration which passes the form rules.
+	automaticApproval = "automatic"
+	// manualApproval queues any registration which passes the form rules to be approved or rejected in the shell.
+	manualApproval = "manual"
+)
+
+// registrationApproval is the result of a registration approval stage.
+type registrationApproval int
+
+const (
+	// approveRegistration passes a registration to the next stage, or approves it if there are no stages left.
+	approveRegistration registrationApproval = iota
+	// rejectRegistration rejects a registration, with a reason.
+	rejectRegistration
+	// queueRegistration holds a registration until it is approved or rejected in the shell.
+	queueRegistration
+)
+
+// registrationApprovalStage is a single stage of the registration approval pipeline.
+type registrationApprovalStage interface {
+	// approve returns the result of the stage for a submitted registration form, and a reason if rejected.
+	approve(facilityKey string, formData *esi.DerFacilityRegistrationFormData) (registrationApproval, string)
+}
+
+// sentFormKey identifies a registration form sent to a facility.
+type sentFormKey struct {
+	facilityKey string
+	formKey     string
+}
+
+var (
+	// sentRegistrationForms is the language code of each sent registration form by facility key and form key.
+	//
+	// A form key is only valid for the facility it was sent to, so that a facility cannot submit another's form.
+	sentRegistrationForms = make(map[sentFormKey]string)
+	// pendingApprovals are the submitted registration forms waiting for manual approval by facility key.
+	//
+	// SECURE_TEXT values are redacted before being queued.
+	pendingApprovals = make(map[string]*esi.DerFacilityRegistrationFormData)
+)
+
+// registrationApprovalPipeline returns the stages run on each submitted registration form, in order.
+func registrationApprovalPipeline() []registrationApprovalStage {
+	stages := []registrationApprovalStage{formRulesStage{}}
+	if registrationForms.Approval == manualApproval {
+		stages = append(stages, manualApprovalStage{})
+	}
+
+	return stages
+}
+
+// approveRegistrationForm runs a submitted registration form through the registration approval pipeline.
+func approveRegistrationForm(facilityKey string, formData *esi.DerFacilityRegistrationFormData) (registrationApproval, string) {
+	for _, stage := range registrationApprovalPipeline() {
+		result, reason := stage.approve(facilityKey, formData)
+		if result != approveRegistration {
+			return result, reason
+		}
+	}
+
+	return approveRegistration, ""
+}
+
+// completeRegistration registers a facility if successful, and sends the result of its registration.
+func completeRegistration(facilityKey string, success bool, reason string) {
+	if success {
+		registeredFacilities[facilityKey] = true
+	}
+	delete(registrationApplicants, facilityKey)
+	delete(pendingApprovals, facilityKey)
+
+	registration := esi.DerFacilityRegistration{
+		Route: &esi.DerRoute{
+			FacilityKey: facilityKey,
+			ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+		},
+		Success: success,
+		Reason:  reason,
+	}
+	err := esi.CompleteDerFacilityRegistration(coordinationNodeClient, &registration)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	log.WithFields(log.Fields{
+		"dest":    facilityKey,
+		"success": success,
+		"reason":  reason,
+	}).Info("Sent completed registration form")
+}
+
+// formRulesStage checks submitted form data against the rules of each setting in the registration form.
+type formRulesStage struct{}
+
+// approve implements registrationApprovalStage.
+func (formRulesStage) approve(facilityKey string, formData *esi.DerFacilityRegistrationFormData) (registrationApproval, string) {
+	languageCode, ok := sentRegistrationForms[sentFormKey{facilityKey, formData.GetData().GetKey()}]
+	if !ok {
+		return rejectRegistration, "unknown registration form"
+	}
+	data := formData.GetData().GetData()
+
+	for _, setting := range registrationForms.find(languageCode).Settings {
+		err := setting.validate(data[setting.Key])
+		if err != nil {
+			return rejectRegistration, err.Error()
+		}
+	}
+
+	return approveRegistration, ""
+}
+
+// manualApprovalStage holds a registration until it is approved or rejected in the shell.
+type manualApprovalStage struct{}
+
+// approve implements registrationApprovalStage.
+func (manualApprovalStage) approve(facilityKey string, formData *esi.DerFacilityRegistrationFormData) (registrationApproval, string) {
+	form := newRegistrationForm(sentRegistrationForms[sentFormKey{facilityKey, formData.GetData().GetKey()}], formData.GetData().GetKey())
+	pendingApprovals[facilityKey] = &esi.DerFacilityRegistrationFormData{
+		Route: formData.GetRoute(),
+		Data:  esi.RedactFormData(form, formData.GetData()),
+	}
+
+	return queueRegistration, ""
+}
+
+// validate checks a value against the rules of a setting.
+//
+// The error of a failed rule is the message of the setting, if given, so that it can be returned to the facility.
+func (s *formSettingTemplate) validate(value string) error {
+	if strings.EqualFold(s.Type, esi.FormSetting_INFO.String()) {
+		return nil
+	}
+	fail := func(format string, a ...interface{}) error {
+		if s.Message != "" {
+			return fmt.Errorf("%s", s.Message)
+		}
+		return fmt.Errorf("'%s' %s", s.Label, fmt.Sprintf(format, a...))
+	}
+
+	if strings.TrimSpace(value) == "" {
+		if s.Required {
+			return fail("is required")
+		}
+		return nil
+	}
+	if s.Pattern != "" {
+		matched, err := regexp.MatchString(s.Pattern, value)
+		if err != nil || !matched {
+			return fail("is invalid")
+		}
+	}
+	if s.Min != nil || s.Max != nil {
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return fail("must be a number")
+		}
+		if s.Min != nil && number < *s.Min {
+			return fail("must be at least %g", *s.Min)
+		}
+		if s.Max != nil && number > *s.Max {
+			return fail("must be at most %g", *s.Max)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/spf13/viper"
+	"regexp"
+	"strings"
+)
+
+const (
+	// registrationFormsCfgKey is the config key of the registration forms file path.
+	registrationFormsCfgKey = "registration-forms"
+)
+
+// registrationFormTemplates are the registration forms sent by a coordination node behaving as an exchange, read from a
+// JSON or YAML file.
+//
+// Each form is a variant of the same registration form in a different language.
+type registrationFormTemplates struct {
+	// DefaultLanguage is the language code of the form sent when no form matches the requested language.
+	DefaultLanguage string `mapstructure:"default-language"`
+	// Approval is how a registration which passes the form rules is approved: automatic or manual.
+	Approval string `mapstructure:"approval"`
+	// Forms are the language variants of the registration form.
+	Forms []registrationFormTemplate `mapstructure:"forms"`
+}
+
+// registrationFormTemplate is a single language variant of a registration form.
+type registrationFormTemplate struct {
+	// LanguageCode is the BCP-47 language code of the form, for example "en" or "zh-Hant".
+	LanguageCode string `mapstructure:"language-code"`
+	// Settings are the settings (fields) of the form.
+	Settings []formSettingTemplate `mapstructure:"settings"`
+}
+
+// formSettingTemplate is a single setting of a registration form.
+type formSettingTemplate struct {
+	// Type is the name of the setting type: INFO, TEXT or SECURE_TEXT.
+	Type        string `mapstructure:"type"`
+	Key         string `mapstructure:"key"`
+	Label       string `mapstructure:"label"`
+	Caption     string `mapstructure:"caption"`
+	Placeholder string `mapstructure:"placeholder"`
+	// Required rejects a registration if the setting is left empty.
+	Required bool `mapstructure:"required"`
+	// Pattern is a regular expression that a non-empty value must match.
+	Pattern string `mapstructure:"pattern"`
+	// Min and Max are the numeric bounds of a non-empty value, if given.
+	Min *float64 `mapstructure:"min"`
+	Max *float64 `mapstructure:"max"`
+	// Message is the reason given to the facility if the value breaks a rule.
+	Message string `mapstructure:"message"`
+}
+
+// defaultRegistrationForms are the registration forms used when no registration forms file is given.
+var defaultRegistrationForms = registrationFormTemplates{
+	DefaultLanguage: defaultLanguage,
+	Approval:        automaticApproval,
+	Forms: []registrationFormTemplate{
+		{
+			LanguageCode: defaultLanguage,
+			Settings: []formSettingTemplate{
+				{
+					Type:        esi.FormSetting_TEXT.String(),
+					Key:         "0",
+					Label:       "Do you wish to register?",
+					Placeholder: "Y",
+					Required:    true,
+					Pattern:     "^(?i)(y|yes)$",
+					Message:     "registration declined",
+				},
+			},
+		},
+	},
+}
+
+// registrationForms are the registration forms currently sent by the coordination node.
+var registrationForms = defaultRegistrationForms
+
+// readRegistrationForms reads and validates a JSON or YAML registration forms file.
+func readRegistrationForms(path string) (*registrationFormTemplates, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	err := v.ReadInConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	templates := registrationFormTemplates{}
+	err = v.Unmarshal(&templates)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(templates.Forms) == 0 {
+		return nil, fmt.Errorf("%s: no forms found", path)
+	}
+	for _, form := range templates.Forms {
+		if form.LanguageCode == "" {
+			return nil, fmt.Errorf("%s: form without a language code", path)
+		}
+		keys := make(map[string]bool)
+		for _, setting := range form.Settings {
+			if _, ok := esi.FormSetting_FormSettingType_value[strings.ToUpper(setting.Type)]; !ok {
+				return nil, fmt.Errorf("%s: setting '%s' has unknown type '%s'", path, setting.Key, setting.Type)
+			}
+			if setting.Key == "" || keys[setting.Key] {
+				return nil, fmt.Errorf("%s: setting keys must be given and unique in form '%s'", path, form.LanguageCode)
+			}
+			keys[setting.Key] = true
+			if setting.Pattern != "" {
+				_, err = regexp.Compile(setting.Pattern)
+				if err != nil {
+					return nil, fmt.Errorf("%s: setting '%s' has invalid pattern: %s", path, setting.Key, err)
+				}
+			}
+			if setting.Min != nil && setting.Max != nil && *setting.Min > *setting.Max {
+				return nil, fmt.Errorf("%s: setting '%s' has min greater than max", path, setting.Key)
+			}
+		}
+	}
+	switch templates.Approval {
+	case "":
+		templates.Approval = automaticApproval
+	case automaticApproval, manualApproval:
+	default:
+		return nil, fmt.Errorf("%s: unknown approval '%s'", path, templates.Approval)
+	}
+	if templates.DefaultLanguage == "" {
+		templates.DefaultLanguage = templates.Forms[0].LanguageCode
+	}
+
+	return &templates, nil
+}
+
+// find returns the form best matching a language code.
+//
+// An exact match is preferred, followed by a match on a less specific language code (so that "en-NZ" matches "en"),
+// followed by the default language, followed by the first form.
+func (t *registrationFormTemplates) find(languageCode string) *registrationFormTemplate {
+	for code := languageCode; code != ""; {
+		for i := range t.Forms {
+			if strings.EqualFold(t.Forms[i].LanguageCode, code) {
+				return &t.Forms[i]
+			}
+		}
+
+		i := strings.LastIndex(code, "-")
+		if i < 0 {
+			break
+		}
+		code = code[:i]
+	}
+
+	for i := range t.Forms {
+		if strings.EqualFold(t.Forms[i].LanguageCode, t.DefaultLanguage) {
+			return &t.Forms[i]
+		}
+	}
+
+	return &t.Forms[0]
+}
+
+// newRegistrationForm returns a new form with the given key, in the language best matching a language code.
+func newRegistrationForm(languageCode string, key string) *esi.Form {
+	template := registrationForms.find(languageCode)
+
+	form := esi.Form{
+		Key:          key,
+		LanguageCode: template.LanguageCode,
+	}
+	for _, setting := range template.Settings {
+		form.Settings = append(form.Settings, &esi.FormSetting{
+			Type:        esi.FormSetting_FormSettingType(esi.FormSetting_FormSettingType_value[strings.ToUpper(setting.Type)]),
+			Key:         setting.Key,
+			Label:       setting.Label,
+			Caption:     setting.Caption,
+			Placeholder: setting.Placeholder,
+		})
+	}
+
+	return &form
+}
@@ -24,6 +24,9 @@ import (
 	"strings"
 )
 
+// registryRateLimiter limits the messages received from each coordination node.
+var registryRateLimiter = newRateLimiter()
+
 // registryMessageReceiver receives and returns any incoming registry messages.
 func registryMessageReceiver() {
 	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
@@ -51,6 +54,11 @@ func registryMessageReceiver() {
 			continue
 		}
 
+		// Check that the source is within its rate limit, as defined in rate_limit.go.
+		if !registryRateLimiter.allow(msg.Src, chunkName(message)) {
+			continue
+		}
+
 		// Case documentation located at api/esi/der_facility_registry_service.go.
 		//
 		// Switch based upon the message type.
@@ -95,6 +103,28 @@ func registryMessageReceiver() {
 					}).Info("Sent known coordination node")
 				}
 			}
+
+		case *esi.RegistryMessage_RotateCoordinationNodeKey:
+			// Only the old key may announce its replacement.
+			rotation := x.RotateCoordinationNodeKey
+			err = verifyKeyRotation(rotation)
+			if err != nil || rotation.GetOldPublicKey() != msg.Src {
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+				}).Warn("Rejected key rotation")
+				continue
+			}
+
+			if coordinationNode, ok := knownCoordinationNodes[rotation.GetOldPublicKey()]; ok {
+				delete(knownCoordinationNodes, rotation.GetOldPublicKey())
+				coordinationNode.PublicKey = rotation.GetNewPublicKey()
+				knownCoordinationNodes[rotation.GetNewPublicKey()] = coordinationNode
+
+				log.WithFields(log.Fields{
+					"src": msg.Src,
+					"new": rotation.GetNewPublicKey(),
+				}).Info("Replaced coordination node key")
+			}
 		}
 	}
 }
@@ -74,6 +74,8 @@ const (
 	secretKeySuffix = ".secret"
 	// logSuffix is the suffix used when storing log files.
 	logSuffix = ".log"
+	// offersSuffix is the suffix used when storing offers.
+	offersSuffix = ".offers.json"
 )
 
 // rootCmd represents the base command when called without any subcommands.
@@ -0,0 +1,277 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// deliveryEntryKind is a ledger entry for the energy delivered by an offer.
+	deliveryEntryKind = "delivery"
+	// penaltyEntryKind is a ledger entry for the penalty charged for cancelling an offer.
+	penaltyEntryKind = "penalty"
+
+	// nanosPerUnit is the number of nano units in a whole currency unit.
+	nanosPerUnit = 1e9
+)
+
+// ledgerEntry is an amount owed between this coordination node and a counterparty for an offer.
+type ledgerEntry struct {
+	// Time is when the amount fell due, the end of a delivered offer or the cancellation of an offer.
+	Time time.Time `json:"time"`
+	// Offer is the uuid of the offer.
+	Offer string `json:"offer"`
+	// Counterparty is the public key of the other party of the offer.
+	Counterparty string `json:"counterparty"`
+	// Kind is either delivery or penalty.
+	Kind string `json:"kind"`
+	// Currency is the ISO 4217 currency code of the amount.
+	Currency string `json:"currency"`
+	// EnergyVAh is the apparent energy delivered, in VAh, or 0 for a penalty.
+	EnergyVAh float64 `json:"energy-vah"`
+	// AmountNanos is the amount in nano units, positive if owed to this coordination node and negative if owed by it.
+	AmountNanos int64 `json:"-"`
+	// Amount is the amount as a decimal.
+	Amount string `json:"amount"`
+}
+
+// ledgerTotal is the total owed between this coordination node and a counterparty in a currency.
+type ledgerTotal struct {
+	// Counterparty is the public key of the other party.
+	Counterparty string `json:"counterparty"`
+	// Currency is the ISO 4217 currency code of the total.
+	Currency string `json:"currency"`
+	// AmountNanos is the total in nano units, positive if owed to this coordination node and negative if owed by it.
+	AmountNanos int64 `json:"-"`
+	// Amount is the total as a decimal.
+	Amount string `json:"amount"`
+}
+
+// ledgerStatement is the ledger entries and totals for a billing period.
+type ledgerStatement struct {
+	// From and To are the start and end of the billing period, including From but not To.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// Entries are the entries in the billing period, from earliest to latest.
+	Entries []ledgerEntry `json:"entries"`
+	// Totals are the totals of the entries by counterparty and currency.
+	Totals []ledgerTotal `json:"totals"`
+}
+
+// formatNanos returns an amount in nano units as a decimal, without trailing zeros.
+func formatNanos(nanos int64) string {
+	sign := ""
+	if nanos < 0 {
+		sign = "-"
+		nanos = -nanos
+	}
+	amount := fmt.Sprintf("%s%d.%09d", sign, nanos/nanosPerUnit, nanos%nanosPerUnit)
+
+	return strings.TrimSuffix(strings.TrimRight(amount, "0"), ".")
+}
+
+// moneyNanos returns an amount of money in nano units.
+func moneyNanos(money *esi.Money) int64 {
+	return money.GetUnits()*nanosPerUnit + int64(money.GetNanos())
+}
+
+// settledPercentage returns the percentage of the committed power an offer is settled for, or false if it is not
+// settled.
+//
+// A COMPLETED offer is settled once the exchange accepted its feedback, or once a dispute over it was resolved, at the
+// percentage agreed. Offers are paid for at most the power committed.
+func settledPercentage(uuid string) (float64, bool) {
+	if offerStatus(uuid) != esi.PriceMapOfferStatus_COMPLETED {
+		return 0, false
+	}
+
+	var percentage float64
+	if d, ok := offerDisputes[uuid]; ok {
+		if d.resolution == nil {
+			return 0, false
+		}
+		percentage = float64(d.resolution.GetDeliveredPercentage())
+	} else {
+		feedback, ok := offerFeedback[uuid]
+		if !ok || !offerFeedbackAccepted[uuid] {
+			return 0, false
+		}
+		percentage = float64(feedback.GetDeliveredPercentage())
+	}
+
+	return math.Max(0, math.Min(percentage, 100)), true
+}
+
+// offerEnergy returns the apparent energy delivered by an offer at a percentage of its committed power, in VAh.
+func offerEnergy(offer *esi.PriceMapOffer, percentage float64) float64 {
+	power := offer.GetPriceMap().GetPowerComponents()
+	apparentPower := math.Hypot(float64(power.GetRealPower()), float64(power.GetReactivePower()))
+	hours := offer.GetPriceMap().GetDuration().AsDuration().Hours()
+
+	return apparentPower * hours * percentage / 100
+}
+
+// ledgerEntries returns every amount owed between this coordination node and its counterparties, from earliest to
+// latest.
+//
+// A settled offer is owed by the exchange to the facility at the apparent energy price of the offer for each VAh
+// delivered, and a cancellation penalty is owed by the party which cancelled the offer to the other party.
+func ledgerEntries() []ledgerEntry {
+	self := coordinationNodeInfo.GetPublicKey()
+
+	var entries []ledgerEntry
+	for uuid, offer := range priceMapOffers {
+		price := offer.GetPriceMap().GetPrice().GetApparentEnergyPrice()
+		counterparty := offerPeer(offer)
+
+		if percentage, ok := settledPercentage(uuid); ok {
+			energy := offerEnergy(offer, percentage)
+			amount := int64(math.Round(float64(moneyNanos(price)) * energy))
+			if offer.Route.GetExchangeKey() == self {
+				amount = -amount
+			}
+			entries = append(entries, ledgerEntry{
+				Time:         time.Unix(offerEnd(offer), 0).UTC(),
+				Offer:        uuid,
+				Counterparty: counterparty,
+				Kind:         deliveryEntryKind,
+				Currency:     price.GetCurrencyCode(),
+				EnergyVAh:    energy,
+				AmountNanos:  amount,
+				Amount:       formatNanos(amount),
+			})
+		}
+
+		if penalty, ok := offerPenalties[uuid]; ok {
+			amount := penalty.nanos
+			if penalty.payer == self {
+				amount = -amount
+			}
+			entries = append(entries, ledgerEntry{
+				Time:         penalty.time.UTC(),
+				Offer:        uuid,
+				Counterparty: counterparty,
+				Kind:         penaltyEntryKind,
+				Currency:     price.GetCurrencyCode(),
+				AmountNanos:  amount,
+				Amount:       formatNanos(amount),
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Time.Before(entries[j].Time)
+		}
+		return entries[i].Offer < entries[j].Offer
+	})
+
+	return entries
+}
+
+// newLedgerStatement returns the ledger entries from a start time until an end time, with their totals by
+// counterparty and currency.
+func newLedgerStatement(from time.Time, to time.Time) ledgerStatement {
+	statement := ledgerStatement{From: from.UTC(), To: to.UTC(), Entries: []ledgerEntry{}}
+	for _, entry := range ledgerEntries() {
+		if entry.Time.Before(from) || !entry.Time.Before(to) {
+			continue
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+	statement.Totals = ledgerTotals(statement.Entries)
+
+	return statement
+}
+
+// ledgerBalances returns the totals of every ledger entry by counterparty and currency, whenever it fell due.
+func ledgerBalances() []ledgerTotal {
+	return ledgerTotals(ledgerEntries())
+}
+
+// ledgerTotals returns the totals of ledger entries by counterparty and currency.
+func ledgerTotals(entries []ledgerEntry) []ledgerTotal {
+	byKey := make(map[[2]string]*ledgerTotal)
+	for _, entry := range entries {
+		key := [2]string{entry.Counterparty, entry.Currency}
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = &ledgerTotal{Counterparty: entry.Counterparty, Currency: entry.Currency}
+		}
+		byKey[key].AmountNanos += entry.AmountNanos
+	}
+
+	totals := []ledgerTotal{}
+	for _, total := range byKey {
+		total.Amount = formatNanos(total.AmountNanos)
+		totals = append(totals, *total)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].Counterparty != totals[j].Counterparty {
+			return totals[i].Counterparty < totals[j].Counterparty
+		}
+		return totals[i].Currency < totals[j].Currency
+	})
+
+	return totals
+}
+
+// writeStatementJson writes a ledger statement as JSON.
+func writeStatementJson(w io.Writer, statement ledgerStatement) error {
+	jsonBytes, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(jsonBytes, '\n'))
+
+	return err
+}
+
+// writeStatementCsv writes the entries of a ledger statement as CSV, with a header row.
+func writeStatementCsv(w io.Writer, statement ledgerStatement) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"time", "offer", "counterparty", "kind", "currency", "energy-vah", "amount"})
+	if err != nil {
+		return err
+	}
+	for _, entry := range statement.Entries {
+		err = writer.Write([]string{
+			entry.Time.Format(time.RFC3339),
+			entry.Offer,
+			entry.Counterparty,
+			entry.Kind,
+			entry.Currency,
+			strconv.FormatFloat(entry.EnergyVAh, 'f', -1, 64),
+			entry.Amount,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+
+	return writer.Error()
+}
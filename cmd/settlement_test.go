@@ -0,0 +1,197 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"testing"
+	"time"
+)
+
+// resetSettlement clears the offer state used to settle offers between tests.
+func resetSettlement() {
+	resetOffers()
+	offerFeedback = make(map[string]*esi.PriceMapOfferFeedback)
+	offerFeedbackAccepted = make(map[string]bool)
+	offerDisputes = make(map[string]*offerDispute)
+	offerPenalties = make(map[string]*offerPenalty)
+}
+
+// testSettledOffer tracks an hour long offer of 100 W from an exchange to a facility at 2.5 USD per VAh, and moves it
+// to a status through the allowed transitions.
+func testSettledOffer(t *testing.T, uuid string, path ...esi.PriceMapOfferStatus_Status) {
+	t.Helper()
+	offer := &esi.PriceMapOffer{
+		Route:   &esi.DerRoute{FacilityKey: "facility", ExchangeKey: "exchange"},
+		OfferId: &esi.Uuid{Uuid: uuid},
+		When:    &timestamppb.Timestamp{Seconds: 1600000000},
+		PriceMap: &esi.PriceMap{
+			PowerComponents: &esi.PowerComponents{RealPower: 100},
+			Duration:        &duration.Duration{Seconds: 3600},
+			Price: &esi.PriceComponents{
+				ApparentEnergyPrice: &esi.Money{CurrencyCode: "USD", Units: 2, Nanos: 500000000},
+			},
+		},
+	}
+	if err := trackOffer(offer, "exchange"); err != nil {
+		t.Fatalf("trackOffer(%s) = %v", uuid, err)
+	}
+	for _, status := range path {
+		if err := transitionOffer(uuid, status); err != nil {
+			t.Fatalf("transitionOffer(%s, %s) = %v", uuid, status, err)
+		}
+	}
+}
+
+func TestFormatNanos(t *testing.T) {
+	tests := []struct {
+		nanos int64
+		want  string
+	}{
+		{0, "0"},
+		{1000000000, "1"},
+		{10000000000, "10"},
+		{1500000000, "1.5"},
+		{123450000000, "123.45"},
+		{1, "0.000000001"},
+		{500000000, "0.5"},
+		{-1, "-0.000000001"},
+		{-500000000, "-0.5"},
+		{-1500000000, "-1.5"},
+		{-10000000000, "-10"},
+	}
+
+	for _, test := range tests {
+		if got := formatNanos(test.nanos); got != test.want {
+			t.Errorf("formatNanos(%d) = %s, want %s", test.nanos, got, test.want)
+		}
+	}
+}
+
+func TestMoneyNanos(t *testing.T) {
+	tests := []struct {
+		money *esi.Money
+		want  int64
+	}{
+		{nil, 0},
+		{&esi.Money{Units: 2, Nanos: 500000000}, 2500000000},
+		{&esi.Money{Units: 0, Nanos: 1}, 1},
+		{&esi.Money{Units: -2, Nanos: -500000000}, -2500000000},
+		{&esi.Money{Units: 0, Nanos: -1}, -1},
+	}
+
+	for _, test := range tests {
+		if got := moneyNanos(test.money); got != test.want {
+			t.Errorf("moneyNanos(%v) = %d, want %d", test.money, got, test.want)
+		}
+	}
+}
+
+func TestSettledPercentage(t *testing.T) {
+	completed := statuses(esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_EXECUTING, esi.PriceMapOfferStatus_COMPLETED)
+	failed := statuses(esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_EXECUTING, esi.PriceMapOfferStatus_FAILED)
+
+	tests := []struct {
+		name       string
+		path       []esi.PriceMapOfferStatus_Status
+		feedback   float32
+		accepted   bool
+		resolution *esi.PriceMapOfferDisputeResolution
+		disputed   bool
+		want       float64
+		ok         bool
+	}{
+		{name: "accepted feedback", path: completed, feedback: 95, accepted: true, want: 95, ok: true},
+		{name: "over the committed power", path: completed, feedback: 120, accepted: true, want: 100, ok: true},
+		{name: "under the baseline", path: completed, feedback: -10, accepted: true, want: 0, ok: true},
+		{name: "feedback not accepted", path: completed, feedback: 95},
+		{name: "failed", path: failed, feedback: 95, accepted: true},
+		{name: "unresolved dispute", path: completed, feedback: 95, disputed: true},
+		{
+			name:       "resolved dispute",
+			path:       completed,
+			feedback:   95,
+			disputed:   true,
+			resolution: &esi.PriceMapOfferDisputeResolution{DeliveredPercentage: 80},
+			want:       80,
+			ok:         true,
+		},
+	}
+
+	for _, test := range tests {
+		resetSettlement()
+		testSettledOffer(t, "offer", test.path...)
+		offerFeedback["offer"] = &esi.PriceMapOfferFeedback{DeliveredPercentage: test.feedback}
+		offerFeedbackAccepted["offer"] = test.accepted
+		if test.disputed {
+			offerDisputes["offer"] = &offerDispute{resolution: test.resolution}
+		}
+
+		got, ok := settledPercentage("offer")
+		if ok != test.ok || got != test.want {
+			t.Errorf("%s: settledPercentage = %.1f, %t, want %.1f, %t", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestLedgerEntrySigns(t *testing.T) {
+	completed := statuses(esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_EXECUTING, esi.PriceMapOfferStatus_COMPLETED)
+	cancelled := statuses(esi.PriceMapOfferStatus_ACCEPTED, esi.PriceMapOfferStatus_CANCELLED)
+
+	tests := []struct {
+		name  string
+		self  string
+		path  []esi.PriceMapOfferStatus_Status
+		payer string
+		kind  string
+		want  int64
+	}{
+		// 100 W for an hour is 100 VAh, at 2.5 per VAh.
+		{name: "delivery to the exchange", self: "exchange", path: completed, kind: deliveryEntryKind, want: -250000000000},
+		{name: "delivery to the facility", self: "facility", path: completed, kind: deliveryEntryKind, want: 250000000000},
+		{name: "penalty paid by the exchange", self: "exchange", path: cancelled, payer: "exchange", kind: penaltyEntryKind, want: -1500000001},
+		{name: "penalty owed to the facility", self: "facility", path: cancelled, payer: "exchange", kind: penaltyEntryKind, want: 1500000001},
+		{name: "penalty owed to the exchange", self: "exchange", path: cancelled, payer: "facility", kind: penaltyEntryKind, want: 1500000001},
+		{name: "penalty paid by the facility", self: "facility", path: cancelled, payer: "facility", kind: penaltyEntryKind, want: -1500000001},
+	}
+
+	for _, test := range tests {
+		restore := useTestKey(testKey{publicKey: test.self})
+		resetSettlement()
+		testSettledOffer(t, "offer", test.path...)
+		offerFeedback["offer"] = &esi.PriceMapOfferFeedback{DeliveredPercentage: 100}
+		offerFeedbackAccepted["offer"] = true
+		if test.payer != "" {
+			offerPenalties["offer"] = &offerPenalty{payer: test.payer, nanos: 1500000001, time: time.Unix(1600000000, 0)}
+		}
+
+		entries := ledgerEntries()
+		restore()
+		if len(entries) != 1 {
+			t.Errorf("%s: ledgerEntries = %d entries, want 1", test.name, len(entries))
+			continue
+		}
+		entry := entries[0]
+		if entry.Kind != test.kind || entry.AmountNanos != test.want || entry.Amount != formatNanos(test.want) {
+			t.Errorf("%s: ledger entry = %s %d (%s), want %s %d", test.name, entry.Kind, entry.AmountNanos, entry.Amount,
+				test.kind, test.want)
+		}
+	}
+	resetSettlement()
+}
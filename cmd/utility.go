@@ -21,6 +21,7 @@ import (
 	"errors"
 	"github.com/gofrs/uuid"
 	"github.com/nknorg/nkn-sdk-go"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -94,7 +95,7 @@ func writeSecretKey(keyPath string) (string, error) {
 	}
 
 	// Convert the key to a hex and write it to the desired path.
-	err = ioutil.WriteFile(keyPath, []byte(formatBinary(newKey)), os.ModePerm)
+	err = writeSeed(keyPath, newKey)
 	if err != nil {
 		return "", err
 	}
@@ -103,6 +104,11 @@ func writeSecretKey(keyPath string) (string, error) {
 	return formatBinary(client.PubKey()), nil
 }
 
+// writeSeed writes a secret seed to the desired path as a hex.
+func writeSeed(keyPath string, seed []byte) error {
+	return ioutil.WriteFile(keyPath, []byte(formatBinary(seed)), os.ModePerm)
+}
+
 // validateCfgKeyPair validates that the provided public key is expected of the created client.
 func validateCfgKeyPair(cfgPublic string, client *nkn.MultiClient) error {
 	publicBytes, err := hex.DecodeString(cfgPublic)
@@ -132,6 +138,17 @@ func newUuid() (string, error) {
 	return newUuid.String(), nil
 }
 
+// chunkName returns the name of the chunk set in a RegistryMessage or CoordinationNodeMessage.
+func chunkName(message protoreflect.ProtoMessage) string {
+	m := message.ProtoReflect()
+	field := m.WhichOneof(m.Descriptor().Oneofs().ByName("chunk"))
+	if field == nil {
+		return ""
+	}
+
+	return string(field.Name())
+}
+
 // randomPrice returns a random price value.
 func randomPrice(low int, high int) (int64, error) {
 	rand.Seed(unixSeconds())
@@ -0,0 +1,356 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
+	"time"
+)
+
+const (
+	// verificationCfgKey is the config key containing the measurement and verification settings.
+	verificationCfgKey = "verification"
+
+	// defaultBaselinePeriods is the default number of periods before an offer its baseline is the mean of.
+	defaultBaselinePeriods = 3
+	// defaultSatisfiedPercentage is the default percentage of the committed power which satisfies an offer.
+	defaultSatisfiedPercentage = 90
+	// deliveredPercentageSlack is how far the delivered percentage claimed by a facility may be from the percentage
+	// worked out again by the exchange, allowing for rounding.
+	deliveredPercentageSlack = 1
+)
+
+// verificationSettings are the measurement and verification settings, read from the config file.
+type verificationSettings struct {
+	// BaselinePeriods is the number of periods before an offer the baseline is the mean of.
+	BaselinePeriods int `mapstructure:"baseline-periods"`
+	// PeriodSeconds is the length of a baseline period, or the duration of the offer if 0. A day compares the offer
+	// to the same time on previous days.
+	PeriodSeconds int64 `mapstructure:"period-seconds"`
+	// SatisfiedPercentage is the percentage of the committed real power which must be delivered to satisfy an offer.
+	SatisfiedPercentage float64 `mapstructure:"satisfied-percentage"`
+}
+
+// verification are the measurement and verification settings used to check the delivery of offers.
+var verification = verificationSettings{
+	BaselinePeriods:     defaultBaselinePeriods,
+	SatisfiedPercentage: defaultSatisfiedPercentage,
+}
+
+var (
+	// offerFeedback is the feedback sent or received on each finished offer, by uuid.
+	offerFeedback = make(map[string]*esi.PriceMapOfferFeedback)
+	// offerFeedbackAccepted is true for each finished offer whose feedback the exchange accepted, by uuid.
+	offerFeedbackAccepted = make(map[string]bool)
+	// pendingVerifications are the uuids of the offers whose feedback is waiting on a power profile to be verified, by
+	// the uuid of the datum request sent for it.
+	pendingVerifications = make(map[string]string)
+)
+
+// offerVerification is the outcome of measuring the delivery of an offer against its baseline.
+type offerVerification struct {
+	// status is SATISFIED or DISPUTED if the delivery could be measured, otherwise UNKNOWN.
+	status esi.PriceMapOfferFeedback_ObligationStatus
+	// message describes why the offer was not satisfied, if it was not.
+	message string
+	// deliveredPercentage is the percentage of the committed real power delivered.
+	deliveredPercentage float32
+	// baseline is the mean power over the periods before the offer.
+	baseline *esi.PowerComponents
+	// measured is the mean power while the offer was executing.
+	measured *esi.PowerComponents
+}
+
+// readVerificationSettings returns the configured measurement and verification settings.
+func readVerificationSettings() (verificationSettings, error) {
+	settings := verificationSettings{
+		BaselinePeriods:     defaultBaselinePeriods,
+		SatisfiedPercentage: defaultSatisfiedPercentage,
+	}
+	if viper.IsSet(verificationCfgKey) {
+		err := viper.UnmarshalKey(verificationCfgKey, &settings)
+		if err != nil {
+			return settings, err
+		}
+	}
+	if settings.BaselinePeriods < 0 || settings.PeriodSeconds < 0 {
+		return settings, fmt.Errorf("baseline periods and period seconds cannot be negative")
+	}
+
+	return settings, nil
+}
+
+// samplesBetween returns the power samples from a start time until an end time.
+func samplesBetween(samples []powerSample, from time.Time, to time.Time) []powerSample {
+	var between []powerSample
+	for _, sample := range samples {
+		if !sample.time.Before(from) && sample.time.Before(to) {
+			between = append(between, sample)
+		}
+	}
+
+	return between
+}
+
+// deliveredPercentage returns the percentage of the committed real power delivered above the baseline.
+//
+// An offer of no real power is fully delivered.
+func deliveredPercentage(committed *esi.PowerComponents, baseline *esi.PowerComponents, measured *esi.PowerComponents) float32 {
+	if committed.GetRealPower() == 0 {
+		return 100
+	}
+	delivered := measured.GetRealPower() - baseline.GetRealPower()
+
+	return float32(100 * float64(delivered) / float64(committed.GetRealPower()))
+}
+
+// verifyOffer measures the delivery of an offer which has finished executing against its baseline, from the power
+// samples recorded by this coordination node.
+func verifyOffer(offer *esi.PriceMapOffer, started time.Time, settings verificationSettings) offerVerification {
+	powerSamplesMutex.Lock()
+	samples := append([]powerSample{}, powerSamples...)
+	powerSamplesMutex.Unlock()
+
+	return measureDelivery(offer, started, samples, settings)
+}
+
+// verificationWindow returns the start of the earliest baseline period of an offer and the end of the offer, between
+// which every power sample needed to measure its delivery falls.
+func verificationWindow(offer *esi.PriceMapOffer, settings verificationSettings) (time.Time, time.Time) {
+	start := time.Unix(offer.GetWhen().GetSeconds(), 0)
+	duration := time.Duration(offer.GetPriceMap().GetDuration().GetSeconds()) * time.Second
+	period := time.Duration(settings.PeriodSeconds) * time.Second
+	if period <= 0 {
+		period = duration
+	}
+
+	return start.Add(-time.Duration(settings.BaselinePeriods) * period), start.Add(duration).Add(time.Second)
+}
+
+// measureDelivery measures the delivery of an offer which has finished executing against its baseline, from power
+// samples.
+//
+// The baseline is the mean power over the samples in the same window of each of the periods before the offer, or no
+// power if there are none, as for equipment which was idle. The measured power is the mean power over the samples
+// from when the offer started being carried out until it ended.
+func measureDelivery(offer *esi.PriceMapOffer, started time.Time, samples []powerSample, settings verificationSettings) offerVerification {
+	start := time.Unix(offer.GetWhen().GetSeconds(), 0)
+	duration := time.Duration(offer.GetPriceMap().GetDuration().GetSeconds()) * time.Second
+	end := start.Add(duration)
+	if started.Before(start) {
+		started = start
+	}
+	period := time.Duration(settings.PeriodSeconds) * time.Second
+	if period <= 0 {
+		period = duration
+	}
+
+	var baselineSamples []powerSample
+	for k := 1; k <= settings.BaselinePeriods; k++ {
+		from := start.Add(-time.Duration(k) * period)
+		baselineSamples = append(baselineSamples, samplesBetween(samples, from, from.Add(duration))...)
+	}
+	baseline := &esi.PowerComponents{}
+	if len(baselineSamples) > 0 {
+		baseline = meanPower(baselineSamples)
+	}
+
+	measuredSamples := samplesBetween(samples, started, end.Add(time.Second))
+	if len(measuredSamples) == 0 {
+		return offerVerification{
+			status:   esi.PriceMapOfferFeedback_UNKNOWN,
+			message:  "no power was measured while the offer was executing",
+			baseline: baseline,
+		}
+	}
+	measured := meanPower(measuredSamples)
+
+	verification := offerVerification{
+		status:              esi.PriceMapOfferFeedback_SATISFIED,
+		deliveredPercentage: deliveredPercentage(offer.GetPriceMap().GetPowerComponents(), baseline, measured),
+		baseline:            baseline,
+		measured:            measured,
+	}
+	if float64(verification.deliveredPercentage) < settings.SatisfiedPercentage {
+		verification.status = esi.PriceMapOfferFeedback_DISPUTED
+		verification.message = fmt.Sprintf("delivered %.1f%% of the committed power, under %.1f%%",
+			verification.deliveredPercentage, settings.SatisfiedPercentage)
+	}
+
+	return verification
+}
+
+// verifyFeedback returns true if an exchange accepts the feedback of a facility on an offer, with the reason if not.
+//
+// The delivery is measured by the exchange from the power profile of the facility, never taken from the feedback. A
+// facility which admits it could not carry out the offer is taken at its word, as it is not paid for it. Otherwise the
+// delivered percentage claimed must agree with the one measured, and an offer claimed to be satisfied must deliver
+// enough of the committed power.
+func verifyFeedback(feedback *esi.PriceMapOfferFeedback, measured offerVerification, settings verificationSettings) (bool, string) {
+	switch feedback.ObligationStatus {
+	case esi.PriceMapOfferFeedback_UNSATISFIED:
+		return true, ""
+	case esi.PriceMapOfferFeedback_SATISFIED, esi.PriceMapOfferFeedback_DISPUTED:
+	default:
+		return false, fmt.Sprintf("cannot verify an obligation status of %s", feedback.ObligationStatus)
+	}
+
+	if measured.status == esi.PriceMapOfferFeedback_UNKNOWN {
+		return false, "no power was measured in the power profile of the facility"
+	}
+	if math.Abs(float64(measured.deliveredPercentage-feedback.DeliveredPercentage)) > deliveredPercentageSlack {
+		return false, fmt.Sprintf("reported %.1f%% delivered, but the power profile delivers %.1f%%",
+			feedback.DeliveredPercentage, measured.deliveredPercentage)
+	}
+	if feedback.ObligationStatus == esi.PriceMapOfferFeedback_SATISFIED &&
+		float64(measured.deliveredPercentage) < settings.SatisfiedPercentage {
+		return false, fmt.Sprintf("delivered %.1f%% of the committed power, under %.1f%%",
+			measured.deliveredPercentage, settings.SatisfiedPercentage)
+	}
+
+	return true, ""
+}
+
+// feedbackVerified returns true if an exchange has finished verifying the feedback on an offer, by accepting it or
+// disputing it.
+func feedbackVerified(uuid string) bool {
+	_, disputed := offerDisputes[uuid]
+	return offerFeedbackAccepted[uuid] || disputed
+}
+
+// requestVerification asks the facility of an offer for its power profile over the baseline periods and the offer,
+// so that an exchange can measure the delivery of the offer itself.
+//
+// The feedback of the facility is answered once the profile arrives.
+func requestVerification(uuid string) error {
+	offer := priceMapOffers[uuid]
+	requestId, err := newUuid()
+	if err != nil {
+		return err
+	}
+	from, to := verificationWindow(offer, verification)
+	request := esi.DatumRequest{
+		Route: &esi.DerRoute{
+			ExchangeKey: coordinationNodeInfo.GetPublicKey(),
+			FacilityKey: offer.Route.GetFacilityKey(),
+		},
+		TimeStyleOneof: &esi.DatumRequest_TimeRange{
+			TimeRange: &esi.TimestampRange{Min: timestamppb.New(from), Max: timestamppb.New(to)},
+		},
+		TimeUnit:  esi.TimeUnit_INSTANT,
+		RequestId: &esi.Uuid{Uuid: requestId},
+	}
+	pendingVerifications[requestId] = uuid
+
+	err = esi.ListPowerProfile(coordinationNodeClient, &request)
+	if err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"dest": offer.Route.GetFacilityKey(),
+		"uuid": uuid,
+	}).Info("Requested power profile to verify offer")
+
+	return nil
+}
+
+// receiveVerification measures the delivery of an offer from the power profile its facility sent in answer to a
+// verification request, and answers the feedback of the facility. It returns false if the profile does not answer a
+// verification request.
+func receiveVerification(src string, profile *esi.PowerProfile) bool {
+	uuid, ok := pendingVerifications[profile.GetRequestId().GetUuid()]
+	if !ok || priceMapOffers[uuid].GetRoute().GetFacilityKey() != src {
+		return false
+	}
+	delete(pendingVerifications, profile.GetRequestId().GetUuid())
+	// An offer disputed while waiting on the profile is settled by the dispute instead.
+	if offerStatus(uuid) != esi.PriceMapOfferStatus_COMPLETED {
+		return true
+	}
+
+	offer := priceMapOffers[uuid]
+	start := time.Unix(offer.GetWhen().GetSeconds(), 0)
+	measured := measureDelivery(offer, start, profileSamples(profile.GetDatum()), verification)
+	accepted, reason := verifyFeedback(offerFeedback[uuid], measured, verification)
+	answerFeedback(uuid, accepted, reason, measured.deliveredPercentage)
+
+	return true
+}
+
+// answerFeedback tells the facility of an offer whether its feedback was accepted, and disputes feedback which was
+// not with the delivered percentage measured by the exchange.
+func answerFeedback(uuid string, accepted bool, reason string, percentage float32) {
+	offer := priceMapOffers[uuid]
+	offerFeedbackAccepted[uuid] = accepted
+	response := esi.PriceMapOfferFeedbackResponse{
+		Route:    offer.Route,
+		OfferId:  offer.OfferId,
+		Accepted: accepted,
+	}
+
+	log.WithFields(log.Fields{
+		"src":       offer.Route.GetFacilityKey(),
+		"uuid":      uuid,
+		"claimed":   fmt.Sprintf("%.1f%%", offerFeedback[uuid].GetDeliveredPercentage()),
+		"delivered": fmt.Sprintf("%.1f%%", percentage),
+		"accepted":  accepted,
+		"reason":    reason,
+	}).Info("Verified offer feedback")
+
+	err := esi.ProvidePriceMapOfferFeedback(coordinationNodeClient, &response)
+	if err != nil {
+		log.Error(err.Error())
+	}
+
+	// Feedback which cannot be verified is disputed with the facility, which then resolves it.
+	if !accepted {
+		err = raiseDispute(uuid, reason, percentage)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+
+	// An aggregated offer may have been waiting on the verification of this offer to finish.
+	scheduleOffers()
+}
+
+// resumeVerification asks again for the power profiles needed to verify feedback which was received but not yet
+// answered when the coordination node stopped, as verification requests are not kept across restarts.
+func resumeVerification() {
+	for uuid, offer := range priceMapOffers {
+		if offer.Route.GetExchangeKey() != coordinationNodeInfo.GetPublicKey() {
+			continue
+		}
+		feedback, ok := offerFeedback[uuid]
+		if !ok || feedback.ObligationStatus == esi.PriceMapOfferFeedback_UNSATISFIED || feedbackVerified(uuid) {
+			continue
+		}
+		if offerStatus(uuid) != esi.PriceMapOfferStatus_COMPLETED {
+			continue
+		}
+		err := requestVerification(uuid)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	}
+}
@@ -0,0 +1,176 @@
+/*
+Copyright © 2021 Ecogy Energy
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"github.com/elijahjpassmore/nkn-esi/api/esi"
+	"github.com/golang/protobuf/ptypes/duration"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"math"
+	"testing"
+	"time"
+)
+
+// testOfferStart is the start time of offers in tests.
+var testOfferStart = time.Unix(1600000000, 0)
+
+// testDeliveryOffer returns an offer of an amount of real power for an hour from testOfferStart.
+func testDeliveryOffer(realPower int64) *esi.PriceMapOffer {
+	return &esi.PriceMapOffer{
+		OfferId: &esi.Uuid{Uuid: "offer"},
+		When:    timestamppb.New(testOfferStart),
+		PriceMap: &esi.PriceMap{
+			PowerComponents: &esi.PowerComponents{RealPower: realPower},
+			Duration:        &duration.Duration{Seconds: 3600},
+		},
+	}
+}
+
+// testSample returns a power sample of real power a number of seconds after testOfferStart.
+func testSample(seconds int64, realPower int64) powerSample {
+	return powerSample{
+		time:  testOfferStart.Add(time.Duration(seconds) * time.Second),
+		power: &esi.PowerComponents{RealPower: realPower},
+	}
+}
+
+func TestMeasureDelivery(t *testing.T) {
+	settings := verificationSettings{BaselinePeriods: 2, SatisfiedPercentage: 90}
+
+	tests := []struct {
+		name       string
+		started    int64
+		samples    []powerSample
+		status     esi.PriceMapOfferFeedback_ObligationStatus
+		baseline   int64
+		percentage float32
+	}{
+		{
+			name:       "idle baseline",
+			samples:    []powerSample{testSample(60, 95)},
+			status:     esi.PriceMapOfferFeedback_SATISFIED,
+			percentage: 95,
+		},
+		{
+			name:       "baseline over both periods",
+			samples:    []powerSample{testSample(-5400, 20), testSample(-1800, 40), testSample(60, 120)},
+			status:     esi.PriceMapOfferFeedback_SATISFIED,
+			baseline:   30,
+			percentage: 90,
+		},
+		{
+			name:       "baseline before the periods ignored",
+			samples:    []powerSample{testSample(-7201, 1000), testSample(-1800, 10), testSample(60, 110)},
+			status:     esi.PriceMapOfferFeedback_SATISFIED,
+			baseline:   10,
+			percentage: 100,
+		},
+		{
+			name:       "under the satisfied percentage",
+			samples:    []powerSample{testSample(-1800, 10), testSample(60, 60)},
+			status:     esi.PriceMapOfferFeedback_DISPUTED,
+			baseline:   10,
+			percentage: 50,
+		},
+		{
+			name:       "below the baseline",
+			samples:    []powerSample{testSample(-1800, 50), testSample(60, 25)},
+			status:     esi.PriceMapOfferFeedback_DISPUTED,
+			baseline:   50,
+			percentage: -25,
+		},
+		{
+			name:       "started late",
+			started:    1800,
+			samples:    []powerSample{testSample(60, 0), testSample(1800, 100)},
+			status:     esi.PriceMapOfferFeedback_SATISFIED,
+			percentage: 100,
+		},
+		{
+			name:       "sample at the end",
+			samples:    []powerSample{testSample(60, 80), testSample(3600, 100)},
+			status:     esi.PriceMapOfferFeedback_SATISFIED,
+			percentage: 90,
+		},
+		{
+			name:     "nothing measured",
+			samples:  []powerSample{testSample(-1800, 10), testSample(3601, 100)},
+			status:   esi.PriceMapOfferFeedback_UNKNOWN,
+			baseline: 10,
+		},
+	}
+
+	for _, test := range tests {
+		started := testOfferStart.Add(time.Duration(test.started) * time.Second)
+		got := measureDelivery(testDeliveryOffer(100), started, test.samples, settings)
+		if got.status != test.status {
+			t.Errorf("%s: status = %s, want %s", test.name, got.status, test.status)
+		}
+		if got.baseline.GetRealPower() != test.baseline {
+			t.Errorf("%s: baseline = %d, want %d", test.name, got.baseline.GetRealPower(), test.baseline)
+		}
+		if math.Abs(float64(got.deliveredPercentage-test.percentage)) > 0.01 {
+			t.Errorf("%s: delivered percentage = %.2f, want %.2f", test.name, got.deliveredPercentage, test.percentage)
+		}
+	}
+}
+
+func TestDeliveredPercentageNoPower(t *testing.T) {
+	got := deliveredPercentage(&esi.PowerComponents{}, &esi.PowerComponents{RealPower: 10}, &esi.PowerComponents{})
+	if got != 100 {
+		t.Errorf("deliveredPercentage of no committed power = %.1f, want 100", got)
+	}
+}
+
+func TestVerifyFeedback(t *testing.T) {
+	settings := verificationSettings{SatisfiedPercentage: 90}
+	// measured returns a measured delivery of a percentage.
+	measured := func(percentage float32) offerVerification {
+		return offerVerification{status: esi.PriceMapOfferFeedback_SATISFIED, deliveredPercentage: percentage}
+	}
+
+	tests := []struct {
+		name     string
+		status   esi.PriceMapOfferFeedback_ObligationStatus
+		claimed  float32
+		measured offerVerification
+		ok       bool
+	}{
+		{"satisfied as measured", esi.PriceMapOfferFeedback_SATISFIED, 92, measured(92), true},
+		{"satisfied within the slack above", esi.PriceMapOfferFeedback_SATISFIED, 93, measured(92), true},
+		{"satisfied within the slack below", esi.PriceMapOfferFeedback_SATISFIED, 91, measured(92), true},
+		{"satisfied past the slack", esi.PriceMapOfferFeedback_SATISFIED, 93.5, measured(92), false},
+		{"satisfied over what was measured", esi.PriceMapOfferFeedback_SATISFIED, 100, measured(85), false},
+		{"satisfied under the satisfied percentage", esi.PriceMapOfferFeedback_SATISFIED, 89.5, measured(89), false},
+		{"disputed as measured", esi.PriceMapOfferFeedback_DISPUTED, 89, measured(89), true},
+		{"disputed past the slack", esi.PriceMapOfferFeedback_DISPUTED, 70, measured(89), false},
+		{"unsatisfied whatever was measured", esi.PriceMapOfferFeedback_UNSATISFIED, 0, measured(100), true},
+		{"nothing measured", esi.PriceMapOfferFeedback_DISPUTED, 0, offerVerification{status: esi.PriceMapOfferFeedback_UNKNOWN}, false},
+		{"unknown status", esi.PriceMapOfferFeedback_UNKNOWN, 95, measured(95), false},
+	}
+
+	for _, test := range tests {
+		feedback := &esi.PriceMapOfferFeedback{ObligationStatus: test.status, DeliveredPercentage: test.claimed}
+		ok, reason := verifyFeedback(feedback, test.measured, settings)
+		if ok != test.ok {
+			t.Errorf("%s: verifyFeedback = %t (%s), want %t", test.name, ok, reason, test.ok)
+		}
+		if !ok && reason == "" {
+			t.Errorf("%s: verifyFeedback gave no reason", test.name)
+		}
+	}
+}